@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/media"
 	"github.com/KushBlazingJudah/fedichan/util"
 	"github.com/gofiber/fiber/v2"
 )
@@ -81,15 +82,19 @@ func (actor Actor) ArchivePosts() error {
 		}
 
 		for _, e := range col.OrderedItems {
-			for _, k := range e.Replies.OrderedItems {
-				if err := k.UpdateType("Archive"); err != nil {
-					return util.WrapError(err)
+			if e.Replies != nil {
+				for _, k := range e.Replies.OrderedItems {
+					if err := k.UpdateType("Archive"); err != nil {
+						return util.WrapError(err)
+					}
 				}
 			}
 
 			if err := e.UpdateType("Archive"); err != nil {
 				return util.WrapError(err)
 			}
+
+			publish(Event{Type: "Archive", Actor: actor.Id, Thread: e.Id, Post: e.Id})
 		}
 	}
 
@@ -142,7 +147,7 @@ func (actor Actor) AutoFollow() error {
 }
 
 func (actor Actor) DeleteCache() error {
-	query := `select id from cacheactivitystream where id in (select id from cacheactivitystream where actor=$1 and id in (select id from replies where inreplyto='')) `
+	query := `select id from posts where not local and actor=$1 and id in (select id from replies where inreplyto='')`
 	rows, err := config.DB.Query(query, actor.Id)
 
 	if err != nil {
@@ -161,6 +166,8 @@ func (actor Actor) DeleteCache() error {
 		}
 	}
 
+	actor.Changed("Delete")
+
 	return nil
 }
 
@@ -168,7 +175,7 @@ func (actor Actor) GetAllArchive(offset int) (Collection, error) {
 	var nColl Collection
 	var result []ObjectBase
 
-	query := `select x.id, x.updated from (select id, updated from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' union select id, updated from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' union select id, updated from cacheactivitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note') as x order by x.updated desc offset $2`
+	query := `select id, updated from posts where (actor=$1 or actor in (select following from following where id=$1)) and id in (select id from replies where inreplyto='') and type='Note' order by updated desc offset $2`
 	rows, err := config.DB.Query(query, actor.Id, offset)
 
 	if err != nil {
@@ -183,11 +190,20 @@ func (actor Actor) GetAllArchive(offset int) (Collection, error) {
 			return nColl, util.WrapError(err)
 		}
 
-		post.Replies, err = post.GetReplies()
-
 		result = append(result, post)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nColl, util.WrapError(err)
+	}
+
+	rows.Close()
+
+	// Only the replies themselves are archived along with their threads
+	if _, err := loadReplies(postPointers(result), 0); err != nil {
+		return nColl, util.WrapError(err)
+	}
+
 	nColl.AtContext.Context = "https://www.w3.org/ns/activitystreams"
 
 	nColl.OrderedItems = result
@@ -206,140 +222,51 @@ func (actor Actor) GetAutoSubscribe() (bool, error) {
 	return subscribed, nil
 }
 
-func (actor Actor) GetCatalogCollection() (Collection, error) {
+func (actor Actor) GetCollectionPage(page int) (Collection, error) {
 	var nColl Collection
 	var result []ObjectBase
 
-	var err error
-	var rows *sql.Rows
-
-	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1)) as x order by x.updated desc limit 165`
-
-	if rows, err = config.DB.Query(query, actor.Id); err != nil {
-		return nColl, util.WrapError(err)
-	}
-
-	stickies, _ := actor.GetStickies()
-	result = append(result, stickies.OrderedItems...)
+	query := `select count(id) over(), id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, posterid, sensitive from posts where (actor=$1 or actor in (select following from following where id=$1)) and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) order by updated desc limit $2 offset $3`
 
-	defer rows.Close()
-	for rows.Next() {
-		var post ObjectBase
-		var actor Actor
-
-		var attch ObjectBase
-
-		var prev ObjectBase
-
-		err = rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
+	limit := 15
 
+	if page == 0 {
+		stickies, err := actor.stickies()
 		if err != nil {
 			return nColl, util.WrapError(err)
 		}
 
-		post.Locked, _ = post.IsLocked()
-		post.Actor = actor.Id
-
-		post.Replies = &CollectionBase{}
+		limit = limit - len(stickies)
 
-		post.Replies.TotalItems, post.Replies.TotalImgs, err = post.GetRepliesCount()
-
-		if err != nil {
-			return nColl, util.WrapError(err)
-		}
-
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
-
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
-
-		result = append(result, post)
-	}
-
-	nColl.AtContext.Context = "https://www.w3.org/ns/activitystreams"
-
-	nColl.OrderedItems = result
-
-	return nColl, nil
-}
-
-func (actor Actor) GetCollectionPage(page int) (Collection, error) {
-	var nColl Collection
-	var result []ObjectBase
-
-	var err error
-	var rows *sql.Rows
-
-	query := `select count (x.id) over(), x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' and id not in (select activity_id from sticky where actor_id=$1) union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where id not in (select activity_id from sticky where actor_id=$1) and actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note') as x order by x.updated desc limit $2 offset $3`
-
-	limit := 15
-
-	if page == 0 {
-		stickies, _ := actor.GetStickies()
-		limit = limit - stickies.TotalItems
-
-		result = append(result, stickies.OrderedItems...)
+		result = append(result, stickies...)
 	}
 
 	offset := page * limit
 
-	if rows, err = config.DB.Query(query, actor.Id, limit, offset); err != nil {
+	rows, err := config.DB.Query(query, actor.Id, limit, offset)
+	if err != nil {
 		return nColl, util.WrapError(err)
 	}
 
 	var count int
 	defer rows.Close()
 	for rows.Next() {
-		var post ObjectBase
-		var actor Actor
-
-		var attch ObjectBase
-
-		var prev ObjectBase
-
-		err = rows.Scan(&count, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
-
+		post, err := scanPost(rows, &count)
 		if err != nil {
 			return nColl, util.WrapError(err)
 		}
 
-		post.Locked, _ = post.IsLocked()
-		post.Actor = actor.Id
-
-		post.Replies, err = post.GetRepliesLimit(5)
-
-		if err != nil {
-			return nColl, util.WrapError(err)
-		}
-
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
+		result = append(result, post)
+	}
 
-		if err != nil {
-			return nColl, util.WrapError(err)
-		}
+	if err := rows.Err(); err != nil {
+		return nColl, util.WrapError(err)
+	}
 
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
+	rows.Close()
 
-		result = append(result, post)
+	if err := loadThreads(postPointers(result), 5); err != nil {
+		return nColl, util.WrapError(err)
 	}
 
 	nColl.AtContext.Context = "https://www.w3.org/ns/activitystreams"
@@ -355,7 +282,7 @@ func (actor Actor) GetCollection() (Collection, error) {
 	var nColl Collection
 	var result []ObjectBase
 
-	query := `select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' order by updated desc`
+	query := `select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, posterid, sensitive from posts where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' order by updated desc`
 	rows, err := config.DB.Query(query, actor.Id)
 
 	if err != nil {
@@ -364,111 +291,50 @@ func (actor Actor) GetCollection() (Collection, error) {
 
 	defer rows.Close()
 	for rows.Next() {
-		var post ObjectBase
-		var actor Actor
-
-		var attch ObjectBase
-
-		var prev ObjectBase
-
-		if err := rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive); err != nil {
-			return nColl, util.WrapError(err)
-		}
-
-		post.Sticky, _ = post.IsSticky()
-		post.Locked, _ = post.IsLocked()
-
-		post.Actor = actor.Id
-
-		post.Replies, err = post.GetReplies()
-
+		post, err := scanPost(rows)
 		if err != nil {
 			return nColl, util.WrapError(err)
 		}
 
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
-
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
-
 		result = append(result, post)
 	}
 
-	nColl.AtContext.Context = "https://www.w3.org/ns/activitystreams"
-
-	nColl.OrderedItems = result
-
-	return nColl, nil
-}
-
-func (actor Actor) GetCollectionType(nType string) (Collection, error) {
-	var nColl Collection
-	var result []ObjectBase
-
-	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2) as x order by x.updated desc`
-	rows, err := config.DB.Query(query, actor.Id, nType)
-	if err != nil {
+	if err := rows.Err(); err != nil {
 		return nColl, util.WrapError(err)
 	}
 
-	defer rows.Close()
-	for rows.Next() {
-		var post ObjectBase
-		var actor Actor
-
-		var attch ObjectBase
-
-		var prev ObjectBase
+	rows.Close()
 
-		if err := rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive); err != nil {
-			return nColl, util.WrapError(err)
-		}
-
-		post.Actor = actor.Id
-
-		post.Replies = &CollectionBase{}
-
-		post.Replies.TotalItems, post.Replies.TotalImgs, err = post.GetRepliesCount()
-		if err != nil {
-			return nColl, util.WrapError(err)
-		}
-
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
-
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
+	ops := postPointers(result)
+	if err := loadThreads(ops, 0); err != nil {
+		return nColl, util.WrapError(err)
+	}
 
-		result = append(result, post)
+	if err := loadPostFlags(ops); err != nil {
+		return nColl, util.WrapError(err)
 	}
 
+	nColl.AtContext.Context = "https://www.w3.org/ns/activitystreams"
+
 	nColl.OrderedItems = result
 
 	return nColl, nil
 }
 
+func (actor Actor) GetCollectionType(nType string) (Collection, error) {
+	return actor.GetCollectionTypeLimit(nType, 0)
+}
+
+// GetCollectionTypeLimit returns the latest limit threads of type nType on the
+// board, or all of them if limit is 0.
+// Only how many replies each has is loaded, not the replies themselves.
 func (actor Actor) GetCollectionTypeLimit(nType string, limit int) (Collection, error) {
 	var nColl Collection
 	var result []ObjectBase
 
-	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor=$1 and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2 union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type=$2) as x order by x.updated desc limit $3`
+	query := `select c.replies, c.images, x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.posterid, x.sensitive from posts x
+	left join lateral (select count(*) as replies, count(nullif(r.attachment, '')) as images from posts r where r.id in (select id from replies where inreplyto=x.id) and r.type='Note') as c on true
+	where (x.actor=$1 or x.actor in (select following from following where id=$1)) and x.id in (select id from replies where inreplyto='') and x.type=$2 order by x.updated desc limit nullif($3, 0)`
 	rows, err := config.DB.Query(query, actor.Id, nType, limit)
 
 	if err != nil {
@@ -477,41 +343,30 @@ func (actor Actor) GetCollectionTypeLimit(nType string, limit int) (Collection,
 
 	defer rows.Close()
 	for rows.Next() {
-		var post ObjectBase
-		var actor Actor
-
-		var attch ObjectBase
+		replies := &CollectionBase{}
 
-		var prev ObjectBase
-
-		if err := rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive); err != nil {
+		post, err := scanPost(rows, &replies.TotalItems, &replies.TotalImgs)
+		if err != nil {
 			return nColl, util.WrapError(err)
 		}
 
-		post.Actor = actor.Id
-
-		post.Replies = &CollectionBase{}
+		post.Replies = replies
+		result = append(result, post)
+	}
 
-		post.Replies.TotalItems, post.Replies.TotalImgs, err = post.GetRepliesCount()
-		if err != nil {
-			return nColl, util.WrapError(err)
-		}
+	if err := rows.Err(); err != nil {
+		return nColl, util.WrapError(err)
+	}
 
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
+	rows.Close()
 
-		if prev.Id != "" {
-			post.Preview, err = post.Preview.GetPreview()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
+	ops := postPointers(result)
+	if err := loadPostFlags(ops); err != nil {
+		return nColl, util.WrapError(err)
+	}
 
-		result = append(result, post)
+	if err := loadMedia(ops); err != nil {
+		return nColl, util.WrapError(err)
 	}
 
 	nColl.OrderedItems = result
@@ -662,7 +517,7 @@ func (actor Actor) GetFollowingResp(ctx *fiber.Ctx) error {
 func (actor Actor) GetImgTotal() (int, error) {
 	var count int
 
-	query := `select count(attachment) from activitystream where actor=$1 and id in (select id from replies where inreplyto='' and type='Note' )`
+	query := `select count(attachment) from posts where actor=$1 and id in (select id from replies where inreplyto='' and type='Note' )`
 	if err := config.DB.QueryRow(query, actor.Id).Scan(&count); err != nil {
 		return count, util.WrapError(err)
 	}
@@ -682,7 +537,7 @@ func (actor Actor) GetInfoResp(ctx *fiber.Ctx) error {
 func (actor Actor) GetPostTotal() (int, error) {
 	var count int
 
-	query := `select count(id) from activitystream where actor=$1 and id in (select id from replies where inreplyto='' and type='Note')`
+	query := `select count(id) from posts where actor=$1 and id in (select id from replies where inreplyto='' and type='Note')`
 	if err := config.DB.QueryRow(query, actor.Id).Scan(&count); err != nil {
 		return count, util.WrapError(err)
 	}
@@ -725,7 +580,7 @@ func (actor Actor) GetOutbox(ctx *fiber.Ctx) error {
 func (actor Actor) GetRecentPosts() ([]ObjectBase, error) {
 	var collection []ObjectBase
 
-	query := `select id, actor, content, published, attachment from activitystream where actor=$1 and type='Note' union select id, actor, content, published, attachment from cacheactivitystream where actor in (select follower from follower where id=$1) and type='Note' order by published desc limit 20`
+	query := `select id, actor, content, published, attachment from posts where (actor=$1 or (not local and actor in (select follower from follower where id=$1))) and type='Note' order by published desc limit 20`
 	rows, err := config.DB.Query(query, actor.Id)
 
 	if err != nil {
@@ -899,6 +754,8 @@ func (actor Actor) UnArchiveLast() error {
 		if err := e.UpdateType("Note"); err != nil {
 			return util.WrapError(err)
 		}
+
+		publish(Event{Type: "Archive", Actor: actor.Id, Thread: e.Id, Post: e.Id})
 	}
 
 	return nil
@@ -1097,78 +954,31 @@ func (actor Actor) ProcessInboxCreate(activity Activity) error {
 	return nil
 }
 
-func (actor Actor) GetStickies() (Collection, error) {
-	// TODO: SELECT activity_id FROM sticky WHERE actor_id = ?
-
-	var nColl Collection
+// stickies returns the threads stickied on actor, without what goes with them.
+func (actor Actor) stickies() ([]ObjectBase, error) {
 	var result []ObjectBase
 
-	query := `
-select count
-(x.id) over(), x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive
-	from
-	 (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream
-		where actor=$1 and id in (select id from replies where inreplyto='') and type='Note' and id in (select activity_id from sticky where actor_id=$1)
-	union
-		select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream
-		where actor in (select following from following where id=$1) and id in (select id from replies where inreplyto='') and type='Note' and id in (select activity_id from sticky where actor_id=$1)
-	union
-		select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where actor in (select following from following where id=$1)
-		and id in (select id from replies where inreplyto='') and type='Note' and id in (select activity_id from sticky where actor_id=$1)
-) as x order by x.updated desc limit 15`
+	query := `select count(id) over(), id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, posterid, sensitive from posts where (actor=$1 or actor in (select following from following where id=$1)) and id in (select id from replies where inreplyto='') and type='Note' and id in (select activity_id from sticky where actor_id=$1) order by updated desc limit 15`
 
 	rows, err := config.DB.Query(query, actor.Id)
-
 	if err != nil {
-		return nColl, util.WrapError(err)
+		return nil, util.WrapError(err)
 	}
 
 	var count int
 	defer rows.Close()
 	for rows.Next() {
-		var post ObjectBase
-		var actor Actor
-
-		var attch ObjectBase
-
-		var prev ObjectBase
-
-		err = rows.Scan(&count, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
-
+		post, err := scanPost(rows, &count)
 		if err != nil {
-			return nColl, util.WrapError(err)
+			return nil, util.WrapError(err)
 		}
 
 		post.Sticky = true
-		post.Locked, _ = post.IsLocked()
-		post.Actor = actor.Id
-
-		post.Replies, err = post.GetRepliesLimit(5)
-		if err != nil {
-			return nColl, err
-		}
-
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nColl, util.WrapError(err)
-			}
-		}
-
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
-			if err != nil {
-				return nColl, err
-			}
-		}
 
 		result = append(result, post)
 	}
 
-	nColl.TotalItems = count
-	nColl.OrderedItems = result
-
-	return nColl, nil
+	return result, util.WrapError(rows.Err())
 }
 
 func (a Actor) Blotters() ([]string, error) {
@@ -1198,8 +1008,13 @@ func (a Actor) SetBlotter(val string) error {
 		Valid:  val != "",
 	}
 
-	_, err := config.DB.Exec(`update actor set blotter = $1 where id = $2`, &ns, a.Id)
-	return util.WrapError(err)
+	if _, err := config.DB.Exec(`update actor set blotter = $1 where id = $2`, &ns, a.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	a.Changed("Update")
+
+	return nil
 }
 
 func (a Actor) Locked() bool {
@@ -1215,6 +1030,147 @@ func (a Actor) Locked() bool {
 }
 
 func (a Actor) SetLocked(l bool) error {
-	_, err := config.DB.Exec(`update actor set locked = $1 where id = $2`, l, a.Id)
-	return err
+	if _, err := config.DB.Exec(`update actor set locked = $1 where id = $2`, l, a.Id); err != nil {
+		return err
+	}
+
+	a.Changed("Lock")
+
+	return nil
+}
+
+// PosterIDs reports whether posts on the board are given per-thread poster
+// IDs.
+func (a Actor) PosterIDs() bool {
+	val := false
+
+	if err := config.DB.QueryRow(`select posterids from actor where id = $1`, a.Id).Scan(&val); err != nil {
+		return false
+	}
+
+	return val
+}
+
+func (a Actor) SetPosterIDs(v bool) error {
+	_, err := config.DB.Exec(`update actor set posterids = $1 where id = $2`, v, a.Id)
+	return util.WrapError(err)
+}
+
+// FloodLimits are how often posters may post and report on a board.
+// Durations are in seconds, and zero turns a limit off.
+type FloodLimits struct {
+	// ReplyDelay is the time a poster must wait between replies.
+	ReplyDelay int
+
+	// ThreadDelay is the time a poster must wait between new threads.
+	ThreadDelay int
+
+	// DupWindow is the time in which a poster may not post the same
+	// comment twice.
+	DupWindow int
+
+	// ReportLimit is how many reports a poster may make in an hour.
+	ReportLimit int
+}
+
+func (a Actor) FloodLimits() (FloodLimits, error) {
+	var l FloodLimits
+
+	query := `select replydelay, threaddelay, dupwindow, reportlimit from actor where id = $1`
+	err := config.DB.QueryRow(query, a.Id).Scan(&l.ReplyDelay, &l.ThreadDelay, &l.DupWindow, &l.ReportLimit)
+
+	return l, util.WrapError(err)
+}
+
+func (a Actor) SetFloodLimits(l FloodLimits) error {
+	query := `update actor set replydelay = $1, threaddelay = $2, dupwindow = $3, reportlimit = $4 where id = $5`
+	_, err := config.DB.Exec(query, l.ReplyDelay, l.ThreadDelay, l.DupWindow, l.ReportLimit, a.Id)
+
+	return util.WrapError(err)
+}
+
+// ThreadLimits are how large a thread on a board may grow.
+// Zero turns a limit off.
+type ThreadLimits struct {
+	// BumpLimit is the number of replies past which a thread stops being
+	// bumped.
+	BumpLimit int
+
+	// ImageLimit is the number of replies with files past which a thread
+	// takes no more files.
+	ImageLimit int
+
+	// CycleLimit is the number of replies cyclical threads keep.
+	CycleLimit int
+}
+
+func (a Actor) ThreadLimits() (ThreadLimits, error) {
+	var l ThreadLimits
+
+	query := `select bumplimit, imagelimit, cyclelimit from actor where id = $1`
+	err := config.DB.QueryRow(query, a.Id).Scan(&l.BumpLimit, &l.ImageLimit, &l.CycleLimit)
+
+	return l, util.WrapError(err)
+}
+
+func (a Actor) SetThreadLimits(l ThreadLimits) error {
+	query := `update actor set bumplimit = $1, imagelimit = $2, cyclelimit = $3 where id = $4`
+	if _, err := config.DB.Exec(query, l.BumpLimit, l.ImageLimit, l.CycleLimit, a.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	a.Changed("Update")
+
+	return nil
+}
+
+// SpoilerImage returns the URL of the image spoilered files on the board are
+// hidden behind.
+func (a Actor) SpoilerImage() (string, error) {
+	var href string
+
+	query := `select spoilerimage from actor where id = $1`
+	if err := config.DB.QueryRow(query, a.Id).Scan(&href); err != nil {
+		return "/static/spoiler.png", util.WrapError(err)
+	}
+
+	if href == "" {
+		return "/static/spoiler.png", nil
+	}
+
+	return href, nil
+}
+
+// SetSpoilerImage replaces the spoiler image of the board with data, which
+// must be an image of a type media can sanitize.
+// Without data, the board goes back to the default one.
+func (a Actor) SetSpoilerImage(data []byte, mediaType string) error {
+	var old, href string
+
+	if err := config.DB.QueryRow(`select spoilerimage from actor where id = $1`, a.Id).Scan(&old); err != nil {
+		return util.WrapError(err)
+	}
+
+	if len(data) > 0 {
+		clean, _, err := media.Sanitize(data, mediaType, util.MediaLimits())
+		if err != nil {
+			return util.WrapError(err)
+		}
+
+		if href, err = StoreMedia(clean, mediaType); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	if _, err := config.DB.Exec(`update actor set spoilerimage = $1 where id = $2`, href, a.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	a.Changed("Update")
+
+	if old != "" {
+		return util.WrapError(releaseMedia(old))
+	}
+
+	return nil
 }
@@ -0,0 +1,194 @@
+package activitypub_test
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+)
+
+// These need a PostgreSQL database to read from, as reading is what they
+// measure. FEDICHAN_TEST_DB names the database to use; the rest of the
+// connection settings come from fchan.cfg as usual. The fixture boards are
+// put in it and taken out again, and everything else is left alone.
+
+// fixtureDomain is where fixture boards live, so that they can't be mistaken
+// for real ones.
+const fixtureDomain = "https://fixture.invalid"
+
+// testDB connects to the test database, counting queries in the returned
+// counter. It skips tb if there is no test database.
+func testDB(tb testing.TB) *atomic.Int64 {
+	name := os.Getenv("FEDICHAN_TEST_DB")
+	if name == "" {
+		tb.Skip("FEDICHAN_TEST_DB is not set")
+	}
+
+	config.DBName = name
+	if err := db.Connect(); err != nil {
+		tb.Fatal(err)
+	}
+
+	var queries atomic.Int64
+	if err := db.CountQueries(&queries); err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() { config.DB.Close() })
+
+	return &queries
+}
+
+// fixtureBoard makes a board with threads threads, each with replies replies
+// that all have files, and returns it.
+func fixtureBoard(tb testing.TB, name string, threads, replies int) activitypub.Actor {
+	id := fixtureDomain + "/" + name
+
+	exec := func(query string, args ...any) {
+		if _, err := config.DB.Exec(query, args...); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	clean := func() {
+		config.DB.Exec(`delete from replies where id like $1 || '/%'`, id)
+		config.DB.Exec(`delete from posts where id like $1 || '/%'`, id)
+		config.DB.Exec(`delete from actor where id = $1`, id)
+	}
+
+	clean()
+	tb.Cleanup(clean)
+
+	exec(`insert into actor (type, id, name, preferedusername, inbox, outbox, following, followers) values ('Group', $1, $2, $2, $1 || '/inbox', $1 || '/outbox', $1 || '/following', $1 || '/followers')`, id, name)
+
+	// post writes a post with a file, which is how most posts come
+	now := time.Now().UTC()
+	post := func(pid, inReplyTo string, age time.Duration) {
+		at := now.Add(-age)
+
+		exec(`insert into posts (id, type, href, mediatype, published, updated, hash) values ($1 || '/a', 'Attachment', $1 || '.png', 'image/png', $2, $2, $1)`, pid, at)
+		exec(`insert into posts (id, type, href, mediatype, published, updated) values ($1 || '/p', 'Preview', $1 || '.thumb.png', 'image/png', $2, $2)`, pid, at)
+		exec(`insert into posts (id, type, name, content, published, updated, attributedto, actor, attachment, preview, local) values ($1, 'Note', '', 'fixture post', $2, $2, 'Anonymous', $3, $1 || '/a', $1 || '/p', true)`, pid, at, id)
+		exec(`insert into replies (id, inreplyto) values ($1, $2)`, pid, inReplyTo)
+	}
+
+	for t := 0; t < threads; t++ {
+		op := fmt.Sprintf("%s/T%04d", id, t)
+		post(op, "", time.Duration(t)*time.Hour)
+
+		for r := 0; r < replies; r++ {
+			post(fmt.Sprintf("%s/R%04d%04d", id, t, r), op, time.Duration(t)*time.Hour-time.Duration(r+1)*time.Second)
+		}
+	}
+
+	actor, err := activitypub.GetActorFromDB(id)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return actor
+}
+
+// benchReads are the reads of a board that should take as many queries no
+// matter how many posts they read, along with the lookups reading their posts
+// one at a time took before.
+var benchReads = []struct {
+	name     string
+	read     func(actor activitypub.Actor) (activitypub.Collection, error)
+	oneByOne func([]activitypub.ObjectBase)
+}{
+	{"catalog", func(actor activitypub.Actor) (activitypub.Collection, error) {
+		return actor.GetCatalogCollection(activitypub.CatalogQuery{})
+	}, activitypub.LookupThreadsOneAtATime},
+	{"page", func(actor activitypub.Actor) (activitypub.Collection, error) {
+		return actor.GetCollectionPage(0)
+	}, activitypub.LookupPostsOneAtATime},
+	{"outbox", func(actor activitypub.Actor) (activitypub.Collection, error) {
+		return actor.GetCollection()
+	}, activitypub.LookupPostsOneAtATime},
+	{"threads", func(actor activitypub.Actor) (activitypub.Collection, error) {
+		return actor.GetCollectionType("Note")
+	}, activitypub.LookupPostsOneAtATime},
+	{"thread", func(actor activitypub.Actor) (activitypub.Collection, error) {
+		return activitypub.ObjectBase{Id: actor.Id + "/T0000"}.GetCollectionFromPath()
+	}, activitypub.LookupPostsOneAtATime},
+	{"archive", func(actor activitypub.Actor) (activitypub.Collection, error) {
+		return actor.GetAllArchive(0)
+	}, func(ops []activitypub.ObjectBase) {
+		for _, op := range ops {
+			op.GetReplies()
+		}
+	}},
+}
+
+// TestReadQueries makes sure reading boards doesn't take more queries the
+// more posts there are, and logs how many reading their posts one at a time
+// would have taken.
+func TestReadQueries(t *testing.T) {
+	queries := testDB(t)
+
+	small := fixtureBoard(t, "fixturesmall", 2, 2)
+	large := fixtureBoard(t, "fixturelarge", 10, 10)
+
+	count := func(f func()) int64 {
+		before := queries.Load()
+		f()
+		return queries.Load() - before
+	}
+
+	for _, r := range benchReads {
+		var coll activitypub.Collection
+		read := func(actor activitypub.Actor) func() {
+			return func() {
+				var err error
+				if coll, err = r.read(actor); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		s, l := count(read(small)), count(read(large))
+		if s != l {
+			t.Errorf("%s took %d queries on a small board and %d on a large one", r.name, s, l)
+		}
+
+		// Plus the query that read the posts themselves
+		old := count(func() { r.oneByOne(coll.OrderedItems) }) + 1
+		if old < l {
+			t.Errorf("%s took %d queries, more than the %d reading its posts one at a time takes", r.name, l, old)
+		}
+
+		t.Logf("%s: %d queries, %d one at a time", r.name, l, old)
+	}
+}
+
+func BenchmarkReads(b *testing.B) {
+	queries := testDB(b)
+	actor := fixtureBoard(b, "fixturebench", 15, 20)
+
+	for _, r := range benchReads {
+		b.Run(r.name, func(b *testing.B) {
+			var coll activitypub.Collection
+			var err error
+
+			before := queries.Load()
+			for i := 0; i < b.N; i++ {
+				if coll, err = r.read(actor); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(queries.Load()-before)/float64(b.N), "queries/op")
+
+			b.StopTimer()
+			before = queries.Load()
+			r.oneByOne(coll.OrderedItems)
+			b.ReportMetric(float64(queries.Load()-before+1), "unbatched-queries/op")
+		})
+	}
+}
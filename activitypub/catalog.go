@@ -0,0 +1,171 @@
+package activitypub
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// CatalogSorts are the orders a catalog can be put in, the first being the
+// default.
+var CatalogSorts = []string{"bump", "created", "replies", "images", "last-reply"}
+
+var catalogOrder = map[string]string{
+	"bump":       "x.updated desc",
+	"created":    "x.published desc",
+	"replies":    "c.replies desc, x.updated desc",
+	"images":     "c.images desc, x.updated desc",
+	"last-reply": "coalesce(c.lastreply, x.published) desc",
+}
+
+// CatalogQuery is what threads to show in a catalog, and in what order.
+type CatalogQuery struct {
+	// Sort is one of CatalogSorts.
+	Sort string
+
+	// Filter is text the subject or comment of threads must contain.
+	Filter string
+
+	// Instance is the host threads must come from, if set.
+	Instance string
+}
+
+// CatalogInstances returns the hosts the threads in the catalog of actor can
+// come from: this one, then those of the boards it follows.
+func (actor Actor) CatalogInstances() ([]string, error) {
+	local, err := url.Parse(config.Domain)
+	if err != nil {
+		return nil, util.WrapError(err)
+	}
+
+	hosts := []string{local.Host}
+
+	following, err := actor.GetFollowing()
+	if err != nil {
+		return hosts, util.WrapError(err)
+	}
+
+	for _, f := range following {
+		if u, err := url.Parse(f.Id); err == nil && u.Host != "" && !util.IsInStringArray(hosts, u.Host) {
+			hosts = append(hosts, u.Host)
+		}
+	}
+
+	return hosts, nil
+}
+
+// catalogActors returns the boards threads in the catalog of actor may come
+// from to be on instance.
+func (actor Actor) catalogActors(instance string) ([]string, error) {
+	var actors []string
+
+	following, err := actor.GetFollowing()
+	if err != nil {
+		return nil, util.WrapError(err)
+	}
+
+	for _, id := range append([]string{actor.Id}, objectIDs(following)...) {
+		if u, err := url.Parse(id); err == nil && strings.EqualFold(u.Host, instance) {
+			actors = append(actors, id)
+		}
+	}
+
+	return actors, nil
+}
+
+func objectIDs(objs []ObjectBase) []string {
+	ids := make([]string, len(objs))
+	for i, o := range objs {
+		ids[i] = o.Id
+	}
+
+	return ids
+}
+
+func (actor Actor) GetCatalogCollection(q CatalogQuery) (Collection, error) {
+	var nColl Collection
+	var result []ObjectBase
+
+	nColl.AtContext.Context = "https://www.w3.org/ns/activitystreams"
+
+	order, ok := catalogOrder[q.Sort]
+	if !ok {
+		order = catalogOrder[CatalogSorts[0]]
+	}
+
+	var actors []string
+	if q.Instance != "" {
+		var err error
+		if actors, err = actor.catalogActors(q.Instance); err != nil {
+			return nColl, util.WrapError(err)
+		} else if len(actors) == 0 {
+			return nColl, nil
+		}
+	}
+
+	// Reply counts, attachments and previews are worked out alongside the
+	// threads so that sorting by them doesn't take a query per thread
+	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.actor, x.tripcode, x.capcode, x.posterid, x.sensitive, x.sticky,
+	coalesce(c.replies, 0), coalesce(c.images, 0),
+	coalesce(a.id, ''), coalesce(a.type, ''), coalesce(a.name, ''), coalesce(a.href, ''), coalesce(a.mediatype, ''), coalesce(a.size, 0), coalesce(a.published, x.published), coalesce(a.width, 0), coalesce(a.height, 0), coalesce(a.hash, ''), coalesce(a.spoiler, false),
+	coalesce(p.id, ''), coalesce(p.type, ''), coalesce(p.name, ''), coalesce(p.href, ''), coalesce(p.mediatype, ''), coalesce(p.size, 0), coalesce(p.published, x.published), coalesce(p.width, 0), coalesce(p.height, 0)
+	from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, posterid, sensitive, id in (select activity_id from sticky where actor_id=$1) as sticky from posts where (actor=$1 or actor in (select following from following where id=$1)) and id in (select id from replies where inreplyto='') and type='Note') as x
+	left join lateral (select count(*) as replies, count(nullif(r.attachment, '')) as images, max(r.published) as lastreply from (select id, attachment, published from posts where id in (select id from replies where inreplyto=x.id) and type='Note') as r) as c on true
+	left join lateral (select id, type, name, href, mediatype, size, published, width, height, hash, spoiler from posts where id=x.attachment) as a on x.attachment != ''
+	left join lateral (select id, type, name, href, mediatype, size, published, width, height from posts where id=x.preview) as p on x.preview != ''
+	where ($2 = '' or strpos(lower(x.name), lower($2)) > 0 or strpos(lower(x.content), lower($2)) > 0) and ($3::text[] is null or x.actor = any($3))
+	order by x.sticky desc, ` + order + ` limit 165`
+
+	rows, err := config.DB.Query(query, actor.Id, q.Filter, actors)
+	if err != nil {
+		return nColl, util.WrapError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var post ObjectBase
+		var attch, prev ObjectBase
+
+		post.Replies = &CollectionBase{}
+
+		err = rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &post.Actor, &post.TripCode, &post.Capcode, &post.PosterID, &post.Sensitive, &post.Sticky,
+			&post.Replies.TotalItems, &post.Replies.TotalImgs,
+			&attch.Id, &attch.Type, &attch.Name, &attch.Href, &attch.MediaType, &attch.Size, &attch.Published, &attch.Width, &attch.Height, &attch.Hash, &attch.Spoiler,
+			&prev.Id, &prev.Type, &prev.Name, &prev.Href, &prev.MediaType, &prev.Size, &prev.Published, &prev.Width, &prev.Height)
+		if err != nil {
+			return nColl, util.WrapError(err)
+		}
+
+		if attch.Id != "" {
+			post.Attachment = []ObjectBase{attch}
+		}
+
+		if prev.Id != "" {
+			post.Preview = &prev
+		}
+
+		result = append(result, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nColl, util.WrapError(err)
+	}
+
+	rows.Close()
+
+	ops := postPointers(result)
+
+	if err := loadThreadFlags(ops); err != nil {
+		return nColl, util.WrapError(err)
+	}
+
+	if err := loadPolls(ops); err != nil {
+		return nColl, util.WrapError(err)
+	}
+
+	nColl.OrderedItems = result
+
+	return nColl, nil
+}
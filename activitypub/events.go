@@ -0,0 +1,72 @@
+package activitypub
+
+import (
+	"sync"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+// An Event is a change to something shown on the pages of a board.
+type Event struct {
+	// Type is what happened: Create, Delete, Sticky, Lock, Archive or
+	// Update.
+	Type string
+
+	// Actor is the board the post belongs to.
+	Actor string
+
+	// Thread is the OP of the thread the post is in, or empty if the
+	// change is to the whole board.
+	Thread string
+
+	// Post is the post that changed.
+	Post string
+}
+
+var (
+	subscribersMu sync.RWMutex
+	subscribers   []func(Event)
+)
+
+// Subscribe calls fn for every event from then on.
+// It is called by whatever made the change, so it must not block.
+func Subscribe(fn func(Event)) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+
+	subscribers = append(subscribers, fn)
+}
+
+func publish(e Event) {
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
+
+// event describes eventType happening to obj, looking up the board and
+// thread it is in.
+// It must be made before obj is deleted, as there is nothing to look up after.
+func (obj ObjectBase) event(eventType string) Event {
+	e := Event{Type: eventType, Actor: obj.Actor, Post: obj.Id}
+
+	if e.Actor == "" {
+		config.DB.QueryRow(`select actor from posts where id=$1`, obj.Id).Scan(&e.Actor)
+	}
+
+	e.Thread, _ = obj.GetOP()
+
+	return e
+}
+
+// Changed announces that obj had eventType happen to it.
+func (obj ObjectBase) Changed(eventType string) {
+	publish(obj.event(eventType))
+}
+
+// Changed announces that something about the whole board changed.
+func (actor Actor) Changed(eventType string) {
+	publish(Event{Type: eventType, Actor: actor.Id})
+}
@@ -0,0 +1,141 @@
+package activitypub
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/media"
+	"github.com/KushBlazingJudah/fedichan/internal/storage"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// StoreMedia saves data to the media store under its SHA-256 and returns the
+// URL it can be found at.
+// If the same file is already stored, it gains another reference instead of
+// being stored twice.
+func StoreMedia(data []byte, mediaType string) (string, error) {
+	key := media.Hash(data) + media.Extension(mediaType)
+
+	var refs int
+
+	query := `insert into media (key, refs) values ($1, 1) on conflict (key) do update set refs = media.refs + 1, updated = now() returning refs`
+	if err := config.DB.QueryRow(query, key).Scan(&refs); err != nil {
+		return "", util.WrapError(err)
+	}
+
+	store := refs == 1
+	if !store {
+		// Make sure it didn't go missing somehow
+		exists, err := storage.Default.Exists(key)
+		if err != nil {
+			return "", util.WrapError(err)
+		}
+
+		store = !exists
+	}
+
+	if store {
+		if err := storage.Default.Put(key, data, mediaType); err != nil {
+			config.DB.Exec(`update media set refs = refs - 1, updated = now() where key = $1`, key)
+			return "", util.WrapError(err)
+		}
+	}
+
+	return storage.Default.URL(key), nil
+}
+
+// releaseMedia drops a reference to the media at href, removing it from the
+// media store once nothing else uses it.
+// URLs that don't point into the media store are ignored.
+func releaseMedia(href string) error {
+	key, ok := storage.Default.Key(href)
+	if !ok {
+		return nil
+	}
+
+	var refs int
+
+	query := `update media set refs = refs - 1, updated = now() where key = $1 returning refs`
+	err := config.DB.QueryRow(query, key).Scan(&refs)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Uploaded before reference counting, so nothing else can use it
+		return util.WrapError(storage.Default.Delete(key))
+	} else if err != nil {
+		return util.WrapError(err)
+	}
+
+	if refs > 0 {
+		return nil
+	}
+
+	if _, err := config.DB.Exec(`delete from media where key = $1 and refs <= 0`, key); err != nil {
+		return util.WrapError(err)
+	}
+
+	return util.WrapError(storage.Default.Delete(key))
+}
+
+// checkMediaBan downloads a remote attachment and checks it against the
+// media bans.
+// Its hashes are recorded in obj so that bans placed later can find it.
+// Attachments that are already cached, or can't be fetched, are let through.
+func (obj *ObjectBase) checkMediaBan() bool {
+	if obj.Href == "" {
+		return false
+	}
+
+	if cached, _ := obj.IsCached(); cached {
+		return false
+	}
+
+	data, err := util.FetchMedia(obj.Href, util.RemoteMediaLimit)
+	if err != nil {
+		log.Println(util.WrapError(err))
+		return false
+	}
+
+	obj.Hash = media.Hash(data)
+	obj.PHash = util.MediaPHash(data, obj.MediaType)
+
+	banned, err := util.IsMediaBanned(data, obj.MediaType)
+	if err != nil {
+		log.Println(util.WrapError(err))
+	}
+
+	return banned
+}
+
+// GetMediaPosts returns the posts, local and cached, that have an attachment
+// matching m, either exactly or by looking like it as media bans do.
+// Only Id and Actor are filled in.
+func GetMediaPosts(m util.MediaMatch) ([]ObjectBase, error) {
+	var posts []ObjectBase
+
+	phash := m.PHash
+	if config.MediaBanDistance < 0 {
+		phash = nil
+	}
+
+	// Counting the bits that differ is how media.Distance works too
+	query := `select id, actor from posts where type != 'Tombstone' and attachment in (select id from posts where type='Attachment' and (hash = any($1) or length(replace((phash # $2::bigint)::bit(64)::text, '0', '')) <= $3))`
+
+	rows, err := config.DB.Query(query, m.Hashes, phash, config.MediaBanDistance)
+	if err != nil {
+		return posts, util.WrapError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var post ObjectBase
+
+		if err := rows.Scan(&post.Id, &post.Actor); err != nil {
+			return posts, util.WrapError(err)
+		}
+
+		posts = append(posts, post)
+	}
+
+	return posts, util.WrapError(rows.Err())
+}
@@ -1,19 +1,22 @@
 package activitypub
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
 	"fmt"
+	"image"
 	"log"
 	"net/smtp"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"regexp"
-	"sort"
 	"strings"
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/markup"
+	"github.com/KushBlazingJudah/fedichan/internal/media"
 	"github.com/KushBlazingJudah/fedichan/util"
 )
 
@@ -100,39 +103,71 @@ func (obj ObjectBase) GetOP() (string, error) {
 	return id, nil
 }
 
-func (obj ObjectBase) CreatePreview() *ObjectBase {
+// previewSize is the largest a preview may be in either dimension.
+const previewSize = 250
+
+// CreatePreview makes a thumbnail out of data, the contents of obj, and puts
+// it in the media store.
+// The returned preview has an empty Href if one could not be made.
+func (obj ObjectBase) CreatePreview(data []byte) *ObjectBase {
 	var nPreview ObjectBase
 
-	re := regexp.MustCompile(`/.+$`)
-	mimetype := re.ReplaceAllString(obj.MediaType, "")
+	if !strings.HasPrefix(obj.MediaType, "image/") {
+		return &nPreview
+	}
+
+	thumb, mediaType, err := media.Thumbnail(data, obj.MediaType, util.MediaLimits(), previewSize, previewSize)
+	if errors.Is(err, media.ErrUnsupported) && media.HasTool("convert") {
+		// Let ImageMagick have a go at it
+		thumb, err = externalThumbnail(data, obj.MediaType)
+		mediaType = obj.MediaType
+	}
+
+	if err != nil {
+		log.Println(util.WrapError(err))
+		return &nPreview
+	}
 
-	if mimetype != "image" {
+	href, err := StoreMedia(thumb, mediaType)
+	if err != nil {
+		log.Println(util.WrapError(err))
 		return &nPreview
 	}
 
-	re = regexp.MustCompile(`.+/`)
-	file := re.ReplaceAllString(obj.MediaType, "")
-	href := util.GetUniqueFilename(file)
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(thumb)); err == nil {
+		nPreview.Width, nPreview.Height = cfg.Width, cfg.Height
+	}
 
 	nPreview.Type = "Preview"
 	nPreview.Name = obj.Name
-	nPreview.Href = config.Domain + "" + href
-	nPreview.MediaType = obj.MediaType
-	nPreview.Size = obj.Size
+	nPreview.Href = href
+	nPreview.MediaType = mediaType
+	nPreview.Size = int64(len(thumb))
 	nPreview.Published = obj.Published
 
-	re = regexp.MustCompile(`/public/.+`)
-	objFile := re.FindString(obj.Href)
+	return &nPreview
+}
+
+// externalThumbnail runs data through ImageMagick by way of temporary files.
+func externalThumbnail(data []byte, mediaType string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "fedichan-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	ext := media.Extension(mediaType)
+	src, dst := filepath.Join(dir, "src"+ext), filepath.Join(dir, "dst"+ext)
 
-	cmd := exec.Command("convert", "."+objFile, "-resize", "250x250>", "-strip", "."+href)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		return nil, err
+	}
 
-	if err := cmd.Run(); err != nil {
-		// TODO: previously we would call CheckError here
-		var preview ObjectBase
-		return &preview
+	if err := media.ExternalThumbnail(src, dst, previewSize, previewSize); err != nil {
+		return nil, err
 	}
 
-	return &nPreview
+	return os.ReadFile(dst)
 }
 
 func (obj ObjectBase) DeleteAndRepliesRequest() error {
@@ -175,14 +210,8 @@ func (obj ObjectBase) DeleteAndRepliesRequest() error {
 	return util.WrapError(err)
 }
 
-// TODO break this off into seperate for Cache
 func (obj ObjectBase) DeleteAttachment() error {
-	query := `delete from activitystream where id in (select attachment from activitystream where id=$1)`
-	if _, err := config.DB.Exec(query, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `delete from cacheactivitystream where id in (select attachment from cacheactivitystream where id=$1)`
+	query := `delete from posts where id in (select attachment from posts where id=$1)`
 	_, err := config.DB.Exec(query, obj.Id)
 	return util.WrapError(err)
 }
@@ -190,32 +219,16 @@ func (obj ObjectBase) DeleteAttachment() error {
 func (obj ObjectBase) DeleteAttachmentFromFile() error {
 	var href string
 
-	query := `select href from activitystream where id in (select attachment from activitystream where id=$1)`
+	query := `select href from posts where local and id in (select attachment from posts where id=$1)`
 	if err := config.DB.QueryRow(query, obj.Id).Scan(&href); err != nil {
 		return nil
 	}
 
-	href = strings.Replace(href, config.Domain+"/", "", 1)
-	if href != "static/notfound.png" {
-		if _, err := os.Stat(href); err != nil {
-			return nil
-		}
-		return os.Remove(href)
-	}
-
-	return nil
+	return releaseMedia(href)
 }
 
-// TODO break this off into seperate for Cache
 func (obj ObjectBase) DeletePreview() error {
-	query := `delete from activitystream where id=$1`
-
-	if _, err := config.DB.Exec(query, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `delete from cacheactivitystream where id in (select preview from cacheactivitystream where id=$1)`
-
+	query := `delete from posts where id in (select preview from posts where id=$1)`
 	_, err := config.DB.Exec(query, obj.Id)
 	return util.WrapError(err)
 }
@@ -223,20 +236,12 @@ func (obj ObjectBase) DeletePreview() error {
 func (obj ObjectBase) DeletePreviewFromFile() error {
 	var href string
 
-	query := `select href from activitystream where id in (select preview from activitystream where id=$1)`
+	query := `select href from posts where local and id in (select preview from posts where id=$1)`
 	if err := config.DB.QueryRow(query, obj.Id).Scan(&href); err != nil {
 		return nil
 	}
 
-	href = strings.Replace(href, config.Domain+"/", "", 1)
-	if href != "static/notfound.png" {
-		if _, err := os.Stat(href); err != nil {
-			return nil
-		}
-		return os.Remove(href)
-	}
-
-	return nil
+	return releaseMedia(href)
 }
 
 func (obj ObjectBase) DeleteAll() error {
@@ -267,14 +272,8 @@ func (obj ObjectBase) DeleteAll() error {
 	return obj.DeleteRepliedTo()
 }
 
-// TODO break this off into seperate for Cache
 func (obj ObjectBase) Delete() error {
-	query := `delete from activitystream where id=$1`
-	if _, err := config.DB.Exec(query, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `delete from cacheactivitystream where id=$1`
+	query := `delete from posts where id=$1`
 	_, err := config.DB.Exec(query, obj.Id)
 	return util.WrapError(err)
 }
@@ -338,6 +337,54 @@ func (obj ObjectBase) DeleteRequest() error {
 	return util.WrapError(err)
 }
 
+// UpdateRequest tells the instances following the board obj was posted to
+// about changes to it, such as becoming cyclical or its poll getting votes.
+func (obj ObjectBase) UpdateRequest() error {
+	nObj, err := obj.GetFromPath()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	keep, err := nObj.GetCyclical()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	nObj.Cyclical = &keep
+
+	if nObj.Poll, err = nObj.GetPoll(); err != nil {
+		return util.WrapError(err)
+	}
+
+	activity, err := nObj.CreateActivity("Update")
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	objActor, _ := GetActor(nObj.Actor)
+	followers, err := objActor.GetFollower()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	for _, e := range followers {
+		activity.To = append(activity.To, e.Id)
+	}
+
+	following, err := objActor.GetFollowing()
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	for _, e := range following {
+		if !util.IsInStringArray(activity.To, e.Id) {
+			activity.To = append(activity.To, e.Id)
+		}
+	}
+
+	return util.WrapError(activity.Send())
+}
+
 func (obj ObjectBase) DeleteReported() error {
 	query := `delete from reported where id=$1`
 	_, err := config.DB.Exec(query, obj.Id)
@@ -352,7 +399,7 @@ func (obj ObjectBase) GetCollectionLocal() (Collection, error) {
 	var rows *sql.Rows
 	var err error
 
-	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where id=$1 and (type='Note' or type='Archive') union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where id=$1 and (type='Note' or type='Archive')) as x`
+	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.posterid, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, posterid, sensitive from posts where id=$1 and (type='Note' or type='Archive')) as x`
 	if rows, err = config.DB.Query(query, obj.Id); err != nil {
 		return nColl, util.WrapError(err)
 	}
@@ -366,7 +413,7 @@ func (obj ObjectBase) GetCollectionLocal() (Collection, error) {
 
 		var prev ObjectBase
 
-		err = rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
+		err = rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Capcode, &post.PosterID, &post.Sensitive)
 
 		if err != nil {
 			return nColl, util.WrapError(err)
@@ -374,8 +421,15 @@ func (obj ObjectBase) GetCollectionLocal() (Collection, error) {
 
 		post.Sticky, _ = post.IsSticky()
 		post.Locked, _ = post.IsLocked()
+		post.Autosage, _ = post.IsAutosage()
+		if keep, _ := post.GetCyclical(); keep > 0 {
+			post.Cyclical = &keep
+		}
+		post.Poll, _ = post.GetPoll()
+		post.BumpLimit, post.ImageLimit, _ = post.LimitsReached()
 
 		post.Actor = actor.Id
+		post.BanMarked, _ = post.IsBanMarked()
 
 		if post.InReplyTo, err = post.GetInReplyTo(); err != nil {
 			return nColl, util.WrapError(err)
@@ -449,8 +503,8 @@ func (obj ObjectBase) GetInReplyTo() ([]ObjectBase, error) {
 func (obj ObjectBase) GetAttachment() ([]ObjectBase, error) {
 	var attachment ObjectBase
 
-	query := `select x.id, x.type, x.name, x.href, x.mediatype, x.size, x.published from (select id, type, name, href, mediatype, size, published from activitystream where id=$1 union select id, type, name, href, mediatype, size, published from cacheactivitystream where id=$1) as x`
-	err := config.DB.QueryRow(query, obj.Id).Scan(&attachment.Id, &attachment.Type, &attachment.Name, &attachment.Href, &attachment.MediaType, &attachment.Size, &attachment.Published)
+	query := `select x.id, x.type, x.name, x.href, x.mediatype, x.size, x.published, x.width, x.height, x.hash, x.spoiler from (select id, type, name, href, mediatype, size, published, width, height, hash, spoiler from posts where id=$1) as x`
+	err := config.DB.QueryRow(query, obj.Id).Scan(&attachment.Id, &attachment.Type, &attachment.Name, &attachment.Href, &attachment.MediaType, &attachment.Size, &attachment.Published, &attachment.Width, &attachment.Height, &attachment.Hash, &attachment.Spoiler)
 
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
@@ -463,55 +517,30 @@ func (obj ObjectBase) GetAttachment() ([]ObjectBase, error) {
 
 func (obj ObjectBase) GetCollectionFromPath() (Collection, error) {
 	var nColl Collection
-	var result []ObjectBase
 
-	var post ObjectBase
-	var actor Actor
-
-	var attch ObjectBase
-
-	var prev ObjectBase
-
-	var err error
+	query := `select x.sticky, x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.posterid, x.sensitive from (select exists (select 1 from sticky where activity_id = posts.id) as sticky, id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, posterid, sensitive from posts where id=$1 and (type='Note' or type='Archive')) as x order by x.updated`
 
-	query := `select x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from activitystream where id like $1 and (type='Note' or type='Archive') union select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, sensitive from cacheactivitystream where id like $1 and (type='Note' or type='Archive')) as x order by x.updated`
-	if err = config.DB.QueryRow(query, obj.Id).Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive); err != nil {
+	var sticky bool
+	post, err := scanPost(config.DB.QueryRow(query, obj.Id), &sticky)
+	if err != nil {
 		return nColl, err
 	}
 
-	post.Sticky, _ = post.IsSticky()
-	post.Locked, _ = post.IsLocked()
-
-	post.Actor = actor.Id
+	post.Sticky = sticky
 
 	if post.InReplyTo, err = post.GetInReplyTo(); err != nil {
 		return nColl, util.WrapError(err)
 	}
 
-	if post.Replies, err = post.GetReplies(); err != nil {
+	if err := loadThreads([]*ObjectBase{&post}, 0); err != nil {
 		return nColl, util.WrapError(err)
 	}
 
-	if attch.Id != "" {
-		post.Attachment, err = attch.GetAttachment()
-		if err != nil {
-			return nColl, util.WrapError(err)
-		}
-	}
-
-	if prev.Id != "" {
-		if post.Preview, err = prev.GetPreview(); err != nil {
-			return nColl, util.WrapError(err)
-		}
-	}
-
-	result = append(result, post)
-
 	nColl.AtContext.Context = "https://www.w3.org/ns/activitystreams"
 
 	nColl.Actor = &Actor{Id: post.Actor}
 
-	nColl.OrderedItems = result
+	nColl.OrderedItems = []ObjectBase{post}
 
 	return nColl, nil
 }
@@ -523,7 +552,7 @@ func (obj ObjectBase) GetFromPath() (ObjectBase, error) {
 
 	var prev ObjectBase
 
-	query := `select id, name, content, type, published, attributedto, attachment, preview, actor from activitystream where id=$1 order by published desc`
+	query := `select id, name, content, type, published, attributedto, attachment, preview, actor from posts where id=$1 and local`
 	err := config.DB.QueryRow(query, obj.Id).Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &post.Actor)
 
 	if err != nil {
@@ -568,8 +597,8 @@ func (obj ObjectBase) GetFromPath() (ObjectBase, error) {
 func (obj ObjectBase) GetPreview() (*ObjectBase, error) {
 	var preview ObjectBase
 
-	query := `select x.id, x.type, x.name, x.href, x.mediatype, x.size, x.published from (select id, type, name, href, mediatype, size, published from activitystream where id=$1 union select id, type, name, href, mediatype, size, published from cacheactivitystream where id=$1) as x`
-	if err := config.DB.QueryRow(query, obj.Id).Scan(&preview.Id, &preview.Type, &preview.Name, &preview.Href, &preview.MediaType, &preview.Size, &preview.Published); err != nil {
+	query := `select x.id, x.type, x.name, x.href, x.mediatype, x.size, x.published, x.width, x.height from (select id, type, name, href, mediatype, size, published, width, height from posts where id=$1) as x`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&preview.Id, &preview.Type, &preview.Name, &preview.Href, &preview.MediaType, &preview.Size, &preview.Published, &preview.Width, &preview.Height); err != nil {
 		return nil, err
 	}
 	if preview.Id == "" {
@@ -582,7 +611,7 @@ func (obj ObjectBase) GetRepliesCount() (int, int, error) {
 	var countId int
 	var countImg int
 
-	query := `select count(x.id) over(), sum(case when RTRIM(x.attachment) = '' then 0 else 1 end) over() from (select id, attachment from activitystream where id in (select id from replies where inreplyto=$1) and type='Note' union select id, attachment from cacheactivitystream where id in (select id from replies where inreplyto=$1) and type='Note') as x`
+	query := `select count(x.id) over(), sum(case when RTRIM(x.attachment) = '' then 0 else 1 end) over() from (select id, attachment from posts where id in (select id from replies where inreplyto=$1) and type='Note') as x`
 
 	if err := config.DB.QueryRow(query, obj.Id).Scan(&countId, &countImg); err != nil {
 		return 0, 0, nil
@@ -591,208 +620,31 @@ func (obj ObjectBase) GetRepliesCount() (int, int, error) {
 	return countId, countImg, nil
 }
 
+// GetReplies returns every reply to obj, oldest first, or nil if it has none.
 func (obj ObjectBase) GetReplies() (*CollectionBase, error) {
-	var result []ObjectBase
-
-	var postCount int
-	var attachCount int
-
-	var rows *sql.Rows
-	var err error
-
-	query := `select x.id, x.name, x.content, x.type, x.published, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select * from activitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive') union select * from cacheactivitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive')) as x order by x.published asc`
-	if rows, err = config.DB.Query(query, obj.Id); err != nil {
-		return nil, util.WrapError(err)
-	}
-
-	defer rows.Close()
-	for rows.Next() {
-		var post ObjectBase
-		var actor Actor
-
-		var attch ObjectBase
-
-		var prev ObjectBase
-
-		err = rows.Scan(&post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
-		if err != nil {
-			return nil, util.WrapError(err)
-		}
-		postCount++
-
-		post.InReplyTo = append(post.InReplyTo, obj)
-
-		post.Actor = actor.Id
-
-		post.Replies, err = post.GetRepliesReplies()
-
-		if err != nil {
-			return nil, util.WrapError(err)
-		}
-
-		if attch.Id != "" {
-			attachCount++
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nil, util.WrapError(err)
-			}
-		}
-
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
-			if err != nil {
-				return nil, util.WrapError(err)
-			}
-		}
-
-		result = append(result, post)
-	}
-
-	if postCount == 0 {
-		return nil, nil
-	}
-
-	return &CollectionBase{
-		OrderedItems: result,
-		TotalItems:   postCount,
-		TotalImgs:    attachCount,
-	}, nil
+	return obj.GetRepliesLimit(0)
 }
 
+// GetRepliesLimit returns the latest limit replies to obj, oldest first, or
+// nil if it has none.
+// It returns all of them if limit is 0.
 func (obj ObjectBase) GetRepliesLimit(limit int) (*CollectionBase, error) {
-	var result []ObjectBase
-
-	var postCount int
-	var attachCount int
-
-	var rows *sql.Rows
-	var err error
-
-	query := `select count(x.id) over(), sum(case when RTRIM(x.attachment) = '' then 0 else 1 end) over(), x.id, x.name, x.content, x.type, x.published, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select * from activitystream where id in (select id from replies where inreplyto=$1) and type='Note' union select * from cacheactivitystream where id in (select id from replies where inreplyto=$1) and type='Note') as x order by x.published desc limit $2`
-	if rows, err = config.DB.Query(query, obj.Id, limit); err != nil {
+	posts, err := loadReplyTree([]*ObjectBase{&obj}, limit)
+	if err != nil {
 		return nil, util.WrapError(err)
 	}
 
-	defer rows.Close()
-	for rows.Next() {
-		var post ObjectBase
-		var actor Actor
-
-		var attch ObjectBase
-
-		var prev ObjectBase
-
-		err = rows.Scan(&postCount, &attachCount, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
-
-		if err != nil {
-			return nil, util.WrapError(err)
-		}
-
-		post.InReplyTo = append(post.InReplyTo, obj)
-
-		post.Actor = actor.Id
-
-		post.Replies, err = post.GetRepliesReplies()
-
-		if err != nil {
-			return nil, util.WrapError(err)
-		}
-
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nil, util.WrapError(err)
-			}
-		}
-
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
-			if err != nil {
-				return nil, util.WrapError(err)
-			}
-		}
-
-		result = append(result, post)
-	}
-
-	if postCount == 0 {
-		return nil, nil
-	}
-
-	sort.Sort(ObjectBaseSortAsc(result))
-
-	return &CollectionBase{
-		OrderedItems: result,
-		TotalItems:   postCount,
-		TotalImgs:    attachCount,
-	}, nil
-}
-
-func (obj ObjectBase) GetRepliesReplies() (*CollectionBase, error) {
-	var result []ObjectBase
-
-	var postCount int
-	var attachCount int
-
-	var err error
-	var rows *sql.Rows
-
-	query := `select count(x.id) over(), sum(case when RTRIM(x.attachment) = '' then 0 else 1 end) over(), x.id, x.name, x.content, x.type, x.published, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.sensitive from (select * from activitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive') union select * from cacheactivitystream where id in (select id from replies where inreplyto=$1) and (type='Note' or type='Archive')) as x order by x.published asc`
-	if rows, err = config.DB.Query(query, obj.Id); err != nil {
+	if err := loadMedia(posts); err != nil {
 		return nil, util.WrapError(err)
 	}
 
-	defer rows.Close()
-	for rows.Next() {
-
-		var post ObjectBase
-		var actor Actor
-
-		var attch ObjectBase
-
-		var prev ObjectBase
-
-		err = rows.Scan(&postCount, &attachCount, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.AttributedTo, &attch.Id, &prev.Id, &actor.Id, &post.TripCode, &post.Sensitive)
-		if err != nil {
-			return nil, util.WrapError(err)
-		}
-
-		post.InReplyTo = append(post.InReplyTo, obj)
-
-		post.Actor = actor.Id
-
-		if attch.Id != "" {
-			post.Attachment, err = attch.GetAttachment()
-			if err != nil {
-				return nil, util.WrapError(err)
-			}
-		}
-
-		if prev.Id != "" {
-			post.Preview, err = prev.GetPreview()
-			if err != nil {
-				return nil, util.WrapError(err)
-			}
-		}
-
-		result = append(result, post)
-	}
-
-	if postCount == 0 {
-		return nil, nil
-	}
-
-	return &CollectionBase{
-		OrderedItems: result,
-		TotalItems:   postCount,
-		TotalImgs:    attachCount,
-	}, nil
+	return obj.Replies, nil
 }
 
 func (obj ObjectBase) GetType() (string, error) {
 	var nType string
 
-	query := `select type from activitystream where id=$1 union select type from cacheactivitystream where id=$1`
+	query := `select type from posts where id=$1`
 	if err := config.DB.QueryRow(query, obj.Id).Scan(&nType); err != nil {
 		return "", nil
 	}
@@ -803,7 +655,7 @@ func (obj ObjectBase) GetType() (string, error) {
 func (obj ObjectBase) IsCached() (bool, error) {
 	var nID string
 
-	query := `select id from cacheactivitystream where id=$1`
+	query := `select id from posts where id=$1 and not local`
 	if err := config.DB.QueryRow(query, obj.Id).Scan(&nID); err != nil {
 		return false, util.WrapError(err)
 	}
@@ -814,7 +666,7 @@ func (obj ObjectBase) IsCached() (bool, error) {
 func (obj ObjectBase) IsLocal() (bool, error) {
 	var nID string
 
-	query := `select id from activitystream where id=$1`
+	query := `select id from posts where id=$1 and local`
 	if err := config.DB.QueryRow(query, obj.Id).Scan(&nID); err != nil {
 		return false, nil
 	}
@@ -839,27 +691,21 @@ func (obj ObjectBase) IsReplyInThread(id string) (bool, error) {
 	return false, nil
 }
 
-// TODO break this off into seperate for Cache
 func (obj ObjectBase) MarkSensitive(sensitive bool) error {
-	var query = `update activitystream set sensitive=$1 where id=$2`
+	query := `update posts set sensitive=$1 where id=$2`
 	if _, err := config.DB.Exec(query, sensitive, obj.Id); err != nil {
 		return util.WrapError(err)
 	}
 
-	query = `update cacheactivitystream set sensitive=$1 where id=$2`
-	_, err := config.DB.Exec(query, sensitive, obj.Id)
-	return util.WrapError(err)
+	obj.Changed("Update")
+
+	return nil
 }
 
 func (obj ObjectBase) SetAttachmentType(_type string) error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type=$1, deleted=$2 where id in (select attachment from activitystream where id=$3)`
-	if _, err := config.DB.Exec(query, _type, datetime, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select attachment from cacheactivitystream  where id=$3)`
+	query := `update posts set type=$1, deleted=$2 where id in (select attachment from posts where id=$3)`
 	_, err := config.DB.Exec(query, _type, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -867,12 +713,7 @@ func (obj ObjectBase) SetAttachmentType(_type string) error {
 func (obj ObjectBase) SetAttachmentRepliesType(_type string) error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type=$1, deleted=$2 where id in (select attachment from activitystream where id in (select id from replies where inreplyto=$3))`
-	if _, err := config.DB.Exec(query, _type, datetime, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select attachment from cacheactivitystream where id in (select id from replies where inreplyto=$3))`
+	query := `update posts set type=$1, deleted=$2 where id in (select attachment from posts where id in (select id from replies where inreplyto=$3))`
 	_, err := config.DB.Exec(query, _type, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -880,12 +721,7 @@ func (obj ObjectBase) SetAttachmentRepliesType(_type string) error {
 func (obj ObjectBase) SetPreviewType(_type string) error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type=$1, deleted=$2 where id in (select preview from activitystream where id=$3)`
-	if _, err := config.DB.Exec(query, _type, datetime, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select preview from cacheactivitystream where id=$3)`
+	query := `update posts set type=$1, deleted=$2 where id in (select preview from posts where id=$3)`
 	_, err := config.DB.Exec(query, _type, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -893,12 +729,7 @@ func (obj ObjectBase) SetPreviewType(_type string) error {
 func (obj ObjectBase) SetPreviewRepliesType(_type string) error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type=$1, deleted=$2 where id in (select preview from activitystream where id in (select id from replies where inreplyto=$3))`
-	if _, err := config.DB.Exec(query, _type, datetime, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select preview from cacheactivitystream where id in (select id from replies where inreplyto=$3))`
+	query := `update posts set type=$1, deleted=$2 where id in (select preview from posts where id in (select id from replies where inreplyto=$3))`
 	_, err := config.DB.Exec(query, _type, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -918,12 +749,7 @@ func (obj ObjectBase) SetType(_type string) error {
 func (obj ObjectBase) _SetType(_type string) error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type=$1, deleted=$2 where id=$3`
-	if _, err := config.DB.Exec(query, _type, datetime, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set type=$1, deleted=$2 where id=$3`
+	query := `update posts set type=$1, deleted=$2 where id=$3`
 	_, err := config.DB.Exec(query, _type, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -955,12 +781,7 @@ func (obj ObjectBase) SetRepliesType(_type string) error {
 func (obj ObjectBase) _SetRepliesType(_type string) error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	var query = `update activitystream set type=$1, deleted=$2 where id in (select id from replies where inreplyto=$3)`
-	if _, err := config.DB.Exec(query, _type, datetime, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set type=$1, deleted=$2 where id in (select id from replies where inreplyto=$3)`
+	query := `update posts set type=$1, deleted=$2 where id in (select id from replies where inreplyto=$3)`
 	_, err := config.DB.Exec(query, _type, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -968,30 +789,39 @@ func (obj ObjectBase) _SetRepliesType(_type string) error {
 func (obj ObjectBase) TombstoneAttachment() error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select attachment from activitystream where id=$3)`
-	if _, err := config.DB.Exec(query, config.Domain+"/static/notfound.png", datetime, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select attachment from cacheactivitystream where id=$3)`
+	query := `update posts set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select attachment from posts where id=$3)`
 	_, err := config.DB.Exec(query, config.Domain+"/static/notfound.png", datetime, obj.Id)
 	return util.WrapError(err)
 }
 
 func (obj ObjectBase) TombstoneAttachmentReplies() error {
-	var attachment ObjectBase
+	var replies []ObjectBase
 
-	query := `select id from activitystream where id in (select id from replies where inreplyto=$1)`
-	if err := config.DB.QueryRow(query, obj.Id).Scan(&attachment.Id); err != nil {
-		return nil
+	query := `select id from posts where id in (select id from replies where inreplyto=$1)`
+	rows, err := config.DB.Query(query, obj.Id)
+	if err != nil {
+		return util.WrapError(err)
 	}
 
-	if err := attachment.DeleteAttachmentFromFile(); err != nil {
-		return util.WrapError(err)
+	for rows.Next() {
+		var reply ObjectBase
+		if err := rows.Scan(&reply.Id); err != nil {
+			rows.Close()
+			return util.WrapError(err)
+		}
+
+		replies = append(replies, reply)
 	}
+	rows.Close()
 
-	if err := attachment.TombstoneAttachment(); err != nil {
-		return util.WrapError(err)
+	for _, reply := range replies {
+		if err := reply.DeleteAttachmentFromFile(); err != nil {
+			return util.WrapError(err)
+		}
+
+		if err := reply.TombstoneAttachment(); err != nil {
+			return util.WrapError(err)
+		}
 	}
 
 	return nil
@@ -1000,30 +830,39 @@ func (obj ObjectBase) TombstoneAttachmentReplies() error {
 func (obj ObjectBase) TombstonePreview() error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select preview from activitystream where id=$3)`
-	if _, err := config.DB.Exec(query, config.Domain+"/static/notfound.png", datetime, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select preview from cacheactivitystream where id=$3)`
+	query := `update posts set type='Tombstone', mediatype='image/png', href=$1, name='', content='', attributedto='deleted', deleted=$2 where id in (select preview from posts where id=$3)`
 	_, err := config.DB.Exec(query, config.Domain+"/static/notfound.png", datetime, obj.Id)
 	return util.WrapError(err)
 }
 
 func (obj ObjectBase) TombstonePreviewReplies() error {
-	var attachment ObjectBase
+	var replies []ObjectBase
 
-	query := `select id from activitystream where id in (select id from replies where inreplyto=$1)`
-	if err := config.DB.QueryRow(query, obj.Id).Scan(&attachment.Id); err != nil {
-		return nil
+	query := `select id from posts where id in (select id from replies where inreplyto=$1)`
+	rows, err := config.DB.Query(query, obj.Id)
+	if err != nil {
+		return util.WrapError(err)
 	}
 
-	if err := attachment.DeletePreviewFromFile(); err != nil {
-		return util.WrapError(err)
+	for rows.Next() {
+		var reply ObjectBase
+		if err := rows.Scan(&reply.Id); err != nil {
+			rows.Close()
+			return util.WrapError(err)
+		}
+
+		replies = append(replies, reply)
 	}
+	rows.Close()
 
-	if err := attachment.TombstonePreview(); err != nil {
-		return util.WrapError(err)
+	for _, reply := range replies {
+		if err := reply.DeletePreviewFromFile(); err != nil {
+			return util.WrapError(err)
+		}
+
+		if err := reply.TombstonePreview(); err != nil {
+			return util.WrapError(err)
+		}
 	}
 
 	return nil
@@ -1050,18 +889,19 @@ func (obj ObjectBase) Tombstone() error {
 		return util.WrapError(err)
 	}
 
-	return obj._Tombstone()
+	if err := obj._Tombstone(); err != nil {
+		return util.WrapError(err)
+	}
+
+	obj.Changed("Delete")
+
+	return nil
 }
 
 func (obj ObjectBase) _Tombstone() error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', deleted=$1 where id=$2`
-	if _, err := config.DB.Exec(query, datetime, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='',  deleted=$1 where id=$2`
+	query := `update posts set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', capcode='', posterid='', deleted=$1 where id=$2`
 	_, err := config.DB.Exec(query, datetime, obj.Id)
 	return util.WrapError(err)
 }
@@ -1105,29 +945,19 @@ func (obj ObjectBase) TombstoneReplies() error {
 func (obj ObjectBase) _TombstoneReplies() error {
 	datetime := time.Now().UTC().Format(time.RFC3339)
 
-	query := `update activitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', deleted=$1 where id in (select id from replies where inreplyto=$2)`
-	if _, err := config.DB.Exec(query, datetime, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', deleted=$1 where id in (select id from replies where inreplyto=$2)`
+	query := `update posts set type='Tombstone', name='', content='', attributedto='deleted', tripcode='', capcode='', posterid='', deleted=$1 where id in (select id from replies where inreplyto=$2)`
 	_, err := config.DB.Exec(query, datetime, obj.Id)
 	return util.WrapError(err)
 }
 
 func (obj ObjectBase) UpdateType(_type string) error {
-	query := `update activitystream set type=$2 where id=$1 and type !='Tombstone'`
-	if _, err := config.DB.Exec(query, obj.Id, _type); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set type=$2 where id=$1 and type !='Tombstone'`
+	query := `update posts set type=$2 where id=$1 and type !='Tombstone'`
 	_, err := config.DB.Exec(query, obj.Id, _type)
 	return util.WrapError(err)
 }
 
 func (obj ObjectBase) UpdatePreview(preview string) error {
-	query := `update activitystream set preview=$1 where attachment=$2`
+	query := `update posts set preview=$1 where attachment=$2`
 	_, err := config.DB.Exec(query, preview, obj.Id)
 	return util.WrapError(err)
 }
@@ -1151,7 +981,7 @@ func (obj ObjectBase) Write() (ObjectBase, error) {
 			obj.Preview.Published = now
 			obj.Preview.Updated = &now
 			obj.Preview.AttributedTo = obj.Id
-			if err := obj.Preview.WritePreview(); err != nil {
+			if err := obj.Preview.insertMedia(true); err != nil {
 				return obj, util.WrapError(err)
 			}
 		}
@@ -1165,108 +995,62 @@ func (obj ObjectBase) Write() (ObjectBase, error) {
 			obj.Attachment[i].Published = now
 			obj.Attachment[i].Updated = &now
 			obj.Attachment[i].AttributedTo = obj.Id
-			obj.Attachment[i].WriteAttachment()
-			obj.WriteWithAttachment(obj.Attachment[i])
+			if err := obj.Attachment[i].insertMedia(true); err != nil {
+				return obj, util.WrapError(err)
+			}
+
+			if err := obj.insert(obj.Attachment[i], true); err != nil {
+				return obj, util.WrapError(err)
+			}
 		}
 	} else {
-		if err := obj._Write(); err != nil {
+		if err := obj.insert(ObjectBase{}, true); err != nil {
 			return obj, util.WrapError(err)
 		}
 	}
 
-	err = obj.WriteReply()
-
-	return obj, util.WrapError(err)
-}
-
-func (obj ObjectBase) _Write() error {
-
-	query := `insert into activitystream (id, type, name, content, published, updated, attributedto, actor, tripcode, sensitive) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
-	_, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.Sensitive)
-
-	return util.WrapError(err)
-}
-
-func (obj ObjectBase) WriteAttachment() error {
-	query := `insert into activitystream (id, type, name, href, published, updated, attributedTo, mediatype, size) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-	_, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Href, obj.Published, obj.Updated, obj.AttributedTo, obj.MediaType, obj.Size)
-
-	return util.WrapError(err)
-}
-
-func (obj ObjectBase) WriteAttachmentCache() error {
-	var id string
-
-	query := `select id from cacheactivitystream where id=$1`
-	if err := config.DB.QueryRow(query, obj.Id).Scan(&id); err != nil {
-		if obj.Updated == nil {
-			obj.Updated = &obj.Published
-		}
-
-		query = `insert into cacheactivitystream (id, type, name, href, published, updated, attributedTo, mediatype, size) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-		_, err = config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Href, obj.Published, obj.Updated, obj.AttributedTo, obj.MediaType, obj.Size)
-		return util.WrapError(err)
+	if err := obj.WriteReply(); err != nil {
+		return obj, util.WrapError(err)
 	}
 
-	return nil
-}
-
-func (obj ObjectBase) _WriteCache() error {
-	var id string
-
-	query := `select id from cacheactivitystream where id=$1`
-	if err := config.DB.QueryRow(query, obj.Id).Scan(&id); err != nil {
-		if obj.Updated == nil {
-			obj.Updated = &obj.Published
-		}
-
-		query = `insert into cacheactivitystream (id, type, name, content, published, updated, attributedto, actor, tripcode, sensitive) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
-		_, err = config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.Sensitive)
-		return util.WrapError(err)
+	if err := obj.WritePoll(); err != nil {
+		return obj, util.WrapError(err)
 	}
 
-	return nil
-}
+	obj.Changed("Create")
 
-func (obj ObjectBase) WriteCacheWithAttachment(attachment ObjectBase) error {
-	var id string
+	return obj, nil
+}
 
-	query := `select id from cacheactivitystream where id=$1`
-	if err := config.DB.QueryRow(query, obj.Id).Scan(&id); err != nil {
-		if obj.Updated == nil {
-			obj.Updated = &obj.Published
-		}
+// insert writes obj to posts, with attachment as its file if it has one.
+// Posts that are already there are left alone.
+func (obj ObjectBase) insert(attachment ObjectBase, local bool) error {
+	if obj.Updated == nil {
+		obj.Updated = &obj.Published
+	}
 
-		query = `insert into cacheactivitystream (id, type, name, content, attachment, preview, published, updated, attributedto, actor, tripcode, sensitive) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
-		_, err = config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, attachment.Id, obj.Preview.Id, obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.Sensitive)
-		return util.WrapError(err)
+	var preview string
+	if attachment.Id != "" && obj.Preview != nil {
+		preview = obj.Preview.Id
 	}
 
-	return nil
-}
+	query := `insert into posts (id, type, name, content, attachment, preview, published, updated, attributedto, actor, tripcode, capcode, posterid, sensitive, deletepass, local) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) on conflict (id) do nothing`
+	_, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, attachment.Id, preview, obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.Capcode, obj.PosterID, obj.Sensitive, obj.DeletePassword, local)
 
-func (obj ObjectBase) WritePreview() error {
-	query := `insert into activitystream (id, type, name, href, published, updated, attributedTo, mediatype, size) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-	_, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Href, obj.Published, obj.Updated, obj.AttributedTo, obj.MediaType, obj.Size)
 	return util.WrapError(err)
 }
 
-func (obj ObjectBase) WritePreviewCache() error {
-	var id string
-
-	query := `select id from cacheactivitystream where id=$1`
-	err := config.DB.QueryRow(query, obj.Id).Scan(&id)
-	if err != nil {
-		if obj.Updated == nil {
-			obj.Updated = &obj.Published
-		}
-
-		query = `insert into cacheactivitystream (id, type, name, href, published, updated, attributedTo, mediatype, size) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-		_, err = config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Href, obj.Published, obj.Updated, obj.AttributedTo, obj.MediaType, obj.Size)
-		return util.WrapError(err)
+// insertMedia writes obj, an attachment or preview, to posts.
+// Ones that are already there are left alone.
+func (obj ObjectBase) insertMedia(local bool) error {
+	if obj.Updated == nil {
+		obj.Updated = &obj.Published
 	}
 
-	return nil
+	query := `insert into posts (id, type, name, href, published, updated, attributedTo, mediatype, size, width, height, hash, phash, spoiler, local) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) on conflict (id) do nothing`
+	_, err := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Href, obj.Published, obj.Updated, obj.AttributedTo, obj.MediaType, obj.Size, obj.Width, obj.Height, obj.Hash, obj.PHash, obj.Spoiler, local)
+
+	return util.WrapError(err)
 }
 
 func (obj ObjectBase) WriteReply() error {
@@ -1307,11 +1091,24 @@ func (obj ObjectBase) WriteReply() error {
 			}
 		}
 
+		// Threads past their bump limit or autosaged sink regardless
+		if update {
+			if bump, err := e.Bumping(); err == nil && !bump {
+				update = false
+			}
+		}
+
 		if update {
 			if err := e.WriteUpdate(obj.Published); err != nil {
 				return util.WrapError(err)
 			}
 		}
+
+		if i == 0 {
+			if err := e.Cycle(); err != nil {
+				return util.WrapError(err)
+			}
+		}
 	}
 
 	if len(obj.InReplyTo) == 0 {
@@ -1329,27 +1126,86 @@ func (obj ObjectBase) WriteReply() error {
 	return nil
 }
 
+// posterIDRe matches poster IDs we are willing to show.
+var posterIDRe = regexp.MustCompile(`^[A-Za-z0-9+/_-]{1,16}$`)
+
+// capcodes are the staff titles a post may be marked with.
+var capcodes = map[string]bool{
+	"Janitor": true,
+	"Mod":     true,
+	"Admin":   true,
+}
+
 func (obj ObjectBase) WriteCache() (ObjectBase, error) {
+	// Only the instance hosting a board can vouch for its staff
+	if !capcodes[obj.Capcode] || !util.SameOrigin(obj.Id, obj.Actor) {
+		obj.Capcode = ""
+	}
+
+	if !posterIDRe.MatchString(obj.PosterID) {
+		obj.PosterID = ""
+	}
+
+	// Polls are kept apart from the post they're in
+	if obj.Type == "Question" {
+		obj.Type = "Note"
+	}
+
+	// A content warning is how most other software hides files
+	if obj.Summary != "" {
+		for i := range obj.Attachment {
+			obj.Attachment[i].Spoiler = true
+		}
+	}
+
 	if isBlacklisted, err := util.IsPostBlacklist(obj.Content); err != nil || isBlacklisted {
 		log.Println("Blacklist post blocked")
 		return obj, util.WrapError(err)
 	}
 
+	for i := range obj.Attachment {
+		if obj.Attachment[i].checkMediaBan() {
+			log.Println("Banned media blocked")
+			return obj, nil
+		}
+	}
+
+	// Replies to threads past their image limit are kept, but not their files
+	if len(obj.Attachment) > 0 && len(obj.InReplyTo) > 0 {
+		if _, full, err := obj.InReplyTo[0].LimitsReached(); err == nil && full {
+			obj.Attachment = nil
+			obj.Preview = nil
+		}
+	}
+
 	if len(obj.Attachment) > 0 {
 		if obj.Preview.Href != "" {
-			obj.Preview.WritePreviewCache()
+			obj.Preview.insertMedia(false)
 		}
 
 		for i := range obj.Attachment {
-			obj.Attachment[i].WriteAttachmentCache()
-			obj.WriteCacheWithAttachment(obj.Attachment[i])
+			obj.Attachment[i].insertMedia(false)
+			obj.insert(obj.Attachment[i], false)
 		}
 	} else {
-		obj._WriteCache()
+		obj.insert(ObjectBase{}, false)
 	}
 
 	obj.WriteReply()
 
+	if err := obj.WritePoll(); err != nil {
+		return obj, util.WrapError(err)
+	}
+
+	// Mirror the pruning of cyclical threads hosted elsewhere
+	if len(obj.InReplyTo) == 0 && obj.Cyclical != nil && *obj.Cyclical > 0 && util.SameOrigin(obj.Id, obj.Actor) {
+		if err := obj.SetCyclical(obj.Actor, *obj.Cyclical); err != nil {
+			return obj, util.WrapError(err)
+		}
+	}
+
+	obj.Changed("Create")
+
 	if obj.Replies != nil {
 		for _, e := range obj.Replies.OrderedItems {
 			e.WriteCache()
@@ -1360,27 +1216,11 @@ func (obj ObjectBase) WriteCache() (ObjectBase, error) {
 }
 
 func (obj ObjectBase) WriteUpdate(updated time.Time) error {
-	query := `update activitystream set updated=$1 where id=$2`
-	if _, err := config.DB.Exec(query, updated, obj.Id); err != nil {
-		return util.WrapError(err)
-	}
-
-	query = `update cacheactivitystream set updated=$1 where id=$2`
+	query := `update posts set updated=$1 where id=$2`
 	_, err := config.DB.Exec(query, updated, obj.Id)
 	return util.WrapError(err)
 }
 
-func (obj ObjectBase) WriteWithAttachment(attachment ObjectBase) {
-
-	query := `insert into activitystream (id, type, name, content, attachment, preview, published, updated, attributedto, actor, tripcode, sensitive) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
-	_, e := config.DB.Exec(query, obj.Id, obj.Type, obj.Name, obj.Content, attachment.Id, obj.Preview.Id, obj.Published, obj.Updated, obj.AttributedTo, obj.Actor, obj.TripCode, obj.Sensitive)
-
-	if e != nil {
-		log.Println("error inserting new activity with attachment")
-		panic(e)
-	}
-}
-
 func (obj ObjectBase) MarkSticky(actorID string) error {
 	var count int
 
@@ -1389,6 +1229,20 @@ func (obj ObjectBase) MarkSticky(actorID string) error {
 		return util.WrapError(err)
 	}
 
+	// Replies may be stickied to keep cyclical threads from pruning them
+	if count == 0 {
+		op, err := obj.GetOP()
+		if err != nil {
+			return util.WrapError(err)
+		}
+
+		if keep, err := (ObjectBase{Id: op}).GetCyclical(); err != nil {
+			return util.WrapError(err)
+		} else if keep > 0 {
+			count = 1
+		}
+	}
+
 	if count == 1 {
 		var nCount int
 		query = `select count(activity_id) from sticky where activity_id=$1`
@@ -1407,6 +1261,8 @@ func (obj ObjectBase) MarkSticky(actorID string) error {
 				return util.WrapError(err)
 			}
 		}
+
+		obj.Changed("Sticky")
 	}
 
 	return nil
@@ -1439,6 +1295,132 @@ func (obj ObjectBase) MarkLocked(actorID string) error {
 				return util.WrapError(err)
 			}
 		}
+
+		obj.Changed("Lock")
+	}
+
+	return nil
+}
+
+func (obj ObjectBase) MarkAutosage(actorID string) error {
+	var count int
+
+	var query = `select count(id) from replies where inreplyto='' and id=$1`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&count); err != nil {
+		return util.WrapError(err)
+	}
+
+	if count == 1 {
+		var nCount int
+
+		query = `select count(activity_id) from autosage where activity_id=$1`
+		if err := config.DB.QueryRow(query, obj.Id).Scan(&nCount); err != nil {
+			return util.WrapError(err)
+		}
+
+		if nCount > 0 {
+			query = `delete from autosage where activity_id=$1`
+			if _, err := config.DB.Exec(query, obj.Id); err != nil {
+				return util.WrapError(err)
+			}
+		} else {
+			query = `insert into autosage (actor_id, activity_id) values ($1, $2)`
+			if _, err := config.DB.Exec(query, actorID, obj.Id); err != nil {
+				return util.WrapError(err)
+			}
+		}
+
+		obj.Changed("Update")
+	}
+
+	return nil
+}
+
+// MarkCyclical makes the thread obj starts cyclical, keeping only its last
+// keep replies, or makes it an ordinary thread again if it already is.
+func (obj ObjectBase) MarkCyclical(actorID string, keep int) error {
+	if n, err := obj.GetCyclical(); err != nil {
+		return util.WrapError(err)
+	} else if n > 0 {
+		keep = 0
+	}
+
+	return obj.SetCyclical(actorID, keep)
+}
+
+// SetCyclical sets how many replies the thread obj starts keeps, pruning it
+// right away.
+// Zero makes it an ordinary thread.
+func (obj ObjectBase) SetCyclical(actorID string, keep int) error {
+	if isOP, _ := obj.CheckIfOP(); !isOP {
+		return nil
+	}
+
+	query := `delete from cyclical where activity_id=$1`
+	if _, err := config.DB.Exec(query, obj.Id); err != nil {
+		return util.WrapError(err)
+	}
+
+	defer obj.Changed("Update")
+
+	if keep <= 0 {
+		return nil
+	}
+
+	query = `insert into cyclical (actor_id, activity_id, keep) values ($1, $2, $3)`
+	if _, err := config.DB.Exec(query, actorID, obj.Id, keep); err != nil {
+		return util.WrapError(err)
+	}
+
+	return obj.Cycle()
+}
+
+// GetCyclical returns how many replies the thread obj starts keeps, or zero if
+// it is not cyclical.
+func (obj ObjectBase) GetCyclical() (int, error) {
+	var keep int
+
+	query := `select keep from cyclical where activity_id=$1`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&keep); errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, util.WrapError(err)
+	}
+
+	return keep, nil
+}
+
+// Cycle tombstones the oldest replies of a cyclical thread past the number it
+// keeps.
+// Stickied replies are never pruned, and do not count towards the limit.
+func (obj ObjectBase) Cycle() error {
+	keep, err := obj.GetCyclical()
+	if err != nil || keep == 0 {
+		return err
+	}
+
+	query := `select x.id from (select id, type, published from posts where id in (select id from replies where inreplyto=$1)) as x where x.type != 'Tombstone' and x.id not in (select activity_id from sticky) order by x.published desc offset $2`
+	rows, err := config.DB.Query(query, obj.Id, keep)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	var prune []ObjectBase
+	for rows.Next() {
+		var post ObjectBase
+		if err := rows.Scan(&post.Id); err != nil {
+			rows.Close()
+			return util.WrapError(err)
+		}
+
+		prune = append(prune, post)
+	}
+	rows.Close()
+
+	for _, post := range prune {
+		if err := post.Tombstone(); err != nil {
+			return util.WrapError(err)
+		}
 	}
 
 	return nil
@@ -1474,6 +1456,75 @@ func (obj ObjectBase) IsLocked() (bool, error) {
 	return false, nil
 }
 
+func (obj ObjectBase) IsAutosage() (bool, error) {
+	var count int
+
+	query := `select count(activity_id) from autosage where activity_id=$1`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&count); err != nil {
+		return false, util.WrapError(err)
+	}
+
+	return count != 0, nil
+}
+
+// threadLimits returns the limits of the board the thread obj starts was
+// posted to.
+// Threads on boards we do not host follow the limits of the instance.
+func (obj ObjectBase) threadLimits() (ThreadLimits, error) {
+	var l ThreadLimits
+
+	query := `select bumplimit, imagelimit from actor where id in ((select actor from posts where id = $1), $2) order by id = $2 limit 1`
+	err := config.DB.QueryRow(query, obj.Id, config.Domain).Scan(&l.BumpLimit, &l.ImageLimit)
+
+	return l, util.WrapError(err)
+}
+
+// LimitsReached reports whether the thread obj starts is past its board's
+// bump limit and image limit.
+func (obj ObjectBase) LimitsReached() (bool, bool, error) {
+	l, err := obj.threadLimits()
+	if err != nil {
+		return false, false, err
+	}
+
+	var replies, images int
+
+	query := `select count(*), count(nullif(x.attachment, '')) from replies r join posts x on x.id = r.id where r.inreplyto = $1 and x.type != 'Tombstone'`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&replies, &images); err != nil {
+		return false, false, util.WrapError(err)
+	}
+
+	return l.BumpLimit > 0 && replies >= l.BumpLimit, l.ImageLimit > 0 && images >= l.ImageLimit, nil
+}
+
+// Bumping reports whether replies to obj should bump it.
+func (obj ObjectBase) Bumping() (bool, error) {
+	if autosage, err := obj.IsAutosage(); err != nil || autosage {
+		return false, err
+	}
+
+	bumpLimit, _, err := obj.LimitsReached()
+	return !bumpLimit, err
+}
+
+// SetPosterID records obj.PosterID for a post that has already been written.
+func (obj ObjectBase) SetPosterID() error {
+	_, err := config.DB.Exec(`update posts set posterid = $1 where id = $2`, obj.PosterID, obj.Id)
+	return util.WrapError(err)
+}
+
+// IsBanMarked reports whether obj says its poster was banned for it.
+func (obj ObjectBase) IsBanMarked() (bool, error) {
+	var count int
+
+	query := `select count(id) from bans where post=$1 and marked`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&count); err != nil {
+		return false, util.WrapError(err)
+	}
+
+	return count != 0, nil
+}
+
 func collectTo() ([]string, error) {
 	// This is a hack to prevent recursive dependencies
 
@@ -1528,7 +1579,7 @@ func (obj ObjectBase) SendEmailNotify() {
 		fmt.Sprintf("InReplyTo: %s", irt),
 		fmt.Sprintf("Subject: %s", obj.Name),
 		"",
-		obj.Content,
+		markup.PlainText(obj.Content),
 	}, "\n")
 
 	domain, _, _ := strings.Cut(config.SiteEmailSMTP, ":")
@@ -0,0 +1,110 @@
+package activitypub
+
+import (
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// OverboardQuery is what threads to show on the overboard.
+type OverboardQuery struct {
+	// Exclude are the IDs of local boards whose threads are left out,
+	// along with those of the boards they follow that no other board does.
+	Exclude []string
+
+	// SFW leaves out the threads shown on boards that aren't safe for work,
+	// and threads marked sensitive.
+	SFW bool
+
+	// Replies is how many of the latest replies of each thread to load.
+	// Catalogs load none, and only count them.
+	Replies int
+
+	Limit, Offset int
+}
+
+// OverboardThread is a thread on the overboard.
+type OverboardThread struct {
+	Thread ObjectBase
+
+	// Board is the ID of the local board the thread is shown on.
+	Board string
+}
+
+// Overboard returns the threads on every local board and the boards they
+// follow, latest bumped first.
+// It also returns how many threads there are in total.
+func Overboard(q OverboardQuery) ([]OverboardThread, int, error) {
+	var threads []OverboardThread
+	var total int
+
+	// Cached threads are shown on whichever local board that isn't left out
+	// follows theirs, much like they are in searches
+	query := `select count(*) over(), x.board, coalesce(c.replies, 0), coalesce(c.images, 0), x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.posterid, x.sensitive from
+	(select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, posterid, sensitive, case when local then actor else (select id from following where following = posts.actor and id != $1 and not (id = any($2)) order by id limit 1) end as board
+		from posts where type='Note' and id in (select id from replies where inreplyto='')) as x
+	join actor a on a.id = x.board
+	left join lateral (select count(*) as replies, count(nullif(r.attachment, '')) as images from (select attachment from posts where id in (select id from replies where inreplyto=x.id) and type='Note') as r) as c on true
+	where x.board != $1 and not (x.board = any($2)) and (not $3 or (a.restricted and not x.sensitive))
+	order by x.updated desc limit $4 offset $5`
+
+	exclude := q.Exclude
+	if exclude == nil {
+		exclude = []string{}
+	}
+
+	rows, err := config.DB.Query(query, config.Domain, exclude, q.SFW, q.Limit, q.Offset)
+	if err != nil {
+		return nil, 0, util.WrapError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var t OverboardThread
+		var replies CollectionBase
+
+		t.Thread, err = scanPost(rows, &total, &t.Board, &replies.TotalItems, &replies.TotalImgs)
+		if err != nil {
+			return nil, 0, util.WrapError(err)
+		}
+
+		t.Thread.Replies = &replies
+		threads = append(threads, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, util.WrapError(err)
+	}
+
+	rows.Close()
+
+	ops := make([]*ObjectBase, len(threads))
+	for i := range threads {
+		ops[i] = &threads[i].Thread
+	}
+
+	if q.Replies > 0 {
+		err = loadThreads(ops, q.Replies)
+	} else {
+		err = loadCatalog(ops)
+	}
+
+	if err != nil {
+		return nil, 0, util.WrapError(err)
+	}
+
+	return threads, total, nil
+}
+
+// loadCatalog loads what is shown of the threads ops start in catalogs: their
+// flags, polls and media.
+func loadCatalog(ops []*ObjectBase) error {
+	if err := loadThreadFlags(ops); err != nil {
+		return err
+	}
+
+	if err := loadPolls(ops); err != nil {
+		return err
+	}
+
+	return loadMedia(ops)
+}
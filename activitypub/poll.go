@@ -0,0 +1,346 @@
+package activitypub
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// Poll is a poll attached to the start of a thread, federated the way
+// Mastodon does it: as a Question with its choices in oneOf if only one may be
+// picked, or anyOf if several may.
+// Each choice is a Note named after it, with its vote count in its replies.
+type Poll struct {
+	OneOf   []ObjectBase `json:"oneOf,omitempty"`
+	AnyOf   []ObjectBase `json:"anyOf,omitempty"`
+	EndTime *time.Time   `json:"endTime,omitempty"`
+}
+
+// NewPoll makes a poll with choices that closes at end.
+func NewPoll(choices []string, multiple bool, end time.Time) Poll {
+	var p Poll
+
+	var objs []ObjectBase
+	for _, c := range choices {
+		objs = append(objs, ObjectBase{Type: "Note", Name: c, Replies: &CollectionBase{Type: "Collection"}})
+	}
+
+	if multiple {
+		p.AnyOf = objs
+	} else {
+		p.OneOf = objs
+	}
+
+	p.EndTime = &end
+	return p
+}
+
+// Choices returns the choices of the poll, if there is one.
+func (p Poll) Choices() []ObjectBase {
+	if len(p.AnyOf) > 0 {
+		return p.AnyOf
+	}
+
+	return p.OneOf
+}
+
+// Multiple reports whether voters may pick more than one choice.
+func (p Poll) Multiple() bool {
+	return len(p.AnyOf) > 0
+}
+
+// Closed reports whether the poll has stopped taking votes.
+func (p Poll) Closed() bool {
+	return p.EndTime != nil && time.Now().After(*p.EndTime)
+}
+
+// TotalVotes returns the number of votes cast across every choice.
+func (p Poll) TotalVotes() int {
+	n := 0
+	for _, c := range p.Choices() {
+		if c.Replies != nil {
+			n += c.Replies.TotalItems
+		}
+	}
+
+	return n
+}
+
+// HasChoice reports whether name is one of the choices of the poll.
+func (p Poll) HasChoice(name string) bool {
+	for _, c := range p.Choices() {
+		if c.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MarshalJSON presents posts with polls as Questions, which is what other
+// software expects them to be.
+// They are stored as Notes like any other post.
+// Posts with spoilered files are given a content warning for the same reason.
+func (obj ObjectBase) MarshalJSON() ([]byte, error) {
+	type object ObjectBase
+
+	o := object(obj)
+	if o.Type == "Note" && len(o.Choices()) > 0 {
+		o.Type = "Question"
+	}
+
+	if o.Summary == "" {
+		for _, a := range o.Attachment {
+			if a.Spoiler {
+				o.Summary = "Spoiler"
+				break
+			}
+		}
+	}
+
+	return json.Marshal(o)
+}
+
+// WritePoll stores the poll of obj, the start of a thread.
+func (obj ObjectBase) WritePoll() error {
+	if isOP, _ := obj.CheckIfOP(); !isOP {
+		return nil
+	}
+
+	choices := obj.Choices()
+	if len(choices) == 0 {
+		return nil
+	}
+
+	query := `insert into polls (id, multiple, endtime) values ($1, $2, $3) on conflict (id) do nothing`
+	if _, err := config.DB.Exec(query, obj.Id, obj.Multiple(), obj.EndTime); err != nil {
+		return util.WrapError(err)
+	}
+
+	for i, c := range choices {
+		votes := 0
+		if c.Replies != nil {
+			votes = c.Replies.TotalItems
+		}
+
+		query = `insert into polloptions (poll, position, name, votes) values ($1, $2, $3, $4)`
+		if _, err := config.DB.Exec(query, obj.Id, i, c.Name, votes); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// GetPoll returns the poll of the thread obj starts.
+// Threads without one have a Poll without choices.
+func (obj ObjectBase) GetPoll() (Poll, error) {
+	var p Poll
+	var multiple bool
+	var end sql.NullTime
+
+	query := `select multiple, endtime from polls where id=$1`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&multiple, &end); errors.Is(err, sql.ErrNoRows) {
+		return p, nil
+	} else if err != nil {
+		return p, util.WrapError(err)
+	}
+
+	rows, err := config.DB.Query(`select name, votes from polloptions where poll=$1 order by position`, obj.Id)
+	if err != nil {
+		return p, util.WrapError(err)
+	}
+
+	defer rows.Close()
+
+	var choices []ObjectBase
+	for rows.Next() {
+		c := ObjectBase{Type: "Note", Replies: &CollectionBase{Type: "Collection"}}
+		if err := rows.Scan(&c.Name, &c.Replies.TotalItems); err != nil {
+			return p, util.WrapError(err)
+		}
+
+		choices = append(choices, c)
+	}
+
+	if multiple {
+		p.AnyOf = choices
+	} else {
+		p.OneOf = choices
+	}
+
+	if end.Valid {
+		p.EndTime = &end.Time
+	}
+
+	return p, util.WrapError(rows.Err())
+}
+
+// Vote records the vote of the poster known by voters, their current identity
+// first, for each of names in the poll of obj, and counts it under that
+// identity.
+// It reports false if they have already voted.
+// The poll is locked while the vote is counted, so that votes sent at once
+// can't get past the check.
+func (obj ObjectBase) Vote(voters []string, names []string) (bool, error) {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return false, util.WrapError(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`select from polls where id=$1 for update`, obj.Id); err != nil {
+		return false, util.WrapError(err)
+	}
+
+	var voted bool
+
+	query := `select exists (select 1 from pollvotes where poll=$1 and voter = any($2))`
+	if err := tx.QueryRow(query, obj.Id, voters).Scan(&voted); err != nil || voted {
+		return false, util.WrapError(err)
+	}
+
+	now := time.Now().UTC()
+
+	for _, name := range names {
+		query = `insert into pollvotes (poll, name, voter, created) values ($1, $2, $3, $4) on conflict (poll, voter, name) do nothing`
+		res, err := tx.Exec(query, obj.Id, name, voters[0], now)
+		if err != nil {
+			return false, util.WrapError(err)
+		}
+
+		if n, err := res.RowsAffected(); err != nil {
+			return false, util.WrapError(err)
+		} else if n == 0 {
+			continue
+		}
+
+		query = `update polloptions set votes = votes + 1 where poll=$1 and name=$2`
+		if _, err := tx.Exec(query, obj.Id, name); err != nil {
+			return false, util.WrapError(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, util.WrapError(err)
+	}
+
+	obj.Changed("Update")
+
+	return true, nil
+}
+
+// SetPollVotes takes the vote counts of the poll of obj as they are on the
+// instance hosting it.
+func (obj ObjectBase) SetPollVotes() error {
+	for _, c := range obj.Choices() {
+		if c.Replies == nil {
+			continue
+		}
+
+		query := `update polloptions set votes=$1 where poll=$2 and name=$3`
+		if _, err := config.DB.Exec(query, c.Replies.TotalItems, obj.Id, c.Name); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	obj.Changed("Update")
+
+	return nil
+}
+
+// IsVote reports whether obj looks like a vote in a poll rather than a post:
+// a Note with nothing but the name of a choice.
+func (obj ObjectBase) IsVote() bool {
+	return obj.Type == "Note" && obj.Name != "" && obj.Content == "" && len(obj.Attachment) == 0 && len(obj.InReplyTo) == 1 && obj.InReplyTo[0].Id != ""
+}
+
+// ProcessVote counts the vote activity carries if it is one, reporting whether
+// it was.
+// Votes for polls hosted elsewhere, polls that have closed and choices that
+// don't exist are dropped.
+func (activity Activity) ProcessVote() (bool, error) {
+	if !activity.Object.IsVote() {
+		return false, nil
+	}
+
+	poll := ObjectBase{Id: activity.Object.InReplyTo[0].Id}
+
+	p, err := poll.GetPoll()
+	if err != nil {
+		return false, util.WrapError(err)
+	} else if len(p.Choices()) == 0 {
+		return false, nil
+	}
+
+	if local, _ := poll.IsLocal(); !local || p.Closed() || !p.HasChoice(activity.Object.Name) {
+		return true, nil
+	}
+
+	// Who voted on another instance can't be checked from here, and the
+	// poster IDs it sends are made up by it and change over time, so that
+	// instance is trusted to let each of its posters vote once, as this one
+	// does for its own. All that can be checked is that the vote was made
+	// by the actor that signed it, so votes are counted under that actor and
+	// the ID of the vote, each only once.
+	if !util.SameOrigin(activity.Actor.Id, activity.Object.Id) {
+		return true, nil
+	}
+
+	voter := activity.Actor.Id + " " + activity.Object.Id
+
+	if counted, err := poll.Vote([]string{voter}, []string{activity.Object.Name}); err != nil || !counted {
+		return true, util.WrapError(err)
+	}
+
+	go func() {
+		if err := poll.UpdateRequest(); err != nil {
+			log.Printf("Failed to federate votes of %s: %v", poll.Id, err)
+		}
+	}()
+
+	return true, nil
+}
+
+// SendVote sends the votes of voter in the poll of obj, hosted on another
+// instance, through actor.
+func (obj ObjectBase) SendVote(actor Actor, voter string, names []string) error {
+	var pollActor string
+
+	query := `select actor from posts where id=$1 and not local`
+	if err := config.DB.QueryRow(query, obj.Id).Scan(&pollActor); err != nil {
+		return util.WrapError(err)
+	}
+
+	for _, name := range names {
+		id, err := util.CreateUniqueID(actor.Id)
+		if err != nil {
+			return util.WrapError(err)
+		}
+
+		vote := CreateObject("Note")
+		vote.Id = fmt.Sprintf("%s/%s", actor.Id, id)
+		vote.Name = name
+		vote.AttributedTo = voter
+		vote.Actor = actor.Id
+		vote.InReplyTo = []ObjectBase{{Id: obj.Id}}
+		vote.To = []string{pollActor}
+
+		activity, err := vote.CreateActivity("Create")
+		if err != nil {
+			return util.WrapError(err)
+		}
+
+		if err := activity.Send(); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,426 @@
+package activitypub
+
+import (
+	"database/sql"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// Board pages, catalogs and threads are read in two steps: the posts on them
+// first, then what goes with those posts with one query for each kind of
+// thing, so the number of queries a page takes does not grow with the number
+// of posts on it.
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanPost reads a row made of dest followed by the columns id, name,
+// content, type, published, updated, attributedto, attachment, preview,
+// actor, tripcode, capcode, posterid and sensitive.
+// The attachment and preview only have their IDs until loadMedia is called.
+func scanPost(row scanner, dest ...any) (ObjectBase, error) {
+	var post ObjectBase
+	var attch, prev string
+
+	dest = append(dest, &post.Id, &post.Name, &post.Content, &post.Type, &post.Published, &post.Updated, &post.AttributedTo, &attch, &prev, &post.Actor, &post.TripCode, &post.Capcode, &post.PosterID, &post.Sensitive)
+	if err := row.Scan(dest...); err != nil {
+		return post, err
+	}
+
+	if attch != "" {
+		post.Attachment = []ObjectBase{{Id: attch}}
+	}
+
+	if prev != "" {
+		post.Preview = &ObjectBase{Id: prev}
+	}
+
+	return post, nil
+}
+
+func postPointers(posts []ObjectBase) []*ObjectBase {
+	ptrs := make([]*ObjectBase, len(posts))
+	for i := range posts {
+		ptrs[i] = &posts[i]
+	}
+
+	return ptrs
+}
+
+func postIDs(posts []*ObjectBase) []string {
+	ids := make([]string, len(posts))
+	for i, p := range posts {
+		ids[i] = p.Id
+	}
+
+	return ids
+}
+
+// loadThreads loads everything shown with the threads ops start: their flags
+// and polls, their latest replies (all of them if replies is 0), the replies
+// to those, and the media of all of them.
+func loadThreads(ops []*ObjectBase, replies int) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	if err := loadThreadFlags(ops); err != nil {
+		return err
+	}
+
+	if err := loadPolls(ops); err != nil {
+		return err
+	}
+
+	posts, err := loadReplyTree(ops, replies)
+	if err != nil {
+		return err
+	}
+
+	return loadMedia(append(posts, ops...))
+}
+
+// loadReplyTree loads the latest replies to each of parents (all of them if
+// limit is 0) along with their flags and the replies to them.
+// It returns every post it loaded, whose media are still to be loaded.
+func loadReplyTree(parents []*ObjectBase, limit int) ([]*ObjectBase, error) {
+	replies, err := loadReplies(parents, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	backlinks, err := loadReplies(replies, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	posts := append(replies, backlinks...)
+
+	return posts, loadPostFlags(posts)
+}
+
+// loadReplies sets the replies of each of parents to the latest of them, or
+// all of them if limit is 0, oldest first.
+// It returns pointers to the replies it loaded.
+func loadReplies(parents []*ObjectBase, limit int) ([]*ObjectBase, error) {
+	if len(parents) == 0 {
+		return nil, nil
+	}
+
+	query := `select y.inreplyto, y.replies, y.images, y.id, y.name, y.content, y.type, y.published, y.updated, y.attributedto, y.attachment, y.preview, y.actor, y.tripcode, y.capcode, y.posterid, y.sensitive from
+	(select r.inreplyto, count(*) over w as replies, count(nullif(x.attachment, '')) over w as images, row_number() over (w order by x.published desc) as n, x.* from replies r join
+		(select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, posterid, sensitive from posts where id in (select id from replies where inreplyto = any($1)) and (type='Note' or type='Archive')) as x
+	on x.id = r.id where r.inreplyto = any($1) window w as (partition by r.inreplyto)) as y
+	where $2 = 0 or y.n <= $2 order by y.inreplyto, y.published`
+
+	rows, err := config.DB.Query(query, postIDs(parents), limit)
+	if err != nil {
+		return nil, util.WrapError(err)
+	}
+
+	defer rows.Close()
+
+	colls := make(map[string]*CollectionBase)
+	for rows.Next() {
+		var parent string
+		var count, imgs int
+
+		post, err := scanPost(rows, &parent, &count, &imgs)
+		if err != nil {
+			return nil, util.WrapError(err)
+		}
+
+		post.InReplyTo = []ObjectBase{{Id: parent}}
+
+		coll, ok := colls[parent]
+		if !ok {
+			coll = &CollectionBase{TotalItems: count, TotalImgs: imgs}
+			colls[parent] = coll
+		}
+
+		coll.OrderedItems = append(coll.OrderedItems, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, util.WrapError(err)
+	}
+
+	var loaded []*ObjectBase
+	for _, p := range parents {
+		if p.Replies = colls[p.Id]; p.Replies != nil {
+			loaded = append(loaded, postPointers(p.Replies.OrderedItems)...)
+		}
+	}
+
+	return loaded, nil
+}
+
+// loadThreadFlags sets what IsLocked, IsAutosage, GetCyclical, LimitsReached
+// and IsBanMarked would return for each of the threads ops start.
+func loadThreadFlags(ops []*ObjectBase) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	query := `select x.id, exists (select 1 from locked where activity_id = x.id), exists (select 1 from autosage where activity_id = x.id), coalesce((select keep from cyclical where activity_id = x.id), 0), exists (select 1 from bans where post = x.id and marked),
+	coalesce(l.bumplimit, 0), coalesce(l.imagelimit, 0), c.replies, c.images
+	from unnest($1::text[]) as x(id)
+	left join lateral (select bumplimit, imagelimit from actor where id in ((select actor from posts where id = x.id), $2) order by id = $2 limit 1) as l on true
+	left join lateral (select count(*) as replies, count(nullif(s.attachment, '')) as images from replies r join (select id, attachment from posts where id in (select id from replies where inreplyto = x.id) and type != 'Tombstone') as s on s.id = r.id where r.inreplyto = x.id) as c on true`
+
+	rows, err := config.DB.Query(query, postIDs(ops), config.Domain)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	defer rows.Close()
+
+	flags := make(map[string]ObjectBase)
+	for rows.Next() {
+		var id string
+		var f ObjectBase
+		var l ThreadLimits
+		var replies, images, keep int
+
+		if err := rows.Scan(&id, &f.Locked, &f.Autosage, &keep, &f.BanMarked, &l.BumpLimit, &l.ImageLimit, &replies, &images); err != nil {
+			return util.WrapError(err)
+		}
+
+		f.BumpLimit = l.BumpLimit > 0 && replies >= l.BumpLimit
+		f.ImageLimit = l.ImageLimit > 0 && images >= l.ImageLimit
+		if keep > 0 {
+			f.Cyclical = &keep
+		}
+		flags[id] = f
+	}
+
+	if err := rows.Err(); err != nil {
+		return util.WrapError(err)
+	}
+
+	for _, op := range ops {
+		f := flags[op.Id]
+		op.Locked, op.Autosage, op.Cyclical, op.BanMarked = f.Locked, f.Autosage, f.Cyclical, f.BanMarked
+		op.BumpLimit, op.ImageLimit = f.BumpLimit, f.ImageLimit
+	}
+
+	return nil
+}
+
+// loadPostFlags sets what IsSticky and IsBanMarked would return for each of
+// posts.
+func loadPostFlags(posts []*ObjectBase) error {
+	if len(posts) == 0 {
+		return nil
+	}
+
+	query := `select x.id, exists (select 1 from sticky where activity_id = x.id), exists (select 1 from bans where post = x.id and marked) from unnest($1::text[]) as x(id)`
+
+	rows, err := config.DB.Query(query, postIDs(posts))
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	defer rows.Close()
+
+	flags := make(map[string]ObjectBase)
+	for rows.Next() {
+		var id string
+		var f ObjectBase
+
+		if err := rows.Scan(&id, &f.Sticky, &f.BanMarked); err != nil {
+			return util.WrapError(err)
+		}
+
+		flags[id] = f
+	}
+
+	if err := rows.Err(); err != nil {
+		return util.WrapError(err)
+	}
+
+	for _, p := range posts {
+		p.Sticky, p.BanMarked = flags[p.Id].Sticky, flags[p.Id].BanMarked
+	}
+
+	return nil
+}
+
+// loadPolls sets what GetPoll would return for each of the threads ops start.
+func loadPolls(ops []*ObjectBase) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	query := `select p.id, p.multiple, p.endtime, o.poll is not null, coalesce(o.name, ''), coalesce(o.votes, 0) from polls p left join polloptions o on o.poll = p.id where p.id = any($1) order by p.id, o.position`
+
+	rows, err := config.DB.Query(query, postIDs(ops))
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	defer rows.Close()
+
+	polls := make(map[string]*Poll)
+	for rows.Next() {
+		var id string
+		var multiple, hasChoice bool
+		var end sql.NullTime
+
+		c := ObjectBase{Type: "Note", Replies: &CollectionBase{Type: "Collection"}}
+		if err := rows.Scan(&id, &multiple, &end, &hasChoice, &c.Name, &c.Replies.TotalItems); err != nil {
+			return util.WrapError(err)
+		}
+
+		p, ok := polls[id]
+		if !ok {
+			p = &Poll{}
+			if end.Valid {
+				p.EndTime = &end.Time
+			}
+
+			polls[id] = p
+		}
+
+		if !hasChoice {
+			continue
+		}
+
+		if multiple {
+			p.AnyOf = append(p.AnyOf, c)
+		} else {
+			p.OneOf = append(p.OneOf, c)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return util.WrapError(err)
+	}
+
+	for _, op := range ops {
+		if p, ok := polls[op.Id]; ok {
+			op.Poll = *p
+		}
+	}
+
+	return nil
+}
+
+// loadMedia fills in the attachments and previews of posts, which only have
+// their IDs when read by scanPost.
+// Those that cannot be found are dropped.
+func loadMedia(posts []*ObjectBase) error {
+	var ids []string
+	for _, p := range posts {
+		for _, a := range p.Attachment {
+			ids = append(ids, a.Id)
+		}
+
+		if p.Preview != nil {
+			ids = append(ids, p.Preview.Id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query := `select x.id, x.type, x.name, x.href, x.mediatype, x.size, x.published, x.width, x.height, x.hash, x.spoiler from (select id, type, name, href, mediatype, size, published, width, height, hash, spoiler from posts where id = any($1)) as x`
+
+	rows, err := config.DB.Query(query, ids)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	defer rows.Close()
+
+	media := make(map[string]ObjectBase)
+	for rows.Next() {
+		var m ObjectBase
+		if err := rows.Scan(&m.Id, &m.Type, &m.Name, &m.Href, &m.MediaType, &m.Size, &m.Published, &m.Width, &m.Height, &m.Hash, &m.Spoiler); err != nil {
+			return util.WrapError(err)
+		}
+
+		media[m.Id] = m
+	}
+
+	if err := rows.Err(); err != nil {
+		return util.WrapError(err)
+	}
+
+	for _, p := range posts {
+		var attch []ObjectBase
+		for _, a := range p.Attachment {
+			if m, ok := media[a.Id]; ok {
+				attch = append(attch, m)
+			}
+		}
+
+		p.Attachment = attch
+
+		if p.Preview != nil {
+			if m, ok := media[p.Preview.Id]; ok {
+				p.Preview = &m
+			} else {
+				p.Preview = nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// LookupThreadsOneAtATime does the lookups of the flags of the threads ops
+// start the way they were done before they were loaded in batches, one query
+// for each, so that what batching saves can be measured.
+func LookupThreadsOneAtATime(ops []ObjectBase) {
+	for _, op := range ops {
+		op.IsLocked()
+		op.IsAutosage()
+		op.GetCyclical()
+		op.GetPoll()
+		op.LimitsReached()
+		op.IsBanMarked()
+	}
+}
+
+// LookupPostsOneAtATime is LookupThreadsOneAtATime for the threads ops start
+// along with their replies and media, as board pages and threads show them.
+func LookupPostsOneAtATime(ops []ObjectBase) {
+	lookupPosts(ops, 0)
+}
+
+// lookupPosts does the lookups for posts at depth: threads are at 0, their
+// replies at 1, and replies to those at 2.
+func lookupPosts(posts []ObjectBase, depth int) {
+	for _, p := range posts {
+		switch depth {
+		case 0:
+			LookupThreadsOneAtATime([]ObjectBase{p})
+		case 1:
+			p.IsSticky()
+			p.IsBanMarked()
+		default:
+			p.IsBanMarked()
+		}
+
+		for _, a := range p.Attachment {
+			a.GetAttachment()
+		}
+
+		if p.Preview != nil {
+			p.Preview.GetPreview()
+		}
+
+		if depth < 2 {
+			// One query read the replies to each post
+			p.GetRepliesCount()
+
+			if p.Replies != nil {
+				lookupPosts(p.Replies.OrderedItems, depth+1)
+			}
+		}
+	}
+}
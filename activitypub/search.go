@@ -0,0 +1,194 @@
+package activitypub
+
+import (
+	"html"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/markup"
+	"github.com/KushBlazingJudah/fedichan/util"
+)
+
+// SearchQuery is what to search posts for.
+type SearchQuery struct {
+	// Terms are what to look for, in the syntax search engines use: words,
+	// "quoted phrases", or and -excluded words.
+	Terms string
+
+	// Board is the ID of the board to search, or empty to search every board.
+	Board string
+
+	// Since and Until limit results to posts published in that range, if
+	// they are set.
+	Since, Until time.Time
+
+	// HasFile limits results to posts with a file.
+	HasFile bool
+
+	// TripCode limits results to posts with that tripcode.
+	TripCode string
+
+	Limit, Offset int
+}
+
+// SearchResult is a post found by a search.
+type SearchResult struct {
+	Post ObjectBase `json:"post"`
+
+	// Board is the ID of the board the post is shown on.
+	Board string `json:"board"`
+
+	// OP is the ID of the thread the post is in.
+	OP string `json:"op"`
+
+	// Snippet is the part of the post that matched, as HTML with the matched
+	// words in <mark>.
+	Snippet string `json:"snippet"`
+}
+
+// Markers ts_headline puts around matches.
+// Neither belongs in a post, so any found on their own are dropped.
+const (
+	searchStart = "\x02"
+	searchStop  = "\x03"
+)
+
+// Search looks through local posts and posts cached from followed boards,
+// including archived threads.
+// It also returns how many posts matched in total.
+func Search(q SearchQuery) ([]SearchResult, int, error) {
+	var results []SearchResult
+	var total int
+
+	var since, until *time.Time
+	if !q.Since.IsZero() {
+		since = &q.Since
+	}
+
+	if !q.Until.IsZero() {
+		until = &q.Until
+	}
+
+	// Cached posts are shown on whichever local board follows theirs
+	query := `select count(*) over(), x.board, coalesce((select id from replies where inreplyto='' and id in (select inreplyto from replies where id=x.id) limit 1), x.id),
+	x.id, x.name, x.content, x.type, x.published, x.updated, x.attributedto, x.attachment, x.preview, x.actor, x.tripcode, x.capcode, x.posterid, x.sensitive from
+	(select id, name, content, type, published, updated, attributedto, attachment, preview, actor, tripcode, capcode, posterid, sensitive, search, case when local then actor else (select id from following where following = posts.actor and id != $9 order by id limit 1) end as board from posts) as x
+	where x.search @@ websearch_to_tsquery('simple', $1) and (x.type='Note' or x.type='Archive') and x.board is not null and ($2 = '' or x.board = $2)
+	and ($3::timestamp is null or x.published >= $3) and ($4::timestamp is null or x.published < $4) and (not $5 or x.attachment != '') and ($6 = '' or x.tripcode = $6)
+	order by ts_rank(x.search, websearch_to_tsquery('simple', $1)) desc, x.published desc limit $7 offset $8`
+
+	rows, err := config.DB.Query(query, q.Terms, q.Board, since, until, q.HasFile, q.TripCode, q.Limit, q.Offset, config.Domain)
+	if err != nil {
+		return nil, 0, util.WrapError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var r SearchResult
+
+		if r.Post, err = scanPost(rows, &total, &r.Board, &r.OP); err != nil {
+			return nil, 0, util.WrapError(err)
+		}
+
+		if r.OP != r.Post.Id {
+			r.Post.InReplyTo = []ObjectBase{{Id: r.OP}}
+		}
+
+		results = append(results, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, util.WrapError(err)
+	}
+
+	rows.Close()
+
+	if err := searchSnippets(results, q.Terms); err != nil {
+		return nil, 0, util.WrapError(err)
+	}
+
+	posts := make([]*ObjectBase, len(results))
+	for i := range results {
+		posts[i] = &results[i].Post
+	}
+
+	if err := loadPostFlags(posts); err != nil {
+		return nil, 0, util.WrapError(err)
+	}
+
+	if err := loadMedia(posts); err != nil {
+		return nil, 0, util.WrapError(err)
+	}
+
+	return results, total, nil
+}
+
+// searchSnippets sets the snippets of results, the posts found searching for
+// terms.
+// They are made from the posts as they read, without markup or spoilers.
+func searchSnippets(results []SearchResult, terms string) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	docs := make([]string, len(results))
+	for i, r := range results {
+		docs[i] = r.Post.Name + " " + markup.PlainText(r.Post.Content)
+	}
+
+	opts := "StartSel=" + searchStart + ", StopSel=" + searchStop + ", MaxFragments=2, MaxWords=30, MinWords=10"
+
+	query := `select ts_headline('simple', x.doc, websearch_to_tsquery('simple', $2), $3) from unnest($1::text[]) with ordinality as x(doc, n) order by x.n`
+
+	rows, err := config.DB.Query(query, docs, terms, opts)
+	if err != nil {
+		return util.WrapError(err)
+	}
+
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		var snippet string
+		if err := rows.Scan(&snippet); err != nil {
+			return util.WrapError(err)
+		}
+
+		results[i].Snippet = highlight(snippet)
+	}
+
+	return util.WrapError(rows.Err())
+}
+
+// highlight turns a headline made by ts_headline into HTML.
+func highlight(s string) string {
+	var b strings.Builder
+	open := false
+
+	for s != "" {
+		i := strings.IndexAny(s, searchStart+searchStop)
+		if i < 0 {
+			b.WriteString(html.EscapeString(s))
+			break
+		}
+
+		b.WriteString(html.EscapeString(s[:i]))
+
+		if s[i:i+1] == searchStart && !open {
+			b.WriteString("<mark>")
+			open = true
+		} else if s[i:i+1] == searchStop && open {
+			b.WriteString("</mark>")
+			open = false
+		}
+
+		s = s[i+1:]
+	}
+
+	if open {
+		b.WriteString("</mark>")
+	}
+
+	return b.String()
+}
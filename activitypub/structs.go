@@ -111,6 +111,8 @@ type ObjectBase struct {
 	Option       []string        `json:"-"`
 	AttributedTo string          `json:"attributedTo,omitempty"`
 	TripCode     string          `json:"tripcode,omitempty"`
+	Capcode      string          `json:"capcode,omitempty"`
+	PosterID     string          `json:"posterId,omitempty"`
 	Actor        string          `json:"actor,omitempty"`
 	Content      string          `json:"content,omitempty"`
 	InReplyTo    []ObjectBase    `json:"inReplyTo,omitempty"`
@@ -128,9 +130,35 @@ type ObjectBase struct {
 	Bcc          string          `json:"Bcc,omitempty"`
 	MediaType    string          `json:"mediatype,omitempty"`
 	Size         int64           `json:"size,omitempty"`
+	Width        int             `json:"width,omitempty"`
+	Height       int             `json:"height,omitempty"`
+	Hash         string          `json:"hash,omitempty"`
 	Sensitive    bool            `json:"sensitive,omitempty"`
+	Spoiler      bool            `json:"spoiler,omitempty"`
 	Sticky       bool            `json:"sticky,omitempty"`
 	Locked       bool            `json:"locked,omitempty"`
+	BanMarked    bool            `json:"-"`
+
+	// Cyclical is how many replies a cyclical thread keeps.
+	// Updates always carry it, so one without it leaves the thread as it is.
+	Cyclical *int `json:"cyclical,omitempty"`
+
+	// Autosage, BumpLimit and ImageLimit are set on threads that no longer
+	// bump or take files.
+	Autosage   bool `json:"-"`
+	BumpLimit  bool `json:"-"`
+	ImageLimit bool `json:"-"`
+
+	// PHash is the perceptual hash of image attachments, which media bans
+	// find similar images by.
+	PHash *int64 `json:"-"`
+
+	// Poll is set on threads started with a poll.
+	Poll
+
+	// DeletePassword is the hashed password the poster may delete the post
+	// with. It never leaves this instance.
+	DeletePassword string `json:"-"`
 
 	// Alias        string          `json:"alias,omitempty"`
 	// Audience     string          `json:"audience,omitempty"`
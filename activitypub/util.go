@@ -2,15 +2,15 @@ package activitypub
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"mime/multipart"
 	"os"
-	"path"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/media"
 	"github.com/KushBlazingJudah/fedichan/util"
 	"github.com/gofiber/fiber/v2"
 )
@@ -30,36 +30,98 @@ func AcceptActivity(header string) bool {
 	return accept
 }
 
-func CreateAttachmentObject(file multipart.File, header *multipart.FileHeader) ([]ObjectBase, *os.File, error) {
-	contentType, err := util.GetFileContentType(file)
-	if err != nil {
+var (
+	// ErrMediaBanned is returned by CreateAttachmentObject for files caught
+	// by a media ban.
+	ErrMediaBanned = errors.New("media is banned")
+
+	// ErrCannotStrip is returned by CreateAttachmentObject for images that
+	// Go can't strip of their metadata when exiv2 isn't installed to do it
+	// instead.
+	// They are turned away rather than stored with whatever they carry.
+	ErrCannotStrip = errors.New("image metadata cannot be removed")
+)
+
+// CreateAttachmentObject saves an uploaded file to the media store and
+// returns an attachment describing it, along with its preview.
+// Images have their metadata stripped before they are stored.
+//
+// Files that are banned or that aren't fit to be stored are refused with
+// ErrMediaBanned, ErrCannotStrip or one of the errors of the media package,
+// which are returned as they are so the poster can be told.
+func CreateAttachmentObject(data []byte, name, contentType string) ([]ObjectBase, *ObjectBase, error) {
+	var image ObjectBase
+
+	image.Type = "Attachment"
+	image.Name = name
+	image.MediaType = contentType
+	image.Published = time.Now().UTC()
+
+	match := util.MediaMatch{Hashes: []string{media.Hash(data)}}
+
+	if media.Supported(contentType) {
+		clean, info, err := media.Sanitize(data, contentType, util.MediaLimits())
+		if errors.Is(err, media.ErrUnsupported) {
+			if !media.HasTool("exiv2") {
+				return nil, nil, ErrCannotStrip
+			}
+
+			clean, err = externalStrip(data, contentType)
+		}
+
+		if errors.Is(err, media.ErrDimensions) || errors.Is(err, media.ErrMismatch) || errors.Is(err, media.ErrCorrupt) {
+			return nil, nil, err
+		} else if err != nil {
+			return nil, nil, util.WrapError(err)
+		}
+
+		match.PHash = util.MediaPHash(data, contentType)
+		data = clean
+		image.Width, image.Height = info.Width, info.Height
+	}
+
+	image.Hash = media.Hash(data)
+	match.Hashes = append(match.Hashes, image.Hash)
+
+	if banned, err := match.Banned(); err != nil {
+		return nil, nil, util.WrapError(err)
+	} else if banned {
+		return nil, nil, ErrMediaBanned
+	}
+
+	var err error
+	if image.Href, err = StoreMedia(data, contentType); err != nil {
 		return nil, nil, util.WrapError(err)
 	}
 
-	filename := header.Filename
-	size := header.Size
+	image.Size = int64(len(data))
+	image.PHash = match.PHash
 
-	fileType := path.Ext(header.Filename)
-	name := fmt.Sprint(time.Now().UTC().Unix())
+	return []ObjectBase{image}, image.CreatePreview(data), nil
+}
 
-	tempFile, err := os.Create(fmt.Sprintf("./public/%s%s", name, fileType))
+// externalStrip runs data through exiv2 by way of a temporary file.
+func externalStrip(data []byte, mediaType string) ([]byte, error) {
+	f, err := os.CreateTemp("", "fedichan-*"+media.Extension(mediaType))
 	if err != nil {
-		return nil, nil, util.WrapError(err)
+		return nil, err
 	}
+	defer os.Remove(f.Name())
 
-	var nAttachment []ObjectBase
-	var image ObjectBase
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 
-	image.Type = "Attachment"
-	image.Name = filename
-	image.Href = fmt.Sprintf("%s/public/%s%s", config.Domain, name, fileType)
-	image.MediaType = contentType
-	image.Size = size
-	image.Published = time.Now().UTC()
+	if err != nil {
+		return nil, err
+	}
 
-	nAttachment = append(nAttachment, image)
+	if err := media.ExternalStrip(f.Name()); err != nil {
+		return nil, err
+	}
 
-	return nAttachment, tempFile, nil
+	return os.ReadFile(f.Name())
 }
 
 func CreateNewActor(board string, prefName string, summary string, restricted bool) *Actor {
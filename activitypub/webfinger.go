@@ -41,6 +41,9 @@ type Board struct {
 	TP          string
 	Restricted  bool
 	Post        ObjectBase
+
+	// SpoilerImage is what spoilered files on the board are hidden behind.
+	SpoilerImage string
 }
 
 type BoardSortAsc []Board
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+)
+
+// bench reads the catalog, first page and threads of boards and reports how
+// many queries each took, against how many reading their posts one at a time
+// would have taken.
+// Every local board is read if none are given.
+//
+//	fchan bench [-n 10] [board...]
+func bench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	n := fs.Int("n", 10, "how many times to read each page")
+	fs.Parse(args)
+
+	if err := db.Connect(); err != nil {
+		log.Fatal(err)
+	}
+
+	var queries atomic.Int64
+	if err := db.CountQueries(&queries); err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	boards := fs.Args()
+	if len(boards) == 0 {
+		instance, err := activitypub.GetActorFromDB(config.Domain)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		following, err := instance.GetFollowing()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, f := range following {
+			if name := strings.TrimPrefix(f.Id, config.Domain+"/"); name != f.Id && !strings.Contains(name, "/") {
+				boards = append(boards, name)
+			}
+		}
+	}
+
+	// measure reads a page n times, then replays what reading its posts one
+	// at a time took.
+	measure := func(board, page string, read func() (activitypub.Collection, error), perPost func([]activitypub.ObjectBase)) {
+		var coll activitypub.Collection
+		var err error
+
+		before := queries.Load()
+		start := time.Now()
+		for i := 0; i < *n; i++ {
+			if coll, err = read(); err != nil {
+				log.Fatalf("%s %s: %v", board, page, err)
+			}
+		}
+
+		took := time.Since(start) / time.Duration(*n)
+		batched := (queries.Load() - before) / int64(*n)
+
+		before = queries.Load()
+		perPost(coll.OrderedItems)
+
+		// Plus the query that read the posts themselves
+		old := queries.Load() - before + 1
+
+		fmt.Printf("/%s/ %-24s %5d posts %5d queries (%d one at a time) %v\n", board, page, countPosts(coll.OrderedItems), batched, old, took)
+	}
+
+	for _, name := range boards {
+		actor, err := activitypub.GetActorFromDB(config.Domain + "/" + name)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+
+		measure(name, "catalog", func() (activitypub.Collection, error) {
+			return actor.GetCatalogCollection(activitypub.CatalogQuery{})
+		}, activitypub.LookupThreadsOneAtATime)
+
+		measure(name, "page 0", func() (activitypub.Collection, error) {
+			return actor.GetCollectionPage(0)
+		}, activitypub.LookupPostsOneAtATime)
+
+		page, err := actor.GetCollectionPage(0)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+
+		for _, op := range page.OrderedItems {
+			measure(name, "thread "+shortID(op.Id), func() (activitypub.Collection, error) {
+				return activitypub.ObjectBase{Id: op.Id}.GetCollectionFromPath()
+			}, activitypub.LookupPostsOneAtATime)
+		}
+	}
+}
+
+func countPosts(posts []activitypub.ObjectBase) int {
+	n := len(posts)
+	for _, p := range posts {
+		if p.Replies != nil {
+			n += countPosts(p.Replies.OrderedItems)
+		}
+	}
+
+	return n
+}
+
+func shortID(id string) string {
+	return id[strings.LastIndex(id, "/")+1:]
+}
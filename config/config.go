@@ -32,6 +32,29 @@ var ActivityStreams = "application/ld+json; profile=\"https://www.w3.org/ns/acti
 var PostCountPerPage = 10
 var SupportedFiles = []string{"image/gif", "image/jpeg", "image/png", "image/webp", "image/apng", "video/mp4", "video/ogg", "video/webm", "audio/mpeg", "audio/ogg", "audio/wav", "audio/wave", "audio/x-wav"}
 var MediaHashs = make(map[string]string)
+var MaxImageWidth, _ = strconv.Atoi(GetConfigValue("maximagewidth", "10000"))
+var MaxImageHeight, _ = strconv.Atoi(GetConfigValue("maximageheight", "10000"))
+var MaxImagePixels, _ = strconv.Atoi(GetConfigValue("maximagepixels", "25000000"))
+var MediaBanDistance, _ = strconv.Atoi(GetConfigValue("mediabandistance", "8"))
+var GCInterval, _ = strconv.Atoi(GetConfigValue("gcinterval", "24"))
+var DeleteTimeLimit, _ = strconv.Atoi(GetConfigValue("deletelimit", "24"))
+var IdentityRotation, _ = strconv.Atoi(GetConfigValue("identityrotation", "24"))
+var IdentityRetention, _ = strconv.Atoi(GetConfigValue("identityretention", "168"))
+var ProxyHeader = GetConfigValue("proxyheader", "")
+var OnionListen = GetConfigValue("onionlisten", "")
+var InboxRate, _ = strconv.Atoi(GetConfigValue("inboxrate", "120"))
+var InboxBurst, _ = strconv.Atoi(GetConfigValue("inboxburst", "60"))
+var PollChoices, _ = strconv.Atoi(GetConfigValue("pollchoices", "10"))
+var PageCache, _ = strconv.Atoi(GetConfigValue("pagecache", "1000"))
+var PageCacheAge, _ = strconv.Atoi(GetConfigValue("pagecacheage", "300"))
+var LiveConns, _ = strconv.Atoi(GetConfigValue("liveconns", "4"))
+var MediaStore = GetConfigValue("mediastore", "local")
+var S3Endpoint = GetConfigValue("s3endpoint", "")
+var S3Region = GetConfigValue("s3region", "us-east-1")
+var S3Bucket = GetConfigValue("s3bucket", "")
+var S3AccessKey = GetConfigValue("s3accesskey", "")
+var S3SecretKey = GetConfigValue("s3secretkey", "")
+var S3PublicURL = GetConfigValue("s3publicurl", "")
 var Key = GetConfigValue("modkey", "")
 var Debug = GetConfigValue("debug", "")
 var Themes []string
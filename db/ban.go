@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+var (
+	ErrBadAddress = errors.New("invalid IP address or range")
+)
+
+// Ban keeps a poster from posting or reporting.
+type Ban struct {
+	Id int
+
+	// Identity is the poster identity that is banned, if any.
+	Identity string
+
+	// IP is the address or CIDR range that is banned, if any.
+	IP string
+
+	// Board is the name of the board the ban applies to, or empty if it
+	// applies everywhere.
+	Board string
+
+	// Reason is shown to the banned poster.
+	Reason string
+
+	// Post is the post the ban was made for, if any.
+	Post string
+
+	// Marked is set if Post says its poster was banned for it.
+	Marked bool
+
+	Created time.Time
+
+	// Expires is when the ban is lifted, or nil if it never is.
+	Expires *time.Time
+
+	Appeal   string
+	Appealed *time.Time
+	Denied   bool
+}
+
+// Active reports whether the ban has yet to expire.
+func (b Ban) Active() bool {
+	return b.Expires == nil || b.Expires.After(time.Now().UTC())
+}
+
+// ParseAddress normalizes an IP address or CIDR range for a ban.
+func ParseAddress(s string) (string, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return "", ErrBadAddress
+		}
+
+		return n.String(), nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", ErrBadAddress
+	}
+
+	return ip.String(), nil
+}
+
+const banColumns = `id, identity, coalesce(abbrev(ip), ''), board, reason, post, marked, created, expires, appeal, appealed, denied`
+
+func scanBans(rows *sql.Rows) ([]Ban, error) {
+	var bans []Ban
+
+	defer rows.Close()
+	for rows.Next() {
+		var b Ban
+		if err := rows.Scan(&b.Id, &b.Identity, &b.IP, &b.Board, &b.Reason, &b.Post, &b.Marked, &b.Created, &b.Expires, &b.Appeal, &b.Appealed, &b.Denied); err != nil {
+			return bans, wrapErr(err)
+		}
+
+		bans = append(bans, b)
+	}
+
+	return bans, wrapErr(rows.Err())
+}
+
+// CreateBan writes a new ban. b.Id and b.Created are ignored.
+// Bans on identities keep the salt that made them from being purged for as
+// long as they last.
+func CreateBan(b Ban) error {
+	if b.Identity == "" && b.IP == "" {
+		return errors.New("ban has neither an identity nor an address")
+	}
+
+	ip := sql.NullString{String: b.IP, Valid: b.IP != ""}
+
+	query := `insert into bans (identity, ip, board, reason, post, marked, created, expires, salt) values ($1, $2::inet, $3, $4, $5, $6, $7, $8, (select salt from posteridentity where identity = $1 and $1 != '' and salt is not null limit 1))`
+	_, err := config.DB.Exec(query, b.Identity, ip, b.Board, b.Reason, b.Post, b.Marked, time.Now().UTC(), b.Expires)
+
+	return wrapErr(err)
+}
+
+func DeleteBan(id int) error {
+	_, err := config.DB.Exec(`delete from bans where id = $1`, id)
+	return wrapErr(err)
+}
+
+// GetBans returns every ban, newest first.
+func GetBans() ([]Ban, error) {
+	rows, err := config.DB.Query(`select ` + banColumns + ` from bans order by created desc`)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+
+	return scanBans(rows)
+}
+
+// GetAppeals returns the bans with appeals waiting to be reviewed, oldest
+// appeal first.
+func GetAppeals() ([]Ban, error) {
+	rows, err := config.DB.Query(`select ` + banColumns + ` from bans where appealed is not null and not denied order by appealed asc`)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+
+	return scanBans(rows)
+}
+
+// GetActiveBans returns the bans that keep a poster known by any of
+// identities or ip from posting on board, newest first.
+func GetActiveBans(identities []string, ip net.IP, board string) ([]Ban, error) {
+	var addr sql.NullString
+	if ip != nil {
+		addr = sql.NullString{String: ip.String(), Valid: true}
+	}
+
+	query := `select ` + banColumns + ` from bans where (identity = any($1) or ip >>= $2::inet) and (board = '' or board = $3) and (expires is null or expires > $4) order by created desc`
+	rows, err := config.DB.Query(query, identities, addr, board, time.Now().UTC())
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+
+	return scanBans(rows)
+}
+
+// AppealBan records an appeal of ban id.
+// Bans can only be appealed once.
+func AppealBan(id int, appeal string) (bool, error) {
+	query := `update bans set appeal = $1, appealed = $2 where id = $3 and appealed is null`
+	res, err := config.DB.Exec(query, appeal, time.Now().UTC(), id)
+	if err != nil {
+		return false, wrapErr(err)
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, wrapErr(err)
+}
+
+// DenyAppeal rejects the appeal of ban id, leaving the ban in place.
+func DenyAppeal(id int) error {
+	_, err := config.DB.Exec(`update bans set denied = true where id = $1`, id)
+	return wrapErr(err)
+}
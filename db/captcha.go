@@ -6,11 +6,11 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
-	"os/exec"
 	"strings"
 	"sync"
 
 	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/media"
 )
 
 const keyDomain = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -27,12 +27,6 @@ var sbPool = &sync.Pool{
 	},
 }
 
-var captchaPtns = []string{
-	"pattern:verticalbricks",
-	"pattern:verticalsaw",
-	"pattern:hs_cross",
-}
-
 func randomGen(domain string, defaultSize int) func(fsize ...int) string {
 	return func(fsize ...int) string {
 		size := defaultSize
@@ -52,34 +46,22 @@ func randomGen(domain string, defaultSize int) func(fsize ...int) string {
 	}
 }
 
-func runConvert(args ...string) error {
-	cmd := exec.Command("convert", args...)
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
 func createNewCaptcha() error {
 	id := randomKey()
 	solution := mkCaptcha()
 	file := fmt.Sprintf("public/%s.jpg", id)
-	pattern := captchaPtns[rand.Intn(len(captchaPtns))]
-
-	if err := runConvert("-size", "200x98", pattern, "-transparent", "white", file); err != nil {
-		os.Remove(file)
-		return wrapErr(err)
-	}
 
-	if err := runConvert(file, "-fill", "blue", "-pointsize", "62", "-annotate", "+0+70", solution, "-tile", "pattern:left30", "-gravity", "center", "-transparent", "white", file); err != nil {
-		os.Remove(file)
+	img, err := media.Captcha(solution)
+	if err != nil {
 		return wrapErr(err)
 	}
 
-	if err := runConvert(file, "-rotate", fmt.Sprint(rand.Intn(12)), "-wave", "5x35", "-distort", "Arc", "20", "-wave", "2x35", "-transparent", "white", file); err != nil {
+	if err := os.WriteFile(file, img, 0644); err != nil {
 		os.Remove(file)
 		return wrapErr(err)
 	}
 
-	_, err := config.DB.Exec(`insert into captchas(file, id, solution) values($1, $2, $3)`, file, id, solution)
+	_, err = config.DB.Exec(`insert into captchas(file, id, solution) values($1, $2, $3)`, file, id, solution)
 	if err != nil {
 		// The database didn't save our captcha, so delete the file
 		os.Remove(file)
@@ -101,7 +83,7 @@ func deleteCaptcha(id string) error {
 		return err
 	}
 
-	if _, err := config.DB.Exec(`delete from captcha where id=$1`, id); err != nil {
+	if _, err := config.DB.Exec(`delete from captchas where id=$1`, id); err != nil {
 		return wrapErr(err)
 	}
 
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync/atomic"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+// CountQueries reconnects to the database so that every query made from then
+// on adds to n, for measuring how many queries something takes.
+// It must be called after Connect.
+func CountQueries(n *atomic.Int64) error {
+	pool := config.DB
+	config.DB = sql.OpenDB(countingConnector{d: pool.Driver(), dsn: DataSource(), n: n})
+
+	return wrapErr(pool.Close())
+}
+
+// countingConnector connects to the database like d does, counting the
+// queries made over its connections in n.
+type countingConnector struct {
+	d   driver.Driver
+	dsn string
+	n   *atomic.Int64
+}
+
+func (c countingConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.d.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return countingConn{conn, c.n}, nil
+}
+
+func (c countingConnector) Driver() driver.Driver {
+	return c.d
+}
+
+type countingConn struct {
+	driver.Conn
+	n *atomic.Int64
+}
+
+func (c countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.n.Add(1)
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.n.Add(1)
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c countingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c countingConn) CheckNamedValue(v *driver.NamedValue) error {
+	return c.Conn.(driver.NamedValueChecker).CheckNamedValue(v)
+}
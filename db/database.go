@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"strings"
 
 	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/config"
@@ -15,17 +16,20 @@ import (
 const pwDomain = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 const pwLength = 24
 
-func Connect() error {
+// DataSource returns what to connect to the database with.
+func DataSource() string {
 	host := config.DBHost
 	port := config.DBPort
 	user := config.DBUser
 	password := config.DBPassword
 	dbname := config.DBName
 
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s "+
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s "+
 		"dbname=%s sslmode=disable", host, port, user, password, dbname)
+}
 
-	_db, err := sql.Open("pgx", psqlInfo)
+func Connect() error {
+	_db, err := sql.Open("pgx", DataSource())
 	if err != nil {
 		return wrapErr(err)
 	}
@@ -40,6 +44,10 @@ func Connect() error {
 		return err
 	}
 
+	if err := checkIndexes(); err != nil {
+		return err
+	}
+
 	log.Println("Successfully connected DB")
 
 	return nil
@@ -139,15 +147,6 @@ func GetReplyOP(link string) (string, error) {
 	return id, nil
 }
 
-func IsHashBanned(hash string) (bool, error) {
-	var h string
-
-	query := `select hash from bannedmedia where hash=$1`
-	_ = config.DB.QueryRow(query, hash).Scan(&h)
-
-	return h == hash, nil
-}
-
 func PrintAdminAuth() error {
 	log.Printf("Mod key: %v", config.Key)
 
@@ -181,15 +180,27 @@ func InitInstance() error {
 	return nil
 }
 
+// likeEscaper escapes the characters that mean something in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// GetPostIDFromNum returns the ID of the post whose last path segment is num,
+// preferring local posts.
 func GetPostIDFromNum(num string) (string, error) {
 	var postID string
 
-	query := `select id from activitystream where id like $1`
-	if err := config.DB.QueryRow(query, "%"+num).Scan(&postID); err != nil {
-		query = `select id from cacheactivitystream where id like $1`
-		if err := config.DB.QueryRow(query, "%"+num).Scan(&postID); err != nil {
-			return "", wrapErr(err)
-		}
+	if num == "" {
+		return "", wrapErr(sql.ErrNoRows)
+	}
+
+	// The suffix indexes are on reversed IDs, which makes the number a prefix
+	rev := []rune(num)
+	for i, j := 0, len(rev)-1; i < j; i, j = i+1, j-1 {
+		rev[i], rev[j] = rev[j], rev[i]
+	}
+
+	query := `select id from posts where reverse(id) like $1 escape '\' order by local desc limit 1`
+	if err := config.DB.QueryRow(query, likeEscaper.Replace(string(rev))+"/%").Scan(&postID); err != nil {
+		return "", wrapErr(err)
 	}
 
 	return postID, nil
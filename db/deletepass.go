@@ -0,0 +1,71 @@
+package db
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+var (
+	// ErrDeleteExpired is returned by CheckDeletePassword when a post is too
+	// old to be deleted by its poster.
+	ErrDeleteExpired = errors.New("post is too old to be deleted")
+)
+
+// NewDeletePassword generates a deletion password for posters that didn't
+// pick one.
+func NewDeletePassword() string {
+	return hex.EncodeToString(makeSalt())
+}
+
+// HashDeletePassword hashes a deletion password for storage alongside a post.
+// The result contains the salt and hash, separated by a colon.
+func HashDeletePassword(pass string) string {
+	salt := makeSalt()
+	ciphertext := sha256.Sum256(makePwText(pass, salt))
+
+	return hex.EncodeToString(salt) + ":" + hex.EncodeToString(ciphertext[:])
+}
+
+// CheckDeletePassword determines if pass may be used to delete the local post
+// id.
+// Posts made without a password can't be deleted this way.
+func CheckDeletePassword(id, pass string) (bool, error) {
+	var stored string
+	var published time.Time
+
+	query := `select deletepass, published from posts where id=$1 and local and type != 'Tombstone'`
+	if err := config.DB.QueryRow(query, id).Scan(&stored, &published); errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, wrapErr(err)
+	}
+
+	encSalt, encHash, ok := strings.Cut(stored, ":")
+	if !ok || pass == "" {
+		return false, nil
+	}
+
+	if config.DeleteTimeLimit > 0 && time.Since(published) > time.Duration(config.DeleteTimeLimit)*time.Hour {
+		return false, ErrDeleteExpired
+	}
+
+	salt, err := hex.DecodeString(encSalt)
+	if err != nil {
+		return false, nil
+	}
+
+	hash, err := hex.DecodeString(encHash)
+	if err != nil {
+		return false, nil
+	}
+
+	ciphertext := sha256.Sum256(makePwText(pass, salt))
+	return subtle.ConstantTimeCompare(ciphertext[:], hash) == 1, nil
+}
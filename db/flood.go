@@ -0,0 +1,55 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+// LastPost returns when the poster known by any of identities last started a
+// thread on board, or replied to one if thread is false.
+// The zero time is returned if they haven't.
+func LastPost(identities []string, board string, thread bool) (time.Time, error) {
+	var last sql.NullTime
+
+	query := `select max(p.created) from posteridentity p join posts a on a.id = p.id
+		where p.identity = any($1) and a.actor = $2 and exists (select 1 from replies r where r.id = p.id and (r.inreplyto = '') = $3)`
+	if err := config.DB.QueryRow(query, identities, board, thread).Scan(&last); err != nil {
+		return time.Time{}, wrapErr(err)
+	}
+
+	return last.Time, nil
+}
+
+// IsDuplicate reports whether the poster known by any of identities has posted
+// comment on board within window.
+func IsDuplicate(identities []string, board, comment string, window time.Duration) (bool, error) {
+	var dup bool
+
+	query := `select exists (select 1 from posteridentity p join posts a on a.id = p.id
+		where p.identity = any($1) and a.actor = $2 and a.content = $3 and p.created > $4)`
+	err := config.DB.QueryRow(query, identities, board, comment, time.Now().UTC().Add(-window)).Scan(&dup)
+
+	return dup, wrapErr(err)
+}
+
+// CountReports returns how many reports the poster known by any of identities
+// has made on board within window.
+func CountReports(identities []string, board string, window time.Duration) (int, error) {
+	var n int
+
+	query := `select count(*) from reporters where identity = any($1) and board = $2 and created > $3`
+	err := config.DB.QueryRow(query, identities, board, time.Now().UTC().Add(-window)).Scan(&n)
+
+	return n, wrapErr(err)
+}
+
+// WriteReporter records that the poster known as identity made a report on
+// board.
+func WriteReporter(identity, board string) error {
+	query := `insert into reporters (identity, board, created) values ($1, $2, $3)`
+	_, err := config.DB.Exec(query, identity, board, time.Now().UTC())
+
+	return wrapErr(err)
+}
@@ -0,0 +1,325 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/storage"
+)
+
+// gcGrace is how old something must be before the garbage collector will
+// touch it.
+// Media is stored before the post carrying it is written, so anything newer
+// may be part of a post that is still being made.
+const gcGrace = time.Hour
+
+// GCReport describes what the garbage collector found.
+type GCReport struct {
+	// Orphans are the URLs of files that nothing refers to.
+	Orphans []string
+
+	// Missing are the URLs of files that are referred to but don't exist.
+	Missing []string
+
+	// Rows is the number of attachment, preview and captcha rows that were
+	// orphaned or pointed to a missing file.
+	Rows int
+
+	// Refs is the number of media reference counts that were wrong.
+	Refs int
+}
+
+func (r GCReport) String() string {
+	return fmt.Sprintf("%d orphaned files, %d missing files, %d orphaned rows, %d bad reference counts", len(r.Orphans), len(r.Missing), r.Rows, r.Refs)
+}
+
+// gcStore is a place files are kept, along with what refers to what is in it.
+type gcStore struct {
+	storage.MediaStore
+
+	refs     map[string]int
+	captchas map[string]string
+}
+
+// orphanedRows returns the attachment and preview rows that no post refers
+// to.
+func orphanedRows() (map[string]bool, error) {
+	orphans := make(map[string]bool)
+
+	query := `select id from posts where href != '' and type != 'Tombstone' and published < $1
+		and id not in (select attachment from posts where attachment is not null)
+		and id not in (select preview from posts where preview is not null)`
+
+	rows, err := config.DB.Query(query, time.Now().UTC().Add(-gcGrace))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		orphans[id] = true
+	}
+
+	return orphans, rows.Err()
+}
+
+// countRefs counts the references posts and boards make to each store,
+// ignoring the rows in skip.
+// Boards refer to their spoiler images, which are stored like any other media.
+func countRefs(stores []*gcStore, skip map[string]bool) error {
+	rows, err := config.DB.Query(`select id, href from posts where href != '' and type != 'Tombstone' union all select id, spoilerimage from actor where spoilerimage != ''`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, href string
+		if err := rows.Scan(&id, &href); err != nil {
+			return err
+		}
+
+		if skip[id] {
+			continue
+		}
+
+		for _, s := range stores {
+			if key, ok := s.Key(href); ok {
+				s.refs[key]++
+				break
+			}
+		}
+	}
+
+	return rows.Err()
+}
+
+// CollectGarbage cross-references stored files with the database, removing
+// files nothing refers to and rows that refer to nothing.
+// Rows whose files have gone missing are reported, but only captchas are
+// removed; a post without its image is still a post.
+//
+// If dryRun is set, nothing is changed and the report describes what would
+// have been.
+func CollectGarbage(dryRun bool) (GCReport, error) {
+	var report GCReport
+
+	// Captchas and files uploaded before the media store existed live in
+	// ./public, which may or may not be where media is kept now.
+	public := &gcStore{
+		MediaStore: &storage.Local{Dir: "./public", BaseURL: config.Domain + "/public"},
+		refs:       make(map[string]int),
+		captchas:   make(map[string]string),
+	}
+
+	store := public
+	if l, ok := storage.Default.(*storage.Local); !ok || filepath.Clean(l.Dir) != filepath.Clean("./public") {
+		store = &gcStore{MediaStore: storage.Default, refs: make(map[string]int)}
+	}
+
+	stores := []*gcStore{store}
+	if store != public {
+		stores = append(stores, public)
+	}
+
+	// Attachments and previews of posts that failed, or that were dropped
+	// from the cache
+	orphans, err := orphanedRows()
+	if err != nil {
+		return report, wrapErr(err)
+	}
+
+	report.Rows += len(orphans)
+
+	if err := countRefs(stores, orphans); err != nil {
+		return report, wrapErr(err)
+	}
+
+	if !dryRun {
+		for id := range orphans {
+			if _, err := config.DB.Exec(`delete from posts where id = $1`, id); err != nil {
+				return report, wrapErr(err)
+			}
+		}
+	}
+
+	rows, err := config.DB.Query(`select id, file from captchas`)
+	if err != nil {
+		return report, wrapErr(err)
+	}
+
+	for rows.Next() {
+		var id, file string
+		if err := rows.Scan(&id, &file); err != nil {
+			rows.Close()
+			return report, wrapErr(err)
+		}
+
+		public.captchas[filepath.Base(file)] = id
+	}
+	rows.Close()
+
+	// Reference counts are only trusted once they have settled
+	type mediaRow struct {
+		refs  int
+		stale bool
+	}
+
+	counted := make(map[string]mediaRow)
+
+	rows, err = config.DB.Query(`select key, refs, updated < now() - $1::interval from media`, fmt.Sprintf("%d seconds", int(gcGrace.Seconds())))
+	if err != nil {
+		return report, wrapErr(err)
+	}
+
+	for rows.Next() {
+		var key string
+		var row mediaRow
+		if err := rows.Scan(&key, &row.refs, &row.stale); err != nil {
+			rows.Close()
+			return report, wrapErr(err)
+		}
+
+		counted[key] = row
+	}
+	rows.Close()
+
+	cutoff := time.Now().Add(-gcGrace)
+	captchasGone := false
+
+	for _, s := range stores {
+		objs, err := s.List()
+		if err != nil {
+			return report, wrapErr(err)
+		}
+
+		exists := make(map[string]bool, len(objs))
+
+		for _, obj := range objs {
+			exists[obj.Key] = true
+
+			if s.refs[obj.Key] > 0 || s.captchas[obj.Key] != "" || obj.Modified.After(cutoff) {
+				continue
+			}
+
+			if row, ok := counted[obj.Key]; ok && s == store && !row.stale {
+				continue
+			}
+
+			report.Orphans = append(report.Orphans, s.URL(obj.Key))
+
+			if dryRun {
+				continue
+			}
+
+			if err := s.Delete(obj.Key); err != nil {
+				return report, wrapErr(err)
+			}
+
+			if s == store {
+				if _, err := config.DB.Exec(`delete from media where key = $1`, obj.Key); err != nil {
+					return report, wrapErr(err)
+				}
+
+				delete(counted, obj.Key)
+			}
+		}
+
+		for key := range s.refs {
+			if !exists[key] {
+				report.Missing = append(report.Missing, s.URL(key))
+			}
+		}
+
+		for key, id := range s.captchas {
+			if exists[key] {
+				continue
+			}
+
+			report.Missing = append(report.Missing, s.URL(key))
+			report.Rows++
+
+			if dryRun {
+				continue
+			}
+
+			if _, err := config.DB.Exec(`delete from captchas where id = $1`, id); err != nil {
+				return report, wrapErr(err)
+			}
+
+			captchasGone = true
+		}
+
+		if s != store {
+			continue
+		}
+
+		// Fix up reference counts
+		for key, n := range s.refs {
+			row, ok := counted[key]
+			if !exists[key] || (ok && (row.refs == n || !row.stale)) {
+				continue
+			}
+
+			report.Refs++
+
+			if dryRun {
+				continue
+			}
+
+			query := `insert into media (key, refs) values ($1, $2) on conflict (key) do update set refs = $2, updated = now()`
+			if _, err := config.DB.Exec(query, key, n); err != nil {
+				return report, wrapErr(err)
+			}
+		}
+
+		// Drop counts for files that are gone and unused
+		for key, row := range counted {
+			if s.refs[key] > 0 || exists[key] || !row.stale {
+				continue
+			}
+
+			report.Refs++
+
+			if dryRun {
+				continue
+			}
+
+			if _, err := config.DB.Exec(`delete from media where key = $1`, key); err != nil {
+				return report, wrapErr(err)
+			}
+		}
+	}
+
+	if captchasGone {
+		if err := MakeCaptchas(); err != nil {
+			return report, wrapErr(err)
+		}
+	}
+
+	return report, nil
+}
+
+// RunGC collects garbage every interval, logging what it finds.
+func RunGC(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for range t.C {
+		report, err := CollectGarbage(false)
+		if err != nil {
+			log.Printf("Garbage collection failed: %v", err)
+			continue
+		}
+
+		log.Printf("Garbage collection: %v", report)
+	}
+}
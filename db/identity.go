@@ -0,0 +1,217 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+// identitySalt caches the salt poster identities are currently made with.
+var identitySalt struct {
+	sync.Mutex
+
+	id      int
+	salt    []byte
+	created time.Time
+}
+
+// identityRotation is how long a salt is used for.
+func identityRotation() time.Duration {
+	if config.IdentityRotation <= 0 {
+		return 24 * time.Hour
+	}
+
+	return time.Duration(config.IdentityRotation) * time.Hour
+}
+
+func identityRetention() time.Duration {
+	return time.Duration(config.IdentityRetention) * time.Hour
+}
+
+// currentSalt returns the salt in use and its ID, making a new one if the
+// last has expired.
+func currentSalt() (int, []byte, error) {
+	identitySalt.Lock()
+	defer identitySalt.Unlock()
+
+	if identitySalt.salt != nil && time.Since(identitySalt.created) < identityRotation() {
+		return identitySalt.id, identitySalt.salt, nil
+	}
+
+	var id int
+	var salt []byte
+	var created time.Time
+
+	query := `select id, salt, created from identitysalts order by created desc limit 1`
+	err := config.DB.QueryRow(query).Scan(&id, &salt, &created)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, wrapErr(err)
+	}
+
+	if err != nil || time.Since(created) >= identityRotation() {
+		salt = make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return 0, nil, wrapErr(err)
+		}
+
+		created = time.Now().UTC()
+
+		query = `insert into identitysalts (salt, created) values ($1, $2) returning id`
+		if err := config.DB.QueryRow(query, salt, created).Scan(&id); err != nil {
+			return 0, nil, wrapErr(err)
+		}
+	}
+
+	identitySalt.id = id
+	identitySalt.salt = salt
+	identitySalt.created = created
+
+	return id, salt, nil
+}
+
+func makeIdentity(salt []byte, source string) string {
+	h := hmac.New(sha256.New, salt)
+	h.Write([]byte(source))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// PosterIdentity turns source, something that identifies a poster like their
+// IP address, into an identity that can't be turned back into it.
+// The same source gives the same identity until the salt rotates.
+func PosterIdentity(source string) (string, error) {
+	_, salt, err := currentSalt()
+	if err != nil {
+		return "", err
+	}
+
+	return makeIdentity(salt, source), nil
+}
+
+// PosterIdentities returns every identity source has had under the salts
+// that have not been purged yet, newest first.
+func PosterIdentities(source string) ([]string, error) {
+	// Make sure the current salt exists
+	if _, _, err := currentSalt(); err != nil {
+		return nil, err
+	}
+
+	var identities []string
+
+	rows, err := config.DB.Query(`select salt from identitysalts order by created desc`)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var salt []byte
+		if err := rows.Scan(&salt); err != nil {
+			return nil, wrapErr(err)
+		}
+
+		identities = append(identities, makeIdentity(salt, source))
+	}
+
+	return identities, wrapErr(rows.Err())
+}
+
+// PosterID returns the short ID shown next to the posts the poster known as
+// identity makes in the thread op.
+func PosterID(identity, op string) string {
+	h := hmac.New(sha256.New, []byte(config.Salt))
+	h.Write([]byte(identity + "\x00" + op))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))[:8]
+}
+
+// ThreadPosterID returns the poster ID of the poster known by source in the
+// thread op.
+// Identities change as the salt rotates, so the oldest one they posted in the
+// thread under is used, keeping their ID the same until it is purged.
+func ThreadPosterID(source, op string) (string, error) {
+	identities, err := PosterIdentities(source)
+	if err != nil {
+		return "", err
+	}
+
+	// The current identity comes first
+	identity := identities[0]
+
+	query := `select identity from posteridentity where identity = any($1) and (id = $2 or id in (select id from replies where inreplyto = $2)) order by created limit 1`
+	if err := config.DB.QueryRow(query, identities, op).Scan(&identity); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", wrapErr(err)
+	}
+
+	return PosterID(identity, op), nil
+}
+
+// WriteIdentity records the identity of whoever made the post id, the
+// poster known by source, and which salt made it.
+func WriteIdentity(id, source string) error {
+	saltID, salt, err := currentSalt()
+	if err != nil {
+		return err
+	}
+
+	query := `insert into posteridentity (id, identity, created, salt) values ($1, $2, $3, $4) on conflict (id) do nothing`
+	_, err = config.DB.Exec(query, id, makeIdentity(salt, source), time.Now().UTC(), saltID)
+	return wrapErr(err)
+}
+
+// GetIdentity returns the identity of whoever made the post id, or an empty
+// string if it isn't known.
+func GetIdentity(id string) (string, error) {
+	var identity string
+
+	query := `select identity from posteridentity where id = $1`
+	if err := config.DB.QueryRow(query, id).Scan(&identity); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", wrapErr(err)
+	}
+
+	return identity, nil
+}
+
+// PurgeIdentities forgets identities older than the retention period, along
+// with the salts that made them.
+// Salts that made identities which are still banned are kept, as without
+// them the bans would no longer match anyone.
+func PurgeIdentities() error {
+	if config.IdentityRetention <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().UTC().Add(-identityRetention())
+
+	if _, err := config.DB.Exec(`delete from posteridentity where created < $1`, cutoff); err != nil {
+		return wrapErr(err)
+	}
+
+	if _, err := config.DB.Exec(`delete from reporters where created < $1`, cutoff); err != nil {
+		return wrapErr(err)
+	}
+
+	// A salt is used for a whole rotation after it is made
+	query := `delete from identitysalts where created < $1 and id not in (select salt from bans where salt is not null and (expires is null or expires > $2))`
+	_, err := config.DB.Exec(query, cutoff.Add(-identityRotation()), time.Now().UTC())
+	return wrapErr(err)
+}
+
+// RunIdentityPurge purges old identities every interval.
+func RunIdentityPurge(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for range t.C {
+		if err := PurgeIdentities(); err != nil {
+			log.Printf("Failed to purge poster identities: %v", err)
+		}
+	}
+}
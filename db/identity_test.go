@@ -0,0 +1,104 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+// testDB connects to the PostgreSQL database named by FEDICHAN_TEST_DB,
+// skipping t if there isn't one.
+// The rest of the connection settings come from fchan.cfg as usual.
+func testDB(t *testing.T) {
+	name := os.Getenv("FEDICHAN_TEST_DB")
+	if name == "" {
+		t.Skip("FEDICHAN_TEST_DB is not set")
+	}
+
+	config.DBName = name
+	if err := Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { config.DB.Close() })
+}
+
+// TestBanOutlivesPurge makes sure bans keep matching their poster after the
+// identities they were made from are purged, for as long as they last.
+// Like the instance does, it purges old identities from the test database.
+func TestBanOutlivesPurge(t *testing.T) {
+	testDB(t)
+
+	retention, rotation := config.IdentityRetention, config.IdentityRotation
+	config.IdentityRetention, config.IdentityRotation = 1, 1
+	t.Cleanup(func() { config.IdentityRetention, config.IdentityRotation = retention, rotation })
+
+	const post = "https://fixture.invalid/b/BANNED"
+	const source = "ip:192.0.2.1"
+
+	// A salt long due to be purged, and a post made with it
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	salt := []byte("a salt long due to be purged")
+
+	var saltID int
+	if err := config.DB.QueryRow(`insert into identitysalts (salt, created) values ($1, $2) returning id`, salt, old).Scan(&saltID); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		config.DB.Exec(`delete from bans where post = $1`, post)
+		config.DB.Exec(`delete from posteridentity where id = $1`, post)
+		config.DB.Exec(`delete from identitysalts where id = $1`, saltID)
+	})
+
+	identity := makeIdentity(salt, source)
+	if _, err := config.DB.Exec(`insert into posteridentity (id, identity, created, salt) values ($1, $2, $3, $4)`, post, identity, old, saltID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateBan(Ban{Identity: identity, Post: post, Reason: "fixture"}); err != nil {
+		t.Fatal(err)
+	}
+
+	banned := func() bool {
+		t.Helper()
+
+		if err := PurgeIdentities(); err != nil {
+			t.Fatal(err)
+		}
+
+		identities, err := PosterIdentities(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bans, err := GetActiveBans(identities, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(bans) > 0
+	}
+
+	if !banned() {
+		t.Error("a permanent ban stopped matching once its identity was purged")
+	}
+
+	// Once the ban is over, its salt goes the way of the others
+	if _, err := config.DB.Exec(`update bans set expires = $1 where post = $2`, time.Now().UTC().Add(-time.Minute), post); err != nil {
+		t.Fatal(err)
+	}
+
+	if banned() {
+		t.Error("an expired ban still matches")
+	}
+
+	var n int
+	if err := config.DB.QueryRow(`select count(*) from identitysalts where id = $1`, saltID).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Error("the salt of an expired ban was kept")
+	}
+}
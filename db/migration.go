@@ -3,6 +3,7 @@ package db
 import (
 	"database/sql"
 	"errors"
+	"log"
 
 	"github.com/KushBlazingJudah/fedichan/config"
 
@@ -155,6 +156,235 @@ var migrations = []func(*sql.Tx) error{
 	migrationScript(`
 		ALTER TABLE actor ADD COLUMN locked BOOLEAN NOT NULL DEFAULT FALSE;
 	`),
+	migrationScript(`
+		ALTER TABLE activitystream ADD COLUMN width INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE activitystream ADD COLUMN height INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE activitystream ADD COLUMN hash TEXT NOT NULL DEFAULT '';
+		ALTER TABLE cacheactivitystream ADD COLUMN width INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE cacheactivitystream ADD COLUMN height INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE cacheactivitystream ADD COLUMN hash TEXT NOT NULL DEFAULT '';
+	`),
+	migrationScript(`
+		CREATE TABLE media(
+		       key TEXT PRIMARY KEY,
+		       refs INTEGER NOT NULL DEFAULT 0
+		);
+	`),
+	func(tx *sql.Tx) error {
+		// These hashed only the first 2048 bytes of a file and were never
+		// checked against anything, so they are kept only to be banned
+		// again
+		var legacy int
+		if err := tx.QueryRow(`select count(*) from bannedmedia`).Scan(&legacy); err != nil {
+			return err
+		}
+
+		if legacy > 0 {
+			log.Printf("%d media bans were made by an older version and no longer match anything; they are marked legacy on the media bans page and should be banned again", legacy)
+		}
+
+		return migrationScript(`
+			ALTER TABLE bannedmedia ADD COLUMN legacy BOOLEAN NOT NULL DEFAULT FALSE;
+			UPDATE bannedmedia SET legacy = TRUE;
+			DELETE FROM bannedmedia a USING bannedmedia b WHERE a.hash = b.hash AND a.id > b.id;
+
+			ALTER TABLE bannedmedia ADD UNIQUE (hash);
+			ALTER TABLE bannedmedia ADD COLUMN phash BIGINT;
+			ALTER TABLE bannedmedia ADD COLUMN added TIMESTAMP NOT NULL DEFAULT now();
+		`)(tx)
+	},
+	migrationScript(`
+		ALTER TABLE media ADD COLUMN updated TIMESTAMP NOT NULL DEFAULT now();
+	`),
+	migrationScript(`
+		ALTER TABLE activitystream ADD COLUMN capcode TEXT NOT NULL DEFAULT '';
+		ALTER TABLE cacheactivitystream ADD COLUMN capcode TEXT NOT NULL DEFAULT '';
+	`),
+	migrationScript(`
+		ALTER TABLE activitystream ADD COLUMN deletepass TEXT NOT NULL DEFAULT '';
+		ALTER TABLE cacheactivitystream ADD COLUMN deletepass TEXT NOT NULL DEFAULT '';
+	`),
+	migrationScript(`
+		CREATE TABLE identitysalts(
+		       id SERIAL PRIMARY KEY,
+		       salt BYTEA NOT NULL,
+		       created TIMESTAMP NOT NULL DEFAULT now()
+		);
+
+		CREATE TABLE posteridentity(
+		       id VARCHAR(100) PRIMARY KEY,
+		       identity TEXT NOT NULL,
+		       created TIMESTAMP NOT NULL DEFAULT now()
+		);
+
+		CREATE INDEX posteridentity_identity ON posteridentity (identity, created);
+	`),
+	migrationScript(`
+		CREATE TABLE bans(
+		       id SERIAL PRIMARY KEY,
+		       identity TEXT NOT NULL DEFAULT '',
+		       ip INET,
+		       board VARCHAR(100) NOT NULL DEFAULT '',
+		       reason TEXT NOT NULL DEFAULT '',
+		       post VARCHAR(100) NOT NULL DEFAULT '',
+		       marked BOOLEAN NOT NULL DEFAULT FALSE,
+		       created TIMESTAMP NOT NULL DEFAULT now(),
+		       expires TIMESTAMP,
+		       appeal TEXT NOT NULL DEFAULT '',
+		       appealed TIMESTAMP,
+		       denied BOOLEAN NOT NULL DEFAULT FALSE
+		);
+
+		CREATE INDEX bans_identity ON bans (identity);
+		CREATE INDEX bans_post ON bans (post);
+	`),
+	migrationScript(`
+		ALTER TABLE actor ADD COLUMN replydelay INTEGER NOT NULL DEFAULT 15;
+		ALTER TABLE actor ADD COLUMN threaddelay INTEGER NOT NULL DEFAULT 120;
+		ALTER TABLE actor ADD COLUMN dupwindow INTEGER NOT NULL DEFAULT 600;
+		ALTER TABLE actor ADD COLUMN reportlimit INTEGER NOT NULL DEFAULT 5;
+
+		CREATE TABLE reporters(
+		       identity TEXT NOT NULL,
+		       board VARCHAR(100) NOT NULL,
+		       created TIMESTAMP NOT NULL DEFAULT now()
+		);
+
+		CREATE INDEX reporters_identity ON reporters (identity, board, created);
+	`),
+	migrationScript(`
+		ALTER TABLE actor ADD COLUMN posterids BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE activitystream ADD COLUMN posterid TEXT NOT NULL DEFAULT '';
+		ALTER TABLE cacheactivitystream ADD COLUMN posterid TEXT NOT NULL DEFAULT '';
+	`),
+	migrationScript(`
+		ALTER TABLE actor ADD COLUMN bumplimit INTEGER NOT NULL DEFAULT 300;
+		ALTER TABLE actor ADD COLUMN imagelimit INTEGER NOT NULL DEFAULT 150;
+
+		CREATE TABLE autosage(
+		       actor_id VARCHAR(100),
+		       activity_id VARCHAR(100)
+		);
+	`),
+	migrationScript(`
+		ALTER TABLE actor ADD COLUMN cyclelimit INTEGER NOT NULL DEFAULT 250;
+
+		CREATE TABLE cyclical(
+		       actor_id VARCHAR(100),
+		       activity_id VARCHAR(100),
+		       keep INTEGER NOT NULL
+		);
+	`),
+	migrationScript(`
+		CREATE TABLE polls(
+		       id VARCHAR(100) PRIMARY KEY,
+		       multiple BOOLEAN NOT NULL DEFAULT FALSE,
+		       endtime TIMESTAMP
+		);
+
+		CREATE TABLE polloptions(
+		       poll VARCHAR(100) NOT NULL,
+		       position INTEGER NOT NULL,
+		       name TEXT NOT NULL,
+		       votes INTEGER NOT NULL DEFAULT 0
+		);
+
+		CREATE INDEX polloptions_poll ON polloptions (poll);
+
+		CREATE TABLE pollvotes(
+		       poll VARCHAR(100) NOT NULL,
+		       name TEXT NOT NULL,
+		       voter TEXT NOT NULL,
+		       created TIMESTAMP NOT NULL DEFAULT now()
+		);
+
+		CREATE INDEX pollvotes_voter ON pollvotes (poll, voter);
+	`),
+	migrationScript(`
+		ALTER TABLE activitystream ADD COLUMN spoiler BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE cacheactivitystream ADD COLUMN spoiler BOOLEAN NOT NULL DEFAULT FALSE;
+
+		ALTER TABLE actor ADD COLUMN spoilerimage TEXT NOT NULL DEFAULT '';
+	`),
+	migrationScript(`
+		ALTER TABLE activitystream ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', coalesce(name, '') || ' ' || coalesce(subject, '') || ' ' || coalesce(content, ''))) STORED;
+		ALTER TABLE cacheactivitystream ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', coalesce(name, '') || ' ' || coalesce(subject, '') || ' ' || coalesce(content, ''))) STORED;
+
+		CREATE INDEX activitystream_search ON activitystream USING GIN (search);
+		CREATE INDEX cacheactivitystream_search ON cacheactivitystream USING GIN (search);
+	`),
+	migrationScript(`
+		ALTER TABLE actor ALTER COLUMN id TYPE TEXT, ALTER COLUMN inbox TYPE TEXT, ALTER COLUMN outbox TYPE TEXT, ALTER COLUMN following TYPE TEXT, ALTER COLUMN followers TYPE TEXT;
+		ALTER TABLE replies ALTER COLUMN id TYPE TEXT, ALTER COLUMN inreplyto TYPE TEXT;
+		ALTER TABLE following ALTER COLUMN id TYPE TEXT, ALTER COLUMN following TYPE TEXT;
+		ALTER TABLE follower ALTER COLUMN id TYPE TEXT, ALTER COLUMN follower TYPE TEXT;
+		ALTER TABLE reported ALTER COLUMN id TYPE TEXT, ALTER COLUMN board TYPE TEXT;
+		ALTER TABLE activitystream ALTER COLUMN actor TYPE TEXT, ALTER COLUMN attachment TYPE TEXT, ALTER COLUMN attributedTo TYPE TEXT, ALTER COLUMN id TYPE TEXT, ALTER COLUMN object TYPE TEXT, ALTER COLUMN preview TYPE TEXT, ALTER COLUMN url TYPE TEXT, ALTER COLUMN href TYPE TEXT;
+		ALTER TABLE cacheactivitystream ALTER COLUMN actor TYPE TEXT, ALTER COLUMN attachment TYPE TEXT, ALTER COLUMN attributedTo TYPE TEXT, ALTER COLUMN id TYPE TEXT, ALTER COLUMN object TYPE TEXT, ALTER COLUMN preview TYPE TEXT, ALTER COLUMN url TYPE TEXT, ALTER COLUMN href TYPE TEXT;
+		ALTER TABLE removed ALTER COLUMN id TYPE TEXT;
+		ALTER TABLE publicKeyPem ALTER COLUMN id TYPE TEXT, ALTER COLUMN owner TYPE TEXT, ALTER COLUMN file TYPE TEXT;
+		ALTER TABLE sticky ALTER COLUMN actor_id TYPE TEXT, ALTER COLUMN activity_id TYPE TEXT;
+		ALTER TABLE locked ALTER COLUMN actor_id TYPE TEXT, ALTER COLUMN activity_id TYPE TEXT;
+		ALTER TABLE autosage ALTER COLUMN actor_id TYPE TEXT, ALTER COLUMN activity_id TYPE TEXT;
+		ALTER TABLE cyclical ALTER COLUMN actor_id TYPE TEXT, ALTER COLUMN activity_id TYPE TEXT;
+		ALTER TABLE polls ALTER COLUMN id TYPE TEXT;
+		ALTER TABLE polloptions ALTER COLUMN poll TYPE TEXT;
+		ALTER TABLE pollvotes ALTER COLUMN poll TYPE TEXT;
+		ALTER TABLE posteridentity ALTER COLUMN id TYPE TEXT;
+		ALTER TABLE bans ALTER COLUMN board TYPE TEXT, ALTER COLUMN post TYPE TEXT;
+		ALTER TABLE reporters ALTER COLUMN board TYPE TEXT;
+
+		CREATE INDEX replies_id ON replies (id);
+		CREATE INDEX replies_inreplyto ON replies (inreplyto);
+		CREATE INDEX following_id ON following (id);
+		CREATE INDEX following_following ON following (following);
+		CREATE INDEX follower_id ON follower (id);
+		CREATE INDEX follower_follower ON follower (follower);
+
+		CREATE INDEX activitystream_actor ON activitystream (actor, type, updated);
+		CREATE INDEX activitystream_updated ON activitystream (updated);
+		CREATE INDEX activitystream_suffix ON activitystream (reverse(id) text_pattern_ops);
+		CREATE INDEX cacheactivitystream_actor ON cacheactivitystream (actor, type, updated);
+		CREATE INDEX cacheactivitystream_updated ON cacheactivitystream (updated);
+		CREATE INDEX cacheactivitystream_suffix ON cacheactivitystream (reverse(id) text_pattern_ops);
+
+		CREATE INDEX sticky_activity ON sticky (activity_id);
+		CREATE INDEX locked_activity ON locked (activity_id);
+		CREATE INDEX autosage_activity ON autosage (activity_id);
+		CREATE INDEX cyclical_activity ON cyclical (activity_id);
+	`),
+	migrationScript(`
+		ALTER TABLE activitystream RENAME TO posts;
+		ALTER TABLE posts ADD COLUMN local BOOLEAN NOT NULL DEFAULT TRUE;
+		ALTER TABLE posts ALTER COLUMN local SET DEFAULT FALSE;
+
+		INSERT INTO posts (actor, attachment, attributedTo, id, object, preview, type, url, content, name, href, mediaType, published, summary, updated, deleted, subject, size, sensitive, tripcode, width, height, hash, capcode, deletepass, posterid, spoiler, local)
+		SELECT actor, attachment, attributedTo, id, object, preview, type, url, content, name, href, mediaType, published, summary, updated, deleted, subject, size, sensitive, tripcode, width, height, hash, capcode, deletepass, posterid, spoiler, FALSE FROM cacheactivitystream
+		ON CONFLICT (id) DO NOTHING;
+
+		DROP TABLE cacheactivitystream;
+
+		ALTER INDEX activitystream_search RENAME TO posts_search;
+		ALTER INDEX activitystream_actor RENAME TO posts_actor;
+		ALTER INDEX activitystream_updated RENAME TO posts_updated;
+		ALTER INDEX activitystream_suffix RENAME TO posts_suffix;
+	`),
+	migrationScript(`
+		ALTER TABLE posts ADD COLUMN phash BIGINT;
+	`),
+	migrationScript(`
+		ALTER TABLE posteridentity ADD COLUMN salt INTEGER;
+		ALTER TABLE bans ADD COLUMN salt INTEGER;
+
+		UPDATE posteridentity p SET salt = (SELECT s.id FROM identitysalts s WHERE s.created <= p.created ORDER BY s.created DESC LIMIT 1);
+		UPDATE bans b SET salt = (SELECT p.salt FROM posteridentity p WHERE p.identity = b.identity LIMIT 1) WHERE b.identity != '';
+	`),
+	migrationScript(`
+		DELETE FROM pollvotes a USING pollvotes b WHERE a.ctid > b.ctid AND a.poll = b.poll AND a.voter = b.voter AND a.name = b.name;
+
+		DROP INDEX pollvotes_voter;
+		ALTER TABLE pollvotes ADD CONSTRAINT pollvotes_voter UNIQUE (poll, voter, name);
+	`),
 }
 
 func migrate() error {
@@ -215,3 +445,45 @@ func migrate() error {
 
 	return nil
 }
+
+// indexes are the indexes lookups on hot paths rely on.
+var indexes = []string{
+	"replies_id", "replies_inreplyto",
+	"following_id", "following_following",
+	"follower_id", "follower_follower",
+	"posts_actor", "posts_updated", "posts_suffix", "posts_search",
+	"sticky_activity", "locked_activity", "autosage_activity", "cyclical_activity",
+}
+
+// checkIndexes warns about any of indexes that are missing, which leaves
+// reading boards and threads scanning whole tables.
+func checkIndexes() error {
+	rows, err := config.DB.Query(`select indexname from pg_indexes where schemaname = current_schema() and indexname = any($1)`, indexes)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	found := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+
+		found[name] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range indexes {
+		if !found[name] {
+			log.Printf("warning: index %s is missing; pages will be slow until it is created (see db/schema.psql)", name)
+		}
+	}
+
+	return nil
+}
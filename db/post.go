@@ -3,13 +3,13 @@ package db
 import (
 	"fmt"
 	"html/template"
-	"mime/multipart"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/markup"
 	"github.com/KushBlazingJudah/fedichan/internal/rx"
 )
 
@@ -91,115 +91,93 @@ func ParseLinkTitle(actorName string, op string, content string) string {
 	return content
 }
 
-func IsMediaBanned(f multipart.File) (bool, error) {
-	/* TODO: Rewrite
-	f.Seek(0, 0)
-	fileBytes := make([]byte, 2048)
-	_, err := f.Read(fileBytes)
-
-	if err != nil {
-		return true, wrapErr(err)
-	}
-
-	hash := util.HashBytes(fileBytes)
-	f.Seek(0, 0)
-
-	return IsHashBanned(hash)
-	*/
-
-	return false, nil
-}
-
 func ParseContent(board activitypub.Actor, op string, content string, thread activitypub.ObjectBase, id string, trunc bool) (template.HTML, error) {
-	content = template.HTMLEscapeString(content)
+	truncated := false
 	if trunc {
-		content = ParseTruncate(content, board, op, id)
+		content, truncated = ParseTruncate(content)
 	}
 
-	content = ParseLinkComments(board, op, content, thread)
-	content = ParseCommentQuotes(content)
+	content = markup.HTML(content, func(cite string) string {
+		return ParseLinkComments(board, op, cite, thread)
+	})
 
-	content = strings.ReplaceAll(content, "\r", "")
-	content = strings.ReplaceAll(content, "\n", "<br/>")
+	if truncated {
+		content += fmt.Sprintf("<a href=\"%s\">(view full post...)</a>", board.Id+"/"+shortURL(board.Outbox, op)+"#"+shortURL(board.Outbox, id))
+	}
 
 	return template.HTML(content), nil
 }
 
-func ParseTruncate(content string, board activitypub.Actor, op string, id string) string {
+// ParseTruncate cuts content down to its first 30 lines, reporting whether
+// anything was cut.
+func ParseTruncate(content string) (string, bool) {
 	if strings.Count(content, "\n") > 30 {
-		content = strings.Join(rx.Newline.Split(content, 30), "\n")
-
-		content += fmt.Sprintf("<a href=\"%s\">(view full post...)</a>", board.Id+"/"+shortURL(board.Outbox, op)+"#"+shortURL(board.Outbox, id))
+		return strings.Join(rx.Newline.Split(content, 30), "\n"), true
 	}
 
-	return content
+	return content, false
 }
 
-func ParseLinkComments(board activitypub.Actor, op string, content string, thread activitypub.ObjectBase) string {
-	return rx.CiteEsc.ReplaceAllStringFunc(content, func(match string) string {
-		v := rx.CiteEsc.FindStringSubmatch(match)
+// ParseLinkComments renders cite, a link to another post, as HTML.
+func ParseLinkComments(board activitypub.Actor, op string, cite string, thread activitypub.ObjectBase) string {
+	v := rx.Cite.FindStringSubmatch(cite)
 
-		isOP := ""
-		domain := v[2]
-		link := strings.Replace(v[0], "&gt;&gt;", "", 1)
+	isOP := ""
+	domain := v[2]
+	link := strings.Replace(v[0], ">>", "", 1)
 
-		if link == op {
-			isOP = " (OP)"
-		}
+	if link == op {
+		isOP = " (OP)"
+	}
 
-		parsedLink := ConvertHashLink(domain, link)
-
-		/* TODO: Broken until I fix it again.
-		//format the hover title text
-		var quoteTitle string
-
-		// if the quoted content is local get it
-		// else get it from the database
-		if thread.Id == link {
-			quoteTitle = ParseLinkTitle(board.Outbox, op, thread.Content)
-		} else {
-			for _, e := range thread.Replies.OrderedItems {
-				if e.Id == parsedLink {
-					quoteTitle = ParseLinkTitle(board.Outbox, op, e.Content)
-					break
-				}
+	parsedLink := ConvertHashLink(domain, link)
+
+	/* TODO: Broken until I fix it again.
+	//format the hover title text
+	var quoteTitle string
+
+	// if the quoted content is local get it
+	// else get it from the database
+	if thread.Id == link {
+		quoteTitle = ParseLinkTitle(board.Outbox, op, thread.Content)
+	} else {
+		for _, e := range thread.Replies.OrderedItems {
+			if e.Id == parsedLink {
+				quoteTitle = ParseLinkTitle(board.Outbox, op, e.Content)
+				break
 			}
+		}
 
-			if quoteTitle == "" {
-				obj := activitypub.ObjectBase{Id: parsedLink}
-				col, err := obj.GetCollectionFromPath()
-				if err == nil {
-					if len(col.OrderedItems) > 0 {
-						quoteTitle = ParseLinkTitle(board.Outbox, op, col.OrderedItems[0].Content)
-					} else {
-						quoteTitle = ParseLinkTitle(board.Outbox, op, parsedLink)
-					}
+		if quoteTitle == "" {
+			obj := activitypub.ObjectBase{Id: parsedLink}
+			col, err := obj.GetCollectionFromPath()
+			if err == nil {
+				if len(col.OrderedItems) > 0 {
+					quoteTitle = ParseLinkTitle(board.Outbox, op, col.OrderedItems[0].Content)
+				} else {
+					quoteTitle = ParseLinkTitle(board.Outbox, op, parsedLink)
 				}
 			}
 		}
-		*/
+	}
+	*/
 
-		if replyID, isReply, err := IsReplyToOP(op, parsedLink); err == nil || !isReply {
-			id := shortURL(board.Outbox, replyID)
+	if replyID, isReply, err := IsReplyToOP(op, parsedLink); err == nil || !isReply {
+		id := shortURL(board.Outbox, replyID)
 
-			return fmt.Sprintf(`<a class="reply" ` /*title="%s" */ +`href="/%s/%s#%s">&gt;&gt;%s%s</a>` /*, quoteTitle*/, board.Name, shortURL(board.Outbox, op), id, id, isOP)
-		}
-
-		//this is a cross post
-		parsedOP, err := GetReplyOP(parsedLink)
-		if err == nil {
-			link = parsedOP + "#" + shortURL(parsedOP, parsedLink)
-		}
+		return fmt.Sprintf(`<a class="reply" ` /*title="%s" */ +`href="/%s/%s#%s">&gt;&gt;%s%s</a>` /*, quoteTitle*/, board.Name, shortURL(board.Outbox, op), id, id, isOP)
+	}
 
-		actor, err := activitypub.FingerActor(parsedLink)
-		if err == nil && actor.Id != "" {
-			return fmt.Sprintf(`<a class="reply" ` /*title="%s" */ +`href="%s">&gt;&gt;%s%s →</a>` /*, quoteTitle*/, link, shortURL(board.Outbox, parsedLink), isOP)
-		}
+	//this is a cross post
+	parsedOP, err := GetReplyOP(parsedLink)
+	if err == nil {
+		link = parsedOP + "#" + shortURL(parsedOP, parsedLink)
+	}
 
-		return fmt.Sprintf(`<a class="reply dead">&gt;&gt;%s</a>`, link)
-	})
-}
+	actor, err := activitypub.FingerActor(parsedLink)
+	if err == nil && actor.Id != "" {
+		return fmt.Sprintf(`<a class="reply" ` /*title="%s" */ +`href="%s">&gt;&gt;%s%s →</a>` /*, quoteTitle*/, link, shortURL(board.Outbox, parsedLink), isOP)
+	}
 
-func ParseCommentQuotes(content string) string {
-	return rx.Quote.ReplaceAllString(content, `<span class="quote">&gt;$1</span>`)
+	return fmt.Sprintf(`<a class="reply dead">&gt;&gt;%s</a>`, link)
 }
@@ -21,8 +21,33 @@ const SaltTable = "" +
 	"................................" +
 	"................................"
 
-func CreateNameTripCode(input string, a *Acct) (string, string, error) {
-	// TODO: Capcode support has been removed. Add it back in.
+// capcodeTypes maps capcodes to the account type needed to post with them.
+var capcodeTypes = map[string]AcctType{
+	"janitor": Janitor,
+	"mod":     Mod,
+	"admin":   Admin,
+}
+
+// capcodeRe matches "## Mod" and friends at the end of a name.
+// They have to stand on their own, with exactly one space after the ##, or
+// they're taken for part of a secure tripcode.
+var capcodeRe = regexp.MustCompile(`(?i)(?:^|\s)## (janitor|mod|admin)$`)
+
+// CreateNameTripCode splits the name field of a post into the name, its
+// tripcode and its capcode.
+// Capcodes are only taken out of the name for accounts allowed to use them;
+// for anyone else, they are left in as a secure tripcode would be, as that
+// may be what they are.
+func CreateNameTripCode(input string, a *Acct) (string, string, string, error) {
+	var capcode string
+
+	if m := capcodeRe.FindStringSubmatch(input); m != nil {
+		title := strings.ToLower(m[1])
+		if a != nil && a.Type >= capcodeTypes[title] {
+			input = strings.TrimSpace(input[:len(input)-len(m[0])])
+			capcode = strings.ToUpper(title[:1]) + title[1:]
+		}
+	}
 
 	tripSecure := regexp.MustCompile("##(.+)?")
 
@@ -32,7 +57,7 @@ func CreateNameTripCode(input string, a *Acct) (string, string, error) {
 
 		hash, err := TripCodeSecure(chunck)
 
-		return tripSecure.ReplaceAllString(input, ""), "!!" + hash, wrapErr(err)
+		return tripSecure.ReplaceAllString(input, ""), "!!" + hash, capcode, wrapErr(err)
 	}
 
 	trip := regexp.MustCompile("#(.+)?")
@@ -42,10 +67,10 @@ func CreateNameTripCode(input string, a *Acct) (string, string, error) {
 		chunck = strings.Replace(chunck, "#", "", 1)
 
 		hash, err := TripCode(chunck)
-		return trip.ReplaceAllString(input, ""), "!" + hash, wrapErr(err)
+		return trip.ReplaceAllString(input, ""), "!" + hash, capcode, wrapErr(err)
 	}
 
-	return input, "", nil
+	return input, "", capcode, nil
 }
 
 func TripCode(pass string) (string, error) {
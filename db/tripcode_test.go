@@ -0,0 +1,48 @@
+package db
+
+import "testing"
+
+func TestCreateNameTripCode(t *testing.T) {
+	janitor := &Acct{Type: Janitor}
+	mod := &Acct{Type: Mod}
+
+	secure := func(pass string) string {
+		hash, err := TripCodeSecure(pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return "!!" + hash
+	}
+
+	tests := []struct {
+		input                   string
+		acct                    *Acct
+		name, tripcode, capcode string
+	}{
+		{"Anonymous", nil, "Anonymous", "", ""},
+		{"Anon ## Mod", mod, "Anon", "", "Mod"},
+		{"## mod", mod, "", "", "Mod"},
+		{"Anon ## Janitor", mod, "Anon", "", "Janitor"},
+		{"Anon##pass ## Mod", mod, "Anon", secure("pass"), "Mod"},
+
+		// Not staff, or not staff enough, so it's a secure tripcode
+		{"Anon ## Mod", nil, "Anon ", secure(" Mod"), ""},
+		{"Anon ## Mod", janitor, "Anon ", secure(" Mod"), ""},
+
+		// Passwords that only look like capcodes are left alone
+		{"Anon##  mod", mod, "Anon", secure("  mod"), ""},
+		{"Anon## mod", mod, "Anon", secure(" mod"), ""},
+		{"Anon ## mod2", mod, "Anon ", secure(" mod2"), ""},
+		{"Anon ## Mod ", mod, "Anon ", secure(" Mod "), ""},
+	}
+
+	for _, tt := range tests {
+		name, tripcode, capcode, err := CreateNameTripCode(tt.input, tt.acct)
+		if err != nil {
+			t.Errorf("CreateNameTripCode(%q): %v", tt.input, err)
+		} else if name != tt.name || tripcode != tt.tripcode || capcode != tt.capcode {
+			t.Errorf("CreateNameTripCode(%q) = %q, %q, %q, want %q, %q, %q", tt.input, name, tripcode, capcode, tt.name, tt.tripcode, tt.capcode)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/internal/storage"
+)
+
+// gc runs the garbage collector once from the command line.
+//
+//	fchan gc [--dry-run]
+func gc(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would be removed without removing anything")
+	fs.Parse(args)
+
+	if err := storage.Open(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := db.Connect(); err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	report, err := db.CollectGarbage(*dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+
+	for _, u := range report.Orphans {
+		fmt.Printf("orphan (%s): %s\n", verb, u)
+	}
+
+	for _, u := range report.Missing {
+		fmt.Printf("missing: %s\n", u)
+	}
+
+	fmt.Println(report)
+}
@@ -7,7 +7,8 @@ require (
 	github.com/gofiber/template v1.7.4
 	github.com/jackc/pgx/v5 v5.4.1
 	github.com/simia-tech/crypt v0.5.1
-	golang.org/x/text v0.10.0
+	golang.org/x/image v0.10.0
+	golang.org/x/text v0.11.0
 )
 
 require (
@@ -0,0 +1,376 @@
+// Package markup turns post comments into HTML, and into plain text for places
+// HTML can't go.
+//
+// Comments may contain:
+//
+//	>greentext, one line at a time
+//	>>https://example.com/b/ABCDEF cites of other posts
+//	[spoiler]spoilers[/spoiler], which may span lines
+//	[code]code blocks that keep their whitespace[/code]
+//	**bold**, *italic*, ~~strike~~ and ==red text==
+//	links, which are made clickable
+//
+// Anything that doesn't pair up is left as it was written, and everything is
+// escaped, so comments from other software come out as plain text at worst.
+package markup
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/KushBlazingJudah/fedichan/internal/rx"
+)
+
+// CiteFunc renders a cite, such as ">>https://example.com/b/ABCDEF", as HTML.
+type CiteFunc func(cite string) string
+
+var (
+	citeStart = regexp.MustCompile(`^` + rx.Cite.String())
+	urlStart  = regexp.MustCompile(`^https?://[^\s<>"'` + "`" + `]+`)
+	quoteLine = regexp.MustCompile(`^\s*>`)
+)
+
+// inline are the kinds of inline formatting, in the order they are tried.
+var inline = []struct {
+	delim      string
+	open, shut string
+}{
+	{"**", "<b>", "</b>"},
+	{"~~", "<s>", "</s>"},
+	{"==", `<span class="redtext">`, "</span>"},
+	{"*", "<i>", "</i>"},
+}
+
+const (
+	codeOpen     = "[code]"
+	codeClose    = "[/code]"
+	spoilerOpen  = "[spoiler]"
+	spoilerClose = "[/spoiler]"
+)
+
+// HTML renders comment as HTML, with cites rendered by cite.
+// If cite is nil, cites are left as text.
+func HTML(comment string, cite CiteFunc) string {
+	var b strings.Builder
+	r := renderer{b: &b, cite: cite}
+
+	for _, c := range splitCode(comment) {
+		if c.code {
+			b.WriteString(`<pre class="code">`)
+			b.WriteString(html.EscapeString(c.text))
+			b.WriteString(`</pre>`)
+		} else {
+			r.text(c.text)
+		}
+	}
+
+	return b.String()
+}
+
+// PlainText strips comment of its markup.
+// Spoilers are left out so they aren't spoiled in places they can't be hidden.
+func PlainText(comment string) string {
+	var b strings.Builder
+	r := renderer{b: &b, plain: true}
+
+	for i, c := range splitCode(comment) {
+		if i > 0 {
+			// Code blocks sit on lines of their own
+			b.WriteString("\n")
+		}
+
+		if c.code {
+			b.WriteString(c.text)
+		} else {
+			r.text(c.text)
+		}
+	}
+
+	return b.String()
+}
+
+type chunk struct {
+	text string
+	code bool
+}
+
+// splitCode splits comment into code blocks and the text around them.
+// Newlines next to a code block belong to it and are dropped.
+func splitCode(comment string) []chunk {
+	var chunks []chunk
+
+	comment = strings.ReplaceAll(comment, "\r", "")
+	for {
+		start := strings.Index(comment, codeOpen)
+		if start < 0 {
+			break
+		}
+
+		end := strings.Index(comment[start+len(codeOpen):], codeClose)
+		if end < 0 {
+			break
+		}
+		end += start + len(codeOpen)
+
+		chunks = append(chunks,
+			chunk{text: strings.TrimSuffix(comment[:start], "\n")},
+			chunk{text: strings.Trim(comment[start+len(codeOpen):end], "\n"), code: true})
+
+		comment = strings.TrimPrefix(comment[end+len(codeClose):], "\n")
+	}
+
+	return append(chunks, chunk{text: comment})
+}
+
+type tokenKind int
+
+const (
+	tokText tokenKind = iota
+	tokOpen
+	tokClose
+	tokNewline
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// lex splits text into spoiler tags, newlines and the text between them.
+// Spoiler tags that don't pair up become text.
+func lex(text string) []token {
+	var toks []token
+	var open []int
+
+	for text != "" {
+		i := strings.IndexAny(text, "[\n")
+		if i < 0 {
+			toks = append(toks, token{tokText, text})
+			break
+		} else if i > 0 {
+			toks = append(toks, token{tokText, text[:i]})
+			text = text[i:]
+		}
+
+		switch {
+		case text[0] == '\n':
+			toks = append(toks, token{tokNewline, "\n"})
+			text = text[1:]
+		case strings.HasPrefix(text, spoilerOpen):
+			open = append(open, len(toks))
+			toks = append(toks, token{tokOpen, spoilerOpen})
+			text = text[len(spoilerOpen):]
+		case strings.HasPrefix(text, spoilerClose) && len(open) > 0:
+			open = open[:len(open)-1]
+			toks = append(toks, token{tokClose, spoilerClose})
+			text = text[len(spoilerClose):]
+		default:
+			toks = append(toks, token{tokText, text[:1]})
+			text = text[1:]
+		}
+	}
+
+	for _, i := range open {
+		toks[i].kind = tokText
+	}
+
+	// Formatting and links can span a stray [ or an unpaired tag, so the
+	// text around them is joined back up
+	merged := toks[:0]
+	for _, t := range toks {
+		if n := len(merged); n > 0 && t.kind == tokText && merged[n-1].kind == tokText {
+			merged[n-1].text += t.text
+		} else {
+			merged = append(merged, t)
+		}
+	}
+
+	return merged
+}
+
+type renderer struct {
+	b     *strings.Builder
+	cite  CiteFunc
+	plain bool
+}
+
+// text renders text that isn't in a code block, line by line.
+// Spoilers are closed at the end of each line and opened again on the next so
+// they nest properly with greentext.
+func (r renderer) text(text string) {
+	depth := 0
+	toks := lex(text)
+
+	for len(toks) > 0 {
+		end := 0
+		for end < len(toks) && toks[end].kind != tokNewline {
+			end++
+		}
+
+		r.line(toks[:end], &depth)
+
+		if end < len(toks) {
+			if r.plain {
+				r.b.WriteString("\n")
+			} else {
+				r.b.WriteString("<br/>")
+			}
+			end++
+		}
+
+		toks = toks[end:]
+	}
+}
+
+func (r renderer) line(toks []token, depth *int) {
+	quote := false
+	if len(toks) > 0 && toks[0].kind == tokText && quoteLine.MatchString(toks[0].text) {
+		// Cites look like greentext but aren't
+		quote = !citeStart.MatchString(strings.TrimSpace(toks[0].text))
+	}
+
+	if quote && !r.plain {
+		r.b.WriteString(`<span class="quote">`)
+	}
+
+	r.spoilers(*depth, true)
+
+	for _, t := range toks {
+		switch t.kind {
+		case tokOpen:
+			r.spoilers(1, true)
+			*depth++
+		case tokClose:
+			r.spoilers(1, false)
+			*depth--
+		default:
+			if r.plain && *depth > 0 {
+				continue
+			}
+
+			r.inline(t.text)
+		}
+	}
+
+	r.spoilers(*depth, false)
+
+	if quote && !r.plain {
+		r.b.WriteString(`</span>`)
+	}
+}
+
+func (r renderer) spoilers(n int, open bool) {
+	if r.plain {
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		if open {
+			r.b.WriteString(`<span class="spoiler">`)
+		} else {
+			r.b.WriteString(`</span>`)
+		}
+	}
+}
+
+// inline renders the inline formatting, cites and links of s.
+func (r renderer) inline(s string) {
+	for i := 0; i < len(s); {
+		rest := s[i:]
+
+		if strings.HasPrefix(rest, ">>") {
+			if m := citeStart.FindString(rest); m != "" {
+				if r.cite != nil && !r.plain {
+					r.b.WriteString(r.cite(m))
+				} else {
+					r.escape(m)
+				}
+
+				i += len(m)
+				continue
+			}
+		}
+
+		if strings.HasPrefix(rest, "http") && (i == 0 || !isWord(s[i-1])) {
+			if m := link(rest); m != "" {
+				if r.plain {
+					r.b.WriteString(m)
+				} else {
+					u := html.EscapeString(m)
+					r.b.WriteString(`<a href="` + u + `" rel="nofollow noopener noreferrer" target="_blank">` + u + `</a>`)
+				}
+
+				i += len(m)
+				continue
+			}
+		}
+
+		if n := r.format(rest); n > 0 {
+			i += n
+			continue
+		}
+
+		r.escape(s[i : i+1])
+		i++
+	}
+}
+
+// format renders the inline formatting at the start of s, if there is any,
+// and returns how much of s it took up.
+func (r renderer) format(s string) int {
+	for _, f := range inline {
+		if !strings.HasPrefix(s, f.delim) {
+			continue
+		}
+
+		end := strings.Index(s[len(f.delim):], f.delim)
+		if end <= 0 {
+			continue
+		}
+
+		inner := s[len(f.delim) : len(f.delim)+end]
+		if inner[0] == ' ' || inner[len(inner)-1] == ' ' {
+			// "2 * 3 * 4" is not italic
+			continue
+		}
+
+		if !r.plain {
+			r.b.WriteString(f.open)
+		}
+
+		r.inline(inner)
+
+		if !r.plain {
+			r.b.WriteString(f.shut)
+		}
+
+		return end + 2*len(f.delim)
+	}
+
+	return 0
+}
+
+func (r renderer) escape(s string) {
+	if r.plain {
+		r.b.WriteString(s)
+	} else {
+		r.b.WriteString(html.EscapeString(s))
+	}
+}
+
+// link returns the URL at the start of s, without any punctuation that
+// probably ends the sentence it's in.
+func link(s string) string {
+	m := strings.TrimRight(urlStart.FindString(s), ".,:;!?)")
+	if u, err := url.Parse(m); err != nil || u.Host == "" {
+		return ""
+	}
+
+	return m
+}
+
+func isWord(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
@@ -0,0 +1,102 @@
+package markup
+
+import (
+	"html"
+	"strings"
+	"testing"
+)
+
+// testCite renders cites the way a board would, more or less.
+func testCite(cite string) string {
+	return `<a class="cite">` + html.EscapeString(cite) + `</a>`
+}
+
+const testLink = `" rel="nofollow noopener noreferrer" target="_blank">`
+
+func TestHTML(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		// Nothing gets out unescaped, wherever it is
+		{"script", "<script>alert(1)</script>", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{"script in bold", "**<script>alert(1)</script>**", "<b>&lt;script&gt;alert(1)&lt;/script&gt;</b>"},
+		{"script in spoiler", "[spoiler]<script>alert(1)</script>[/spoiler]", `<span class="spoiler">&lt;script&gt;alert(1)&lt;/script&gt;</span>`},
+		{"script in code", "[code]<script>alert(1)</script>[/code]", `<pre class="code">&lt;script&gt;alert(1)&lt;/script&gt;</pre>`},
+		{"closing code", "[code]</pre><script>alert(1)</script>[/code]", `<pre class="code">&lt;/pre&gt;&lt;script&gt;alert(1)&lt;/script&gt;</pre>`},
+		{"attribute in italic", `*" onmouseover="alert(1)*`, "<i>&#34; onmouseover=&#34;alert(1)</i>"},
+		{"double quote in link", `http://x/"onmouseover=alert(1)`, `<a href="http://x/` + testLink + `http://x/</a>&#34;onmouseover=alert(1)`},
+		{"single quote in link", `http://x/'onmouseover=alert(1)`, `<a href="http://x/` + testLink + `http://x/</a>&#39;onmouseover=alert(1)`},
+		{"tag in link", "http://x/<script>", `<a href="http://x/` + testLink + `http://x/</a>&lt;script&gt;`},
+		{"link in bold", `**http://x/"onmouseover=alert(1)**`, `<b><a href="http://x/` + testLink + `http://x/</a>&#34;onmouseover=alert(1)</b>`},
+		{"ampersand in link", "[spoiler]http://x/?a=1&b=2[/spoiler]", `<span class="spoiler"><a href="http://x/?a=1&amp;b=2` + testLink + `http://x/?a=1&amp;b=2</a></span>`},
+		{"javascript", "javascript:alert(1)", "javascript:alert(1)"},
+
+		// Formatting
+		{"nested formatting", "**a *b* c**", "<b>a <i>b</i> c</b>"},
+		{"stacked formatting", "~~==a==~~", `<s><span class="redtext">a</span></s>`},
+		{"unbalanced bold", "**bold*", "*<i>bold</i>"},
+		{"spaced asterisks", "2 * 3 * 4", "2 * 3 * 4"},
+		{"bracket in bold", "**a[b**", "<b>a[b</b>"},
+		{"brackets in link", "http://x/a[b]c", `<a href="http://x/a[b]c` + testLink + `http://x/a[b]c</a>`},
+
+		// Spoilers
+		{"nested spoilers", "[spoiler]a[spoiler]b[/spoiler]c[/spoiler]", `<span class="spoiler">a<span class="spoiler">b</span>c</span>`},
+		{"unclosed spoiler", "[spoiler]a", "[spoiler]a"},
+		{"unopened spoiler", "a[/spoiler]", "a[/spoiler]"},
+		{"backwards spoiler", "[/spoiler][spoiler]", "[/spoiler][spoiler]"},
+		{"extra close", "[spoiler]a[/spoiler][/spoiler]", `<span class="spoiler">a</span>[/spoiler]`},
+		{"spoiler in code", "[code]a[spoiler]b[/spoiler][/code]", `<pre class="code">a[spoiler]b[/spoiler]</pre>`},
+		{"unclosed code", "[code]unclosed", "[code]unclosed"},
+
+		// Greentext and spoilers
+		{"greentext in spoiler", "[spoiler]>implying[/spoiler]", `<span class="spoiler">&gt;implying</span>`},
+		{"spoiler in greentext", ">[spoiler]implying[/spoiler]", `<span class="quote">&gt;<span class="spoiler">implying</span></span>`},
+		{"spoiler across greentext", "[spoiler]a\n>b\nc[/spoiler]", `<span class="spoiler">a</span><br/><span class="quote"><span class="spoiler">&gt;b</span></span><br/><span class="spoiler">c</span>`},
+
+		// Cites
+		{"cite", ">>https://example.com/b/ABCDEF", `<a class="cite">&gt;&gt;https://example.com/b/ABCDEF</a>`},
+		{"cite and text", ">>https://example.com/b/ABCDEF reply", `<a class="cite">&gt;&gt;https://example.com/b/ABCDEF</a> reply`},
+		{"cite in spoiler", "[spoiler]>>https://example.com/b/ABCDEF[/spoiler]", `<span class="spoiler"><a class="cite">&gt;&gt;https://example.com/b/ABCDEF</a></span>`},
+		{"greentext link", ">https://example.com/b/ABCDEF", `<span class="quote">&gt;<a href="https://example.com/b/ABCDEF` + testLink + `https://example.com/b/ABCDEF</a></span>`},
+	}
+
+	for _, tt := range tests {
+		got := HTML(tt.in, testCite)
+		if got != tt.want {
+			t.Errorf("%s: HTML(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+
+		if strings.Contains(got, "<script") {
+			t.Errorf("%s: HTML(%q) let a script through: %q", tt.name, tt.in, got)
+		}
+	}
+}
+
+func TestHTMLNoCite(t *testing.T) {
+	in := ">>https://example.com/b/<ABCDEF>"
+	if got, want := HTML(in, nil), "&gt;&gt;https://example.com/b/&lt;ABCDEF&gt;"; got != want {
+		t.Errorf("HTML(%q, nil) = %q, want %q", in, got, want)
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"formatting", "**a *b* c**", "a b c"},
+		{"spoiler", "a [spoiler]secret[/spoiler] b", "a  b"},
+		{"nested spoilers", "[spoiler]a[spoiler]b[/spoiler]c[/spoiler]d", "d"},
+		{"spoiler across lines", "[spoiler]x\ny[/spoiler]z", "\nz"},
+		{"greentext spoiler", ">[spoiler]implying[/spoiler]", ">"},
+		{"unclosed spoiler", "[spoiler]a", "[spoiler]a"},
+		{"cite", ">>https://example.com/b/ABCDEF [spoiler]s[/spoiler]", ">>https://example.com/b/ABCDEF "},
+		{"code", "a\n[code]<b>[/code]\nb", "a\n<b>\nb"},
+		{"link", "http://x/?a=1&b=2", "http://x/?a=1&b=2"},
+	}
+
+	for _, tt := range tests {
+		if got := PlainText(tt.in); got != tt.want {
+			t.Errorf("%s: PlainText(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
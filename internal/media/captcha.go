@@ -0,0 +1,142 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"math/rand"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	captchaWidth   = 200
+	captchaHeight  = 98
+	captchaSize    = 62
+	captchaMinSize = 30
+	captchaMargin  = 24
+)
+
+var captchaFont, _ = opentype.Parse(gobold.TTF)
+
+var (
+	captchaInk   = color.RGBA{0x00, 0x00, 0xff, 0xff}
+	captchaNoise = color.RGBA{0x60, 0x60, 0x60, 0xff}
+)
+
+// captchaPatterns draw the background noise of a captcha.
+// They vaguely imitate the ImageMagick patterns we used to use.
+var captchaPatterns = []func(x, y int) bool{
+	// Vertical bricks
+	func(x, y int) bool {
+		return y%16 == 0 || (x+(y/16%2)*8)%16 == 0
+	},
+
+	// Vertical saw
+	func(x, y int) bool {
+		return (x+y%16)%16 == 0 || (x-y%16)%16 == 0
+	},
+
+	// Cross hatch
+	func(x, y int) bool {
+		return (x+y)%8 == 0 || (x-y+captchaHeight)%8 == 0
+	},
+}
+
+// stripes fills text with diagonal stripes so it can't be picked out by
+// color alone.
+type stripes struct{}
+
+func (stripes) ColorModel() color.Model { return color.RGBAModel }
+func (stripes) Bounds() image.Rectangle { return image.Rect(-1e9, -1e9, 1e9, 1e9) }
+func (stripes) At(x, y int) color.Color {
+	if (x+y*2)%10 < 3 {
+		return color.White
+	}
+	return captchaInk
+}
+
+// Captcha draws solution onto a noisy, distorted background and returns it
+// encoded as a JPEG.
+func Captcha(solution string) ([]byte, error) {
+	var face font.Face
+	var width int
+
+	// Shrink the text until it fits; some letters are much wider than others
+	for size := captchaSize; ; size -= 4 {
+		var err error
+		face, err = opentype.NewFace(captchaFont, &opentype.FaceOptions{
+			Size:    float64(size),
+			DPI:     72,
+			Hinting: font.HintingFull,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		width = font.MeasureString(face, solution).Ceil()
+		if width <= captchaWidth-captchaMargin || size <= captchaMinSize {
+			break
+		}
+
+		face.Close()
+	}
+	defer face.Close()
+
+	canvas := image.NewRGBA(image.Rect(0, 0, captchaWidth, captchaHeight))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+
+	pattern := captchaPatterns[rand.Intn(len(captchaPatterns))]
+	for y := 0; y < captchaHeight; y++ {
+		for x := 0; x < captchaWidth; x++ {
+			if pattern(x, y) {
+				canvas.Set(x, y, captchaNoise)
+			}
+		}
+	}
+
+	d := &font.Drawer{Dst: canvas, Src: stripes{}, Face: face}
+	d.Dot = fixed.P((captchaWidth-width)/2, 70)
+	d.DrawString(solution)
+
+	out := distort(canvas)
+
+	buf := &bytes.Buffer{}
+	err := jpeg.Encode(buf, out, &jpeg.Options{Quality: 75})
+	return buf.Bytes(), err
+}
+
+// distort rotates an image by a small random angle and runs it through a pair
+// of sine waves.
+func distort(src *image.RGBA) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.White, image.Point{}, draw.Src)
+
+	theta := float64(rand.Intn(12)) * math.Pi / 180
+	sin, cos := math.Sin(theta), math.Cos(theta)
+	cx, cy := float64(b.Dx())/2, float64(b.Dy())/2
+	phase := rand.Float64() * 2 * math.Pi
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			fx := float64(x) - cx + 2*math.Sin(float64(y)/35*2*math.Pi+phase)
+			fy := float64(y) - cy + 5*math.Sin(float64(x)/35*2*math.Pi+phase)
+
+			sx := int(fx*cos + fy*sin + cx)
+			sy := int(-fx*sin + fy*cos + cy)
+
+			if image.Pt(sx, sy).In(b) {
+				dst.SetRGBA(x, y, src.RGBAAt(sx, sy))
+			}
+		}
+	}
+
+	return dst
+}
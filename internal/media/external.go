@@ -0,0 +1,35 @@
+package media
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// These wrap the tools Fedichan used to depend on.
+// They are only used for files the Go pipeline returns ErrUnsupported for,
+// and only if they are installed.
+
+// HasTool reports whether an external program is available in $PATH.
+func HasTool(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+func runTool(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// ExternalStrip removes metadata from the file at path in place using exiv2.
+func ExternalStrip(path string) error {
+	return runTool("exiv2", "rm", path)
+}
+
+// ExternalThumbnail writes a thumbnail of src to dst using ImageMagick.
+// The format of dst is determined by its extension.
+func ExternalThumbnail(src, dst string, maxW, maxH int) error {
+	// The trailing [0] selects the first frame of animations
+	return runTool("convert", src+"[0]", "-resize", fmt.Sprintf("%dx%d>", maxW, maxH), "-strip", dst)
+}
@@ -0,0 +1,172 @@
+// media is a package implementing Fedichan's image pipeline.
+//
+// Uploaded images are validated, stripped of metadata, hashed, and
+// thumbnailed here without shelling out to anything.
+// The external tools that used to do this job are still available as
+// fallbacks for files Go cannot handle; see external.go.
+package media
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+
+	// Decoders for image.DecodeConfig and image.Decode
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	// ErrUnsupported is returned when a file is in a format the pipeline
+	// does not handle, or uses a feature of one that the decoders do not
+	// implement.
+	ErrUnsupported = errors.New("unsupported image format")
+
+	// ErrDimensions is returned when an image is larger than the limits
+	// allow.
+	ErrDimensions = errors.New("image dimensions exceed limits")
+
+	// ErrMismatch is returned when the contents of a file do not match the
+	// media type it was sent with.
+	ErrMismatch = errors.New("image contents do not match media type")
+
+	// ErrCorrupt is returned when an image's container cannot be parsed.
+	ErrCorrupt = errors.New("corrupt image")
+)
+
+// Limits bound what the pipeline is willing to decode.
+// A zero value for any field disables that check.
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+
+	// MaxPixels caps width*height.
+	// Image headers are read before anything is decoded, so a small file
+	// claiming an enormous canvas is rejected without allocating it.
+	MaxPixels int
+}
+
+// Info describes a processed image.
+type Info struct {
+	MediaType string
+	Width     int
+	Height    int
+
+	// Hash is the hex encoded SHA-256 of the sanitized file.
+	Hash string
+}
+
+// formats maps the media types we handle to the names the image package
+// registers their decoders under.
+var formats = map[string]string{
+	"image/gif":  "gif",
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/apng": "png",
+	"image/webp": "webp",
+}
+
+// Supported reports whether mediaType is handled by the pipeline.
+func Supported(mediaType string) bool {
+	_, ok := formats[mediaType]
+	return ok
+}
+
+// Hash returns the hex encoded SHA-256 of data.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Check reads the header of an image and makes sure it fits within lim.
+func Check(data []byte, mediaType string, lim Limits) (image.Config, error) {
+	want, ok := formats[mediaType]
+	if !ok {
+		return image.Config{}, ErrUnsupported
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return cfg, ErrMismatch
+	} else if err != nil {
+		return cfg, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	} else if format != want {
+		return cfg, ErrMismatch
+	}
+
+	if cfg.Width <= 0 || cfg.Height <= 0 ||
+		(lim.MaxWidth > 0 && cfg.Width > lim.MaxWidth) ||
+		(lim.MaxHeight > 0 && cfg.Height > lim.MaxHeight) ||
+		(lim.MaxPixels > 0 && cfg.Width*cfg.Height > lim.MaxPixels) {
+		return cfg, ErrDimensions
+	}
+
+	return cfg, nil
+}
+
+// Sanitize validates an image against lim and returns a copy of it with all
+// metadata removed.
+//
+// Stripping is done on the container and the image data itself is left
+// untouched, so there is no loss in quality.
+// Anything trailing the end of the image is discarded as well.
+func Sanitize(data []byte, mediaType string, lim Limits) ([]byte, Info, error) {
+	info := Info{MediaType: mediaType}
+
+	cfg, err := Check(data, mediaType, lim)
+	if err != nil {
+		return nil, info, err
+	}
+
+	info.Width, info.Height = cfg.Width, cfg.Height
+
+	var out []byte
+	switch formats[mediaType] {
+	case "jpeg":
+		out, err = stripJPEG(data)
+	case "png":
+		out, err = stripPNG(data)
+	case "gif":
+		out, err = stripGIF(data)
+	case "webp":
+		out, err = stripWebP(data)
+	}
+
+	if err != nil {
+		return nil, info, err
+	}
+
+	info.Hash = Hash(out)
+	return out, info, nil
+}
+
+// extensions maps the media types Fedichan accepts to the extension files of
+// that type are stored with.
+var extensions = map[string]string{
+	"image/gif":   ".gif",
+	"image/jpeg":  ".jpg",
+	"image/png":   ".png",
+	"image/apng":  ".png",
+	"image/webp":  ".webp",
+	"video/mp4":   ".mp4",
+	"video/ogg":   ".ogv",
+	"video/webm":  ".webm",
+	"audio/mpeg":  ".mp3",
+	"audio/ogg":   ".ogg",
+	"audio/wav":   ".wav",
+	"audio/wave":  ".wav",
+	"audio/x-wav": ".wav",
+}
+
+// Extension returns the file extension, including the leading dot, used for
+// files of mediaType.
+// Unknown types get no extension.
+func Extension(mediaType string) string {
+	return extensions[mediaType]
+}
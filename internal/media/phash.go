@@ -0,0 +1,54 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math/bits"
+
+	"golang.org/x/image/draw"
+)
+
+// PerceptualHash computes the difference hash (dHash) of an image.
+//
+// The image is shrunk to 9x8 pixels in grayscale, and each bit records whether
+// a pixel is brighter than its neighbour to the right.
+// Re-encoding, resizing and small edits leave most bits alone, so similar
+// images have hashes that are a small Distance apart.
+func PerceptualHash(data []byte, mediaType string, lim Limits) (uint64, error) {
+	if _, err := Check(data, mediaType, lim); err != nil {
+		return 0, err
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	// Scale in color first; transparent pixels would otherwise come out
+	// black regardless of what the image shows.
+	small := image.NewRGBA(image.Rect(0, 0, 9, 8))
+	draw.Draw(small, small.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.BiLinear.Scale(small, small.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	gray := image.NewGray(small.Bounds())
+	draw.Draw(gray, gray.Bounds(), small, image.Point{}, draw.Src)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray.GrayAt(x, y).Y > gray.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash, nil
+}
+
+// Distance returns the number of bits that differ between two perceptual
+// hashes.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
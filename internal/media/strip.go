@@ -0,0 +1,321 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// JPEG markers we care about.
+const (
+	jpegSOI  = 0xD8
+	jpegEOI  = 0xD9
+	jpegSOS  = 0xDA
+	jpegRST0 = 0xD0
+	jpegRST7 = 0xD7
+	jpegTEM  = 0x01
+	jpegAPP0 = 0xE0
+	jpegAPP2 = 0xE2
+	jpegAPPE = 0xEE
+	jpegAPPF = 0xEF
+	jpegCOM  = 0xFE
+)
+
+// keepJPEGSegment decides if a marker segment survives stripping.
+// APP segments are where EXIF, XMP, IPTC and friends live, but a few of them
+// are needed to decode the image correctly.
+func keepJPEGSegment(marker byte, seg []byte) bool {
+	switch {
+	case marker == jpegAPP0:
+		return bytes.HasPrefix(seg, []byte("JFIF\x00"))
+	case marker == jpegAPP2:
+		// Color profile
+		return bytes.HasPrefix(seg, []byte("ICC_PROFILE\x00"))
+	case marker == jpegAPPE:
+		// Needed for CMYK images
+		return bytes.HasPrefix(seg, []byte("Adobe"))
+	case marker > jpegAPP0 && marker <= jpegAPPF, marker == jpegCOM:
+		return false
+	}
+
+	return true
+}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return nil, ErrCorrupt
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, jpegSOI)
+
+	for i := 2; ; {
+		// Some encoders leave junk between segments; skip it like the
+		// decoders do.
+		for i < len(data) && data[i] != 0xFF {
+			i++
+		}
+
+		// Markers may be padded with any number of fill bytes
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+
+		if i >= len(data) {
+			return nil, ErrCorrupt
+		}
+
+		marker := data[i]
+		i++
+
+		if marker == jpegEOI {
+			// Drop anything that was appended to the image
+			return append(out, 0xFF, jpegEOI), nil
+		} else if (marker >= jpegRST0 && marker <= jpegRST7) || marker == jpegTEM {
+			out = append(out, 0xFF, marker)
+			continue
+		}
+
+		if i+2 > len(data) {
+			return nil, ErrCorrupt
+		}
+
+		n := int(binary.BigEndian.Uint16(data[i:]))
+		if n < 2 || i+n > len(data) {
+			return nil, ErrCorrupt
+		}
+
+		if keepJPEGSegment(marker, data[i+2:i+n]) {
+			out = append(out, 0xFF, marker)
+			out = append(out, data[i:i+n]...)
+		}
+
+		i += n
+
+		if marker != jpegSOS {
+			continue
+		}
+
+		// Entropy coded data follows a scan header.
+		// Within it, 0xFF is always followed by a zero byte or a restart
+		// marker; anything else is the next marker.
+		j := i
+		for ; j+1 < len(data); j++ {
+			if data[j] != 0xFF {
+				continue
+			}
+
+			if m := data[j+1]; m != 0x00 && (m < jpegRST0 || m > jpegRST7) {
+				break
+			}
+		}
+
+		if j+1 >= len(data) {
+			// Truncated image.
+			// Browsers will show what is there, so we do the same.
+			out = append(out, data[i:]...)
+			return append(out, 0xFF, jpegEOI), nil
+		}
+
+		out = append(out, data[i:j]...)
+		i = j
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngKeep lists the ancillary chunks that affect how an image is displayed.
+// Everything else, such as text chunks, EXIF and timestamps, is dropped.
+var pngKeep = map[string]bool{
+	"tRNS": true,
+	"gAMA": true,
+	"cHRM": true,
+	"sRGB": true,
+	"iCCP": true,
+	"sBIT": true,
+	"bKGD": true,
+
+	// APNG
+	"acTL": true,
+	"fcTL": true,
+	"fdAT": true,
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrCorrupt
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+
+	for i := len(pngSignature); ; {
+		if i+8 > len(data) {
+			return nil, ErrCorrupt
+		}
+
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		end := i + 8 + n + 4 // length, type, data, CRC
+
+		if n < 0 || end > len(data) || end < i {
+			return nil, ErrCorrupt
+		}
+
+		// Critical chunks start with an uppercase letter
+		if typ[0]&0x20 == 0 || pngKeep[typ] {
+			out = append(out, data[i:end]...)
+		}
+
+		if typ == "IEND" {
+			return out, nil
+		}
+
+		i = end
+	}
+}
+
+// skipGIFSubBlocks returns the offset just past a run of GIF data sub-blocks
+// starting at i.
+func skipGIFSubBlocks(data []byte, i int) (int, error) {
+	for {
+		if i >= len(data) {
+			return 0, ErrCorrupt
+		}
+
+		n := int(data[i])
+		i++
+
+		if n == 0 {
+			return i, nil
+		}
+
+		i += n
+	}
+}
+
+func stripGIF(data []byte) ([]byte, error) {
+	if len(data) < 13 || !(bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))) {
+		return nil, ErrCorrupt
+	}
+
+	// Header, logical screen descriptor and global color table
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << ((flags & 0x07) + 1)
+	}
+
+	if i > len(data) {
+		return nil, ErrCorrupt
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:i]...)
+
+	for {
+		if i >= len(data) {
+			return nil, ErrCorrupt
+		}
+
+		start := i
+
+		switch data[i] {
+		case 0x21: // Extension
+			if i+2 > len(data) {
+				return nil, ErrCorrupt
+			}
+
+			label := data[i+1]
+			end, err := skipGIFSubBlocks(data, i+2)
+			if err != nil {
+				return nil, err
+			}
+
+			keep := label == 0xF9 || label == 0x01 // Graphic control, plain text
+			if label == 0xFF && i+14 <= len(data) {
+				// Application extensions carry XMP among other things, but
+				// looping information lives in one too.
+				app := string(data[i+3 : i+14])
+				keep = app == "NETSCAPE2.0" || app == "ANIMEXTS1.0"
+			}
+
+			if keep {
+				out = append(out, data[start:end]...)
+			}
+
+			i = end
+		case 0x2C: // Image descriptor
+			if i+10 > len(data) {
+				return nil, ErrCorrupt
+			}
+
+			j := i + 10
+			if flags := data[i+9]; flags&0x80 != 0 {
+				j += 3 << ((flags & 0x07) + 1)
+			}
+
+			// LZW minimum code size, then the image data
+			end, err := skipGIFSubBlocks(data, j+1)
+			if err != nil {
+				return nil, err
+			}
+
+			out = append(out, data[start:end]...)
+			i = end
+		case 0x3B: // Trailer
+			return append(out, 0x3B), nil
+		default:
+			return nil, ErrCorrupt
+		}
+	}
+}
+
+// VP8X flags
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrCorrupt
+	}
+
+	size := int(binary.LittleEndian.Uint32(data[4:])) + 8
+	if size > len(data) || size < 12 {
+		return nil, ErrCorrupt
+	}
+
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+
+	for i := 12; i < size; {
+		if i+8 > size {
+			return nil, ErrCorrupt
+		}
+
+		typ := string(data[i : i+4])
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + n + n&1 // Chunks are padded to an even size
+
+		if n < 0 || end > size || end < i {
+			return nil, ErrCorrupt
+		}
+
+		switch typ {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[i:end]...)
+			if n > 0 {
+				chunk[8] &^= webpFlagEXIF | webpFlagXMP
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[i:end]...)
+		}
+
+		i = end
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
@@ -0,0 +1,71 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+)
+
+const thumbQuality = 85
+
+// fit scales w and h down to fit within maxW by maxH, keeping the aspect
+// ratio.
+// Images that already fit are left alone.
+func fit(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+
+	if w*maxH > h*maxW {
+		h = h * maxW / w
+		w = maxW
+	} else {
+		w = w * maxH / h
+		h = maxH
+	}
+
+	if w < 1 {
+		w = 1
+	}
+
+	if h < 1 {
+		h = 1
+	}
+
+	return w, h
+}
+
+// Thumbnail decodes an image and scales it to fit within maxW by maxH.
+//
+// Opaque images are encoded as JPEG and those with transparency as PNG; the
+// media type of the thumbnail is returned alongside it.
+// Only the first frame of an animation is used.
+func Thumbnail(data []byte, mediaType string, lim Limits, maxW, maxH int) ([]byte, string, error) {
+	if _, err := Check(data, mediaType, lim); err != nil {
+		return nil, "", err
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	b := src.Bounds()
+	w, h := fit(b.Dx(), b.Dy(), maxW, maxH)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+
+	buf := &bytes.Buffer{}
+	if dst.Opaque() {
+		err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: thumbQuality})
+		return buf.Bytes(), "image/jpeg", err
+	}
+
+	err = png.Encode(buf, dst)
+	return buf.Bytes(), "image/png", err
+}
@@ -0,0 +1,78 @@
+// Package ratelimit implements token buckets, one for each thing being
+// limited.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter hands out tokens at Rate per second to each key, letting up to
+// Burst of them build up.
+type Limiter struct {
+	Rate  float64
+	Burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter allowing perMinute requests a minute to each key,
+// with bursts of up to burst requests.
+func New(perMinute, burst int) *Limiter {
+	return &Limiter{
+		Rate:    float64(perMinute) / 60,
+		Burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > l.Burst {
+		b.tokens = l.Burst
+	}
+
+	b.last = now
+}
+
+// Allow takes a token from the bucket of key, reporting whether there was one
+// to take.
+func (l *Limiter) Allow(key string) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Full buckets are the same as no bucket, so forget them every so often
+	if now.Sub(l.swept) > time.Minute {
+		for k, b := range l.buckets {
+			if l.refill(b, now); b.tokens >= l.Burst {
+				delete(l.buckets, k)
+			}
+		}
+
+		l.swept = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.Burst, last: now}
+		l.buckets[key] = b
+	}
+
+	l.refill(b, now)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Local keeps media in a directory on disk, served by Fedichan itself.
+type Local struct {
+	Dir     string
+	BaseURL string
+}
+
+func (l *Local) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", errors.New("invalid key")
+	}
+
+	return filepath.Join(l.Dir, key), nil
+}
+
+func (l *Local) Put(key string, data []byte, _ string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so nobody sees half a file
+	f, err := os.CreateTemp(l.Dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (l *Local) Get(key string) ([]byte, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+
+	return data, err
+}
+
+func (l *Local) Delete(key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (l *Local) Exists(key string) (bool, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (l *Local) URL(key string) string {
+	return l.BaseURL + "/" + key
+}
+
+func (l *Local) Key(url string) (string, bool) {
+	key := strings.TrimPrefix(url, l.BaseURL+"/")
+	if key == url || !validKey(key) {
+		return "", false
+	}
+
+	return key, true
+}
+
+func (l *Local) List() ([]Object, error) {
+	entries, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	objs := make([]Object, 0, len(entries))
+	for _, e := range entries {
+		// Skip uploads in progress
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		info, err := e.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		objs = append(objs, Object{Key: e.Name(), Modified: info.ModTime()})
+	}
+
+	return objs, nil
+}
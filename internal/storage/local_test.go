@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testStore puts a few files in store and checks they come back out.
+func testStore(t *testing.T, store MediaStore) {
+	t.Helper()
+
+	files := map[string][]byte{
+		"a.png": []byte("not really a png"),
+		"b.jpg": []byte("nor a jpeg"),
+		"c.txt": {},
+	}
+
+	for key, data := range files {
+		if err := store.Put(key, data, "application/octet-stream"); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+
+	for key, data := range files {
+		got, err := store.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("Get(%q) = %q, want %q", key, got, data)
+		}
+
+		if ok, err := store.Exists(key); err != nil || !ok {
+			t.Errorf("Exists(%q) = %v, %v, want true", key, ok, err)
+		}
+
+		if got, ok := store.Key(store.URL(key)); !ok || got != key {
+			t.Errorf("Key(URL(%q)) = %q, %v", key, got, ok)
+		}
+	}
+
+	objs, err := store.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+
+	var keys []string
+	for _, o := range objs {
+		keys = append(keys, o.Key)
+	}
+	sort.Strings(keys)
+
+	if want := []string{"a.png", "b.jpg", "c.txt"}; len(keys) != len(want) || keys[0] != want[0] || keys[1] != want[1] || keys[2] != want[2] {
+		t.Errorf("List = %q, want %q", keys, want)
+	}
+
+	if err := store.Delete("a.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	// Deleting twice is fine
+	if err := store.Delete("a.png"); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+
+	if ok, err := store.Exists("a.png"); err != nil || ok {
+		t.Errorf("Exists after Delete = %v, %v, want false", ok, err)
+	}
+
+	if _, err := store.Get("a.png"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Get after Delete: %v, want ErrNotExist", err)
+	}
+
+	for _, key := range []string{"", "..", "../a.png", "a/b.png"} {
+		if err := store.Put(key, nil, ""); err == nil {
+			t.Errorf("Put(%q) was let through", key)
+		}
+	}
+
+	if _, ok := store.Key("https://elsewhere.example/a.png"); ok {
+		t.Error("Key accepted a URL outside the store")
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	store := &Local{Dir: dir, BaseURL: "https://example.com/public"}
+
+	// Uploads in progress aren't listed
+	if err := os.WriteFile(filepath.Join(dir, ".upload-123"), []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testStore(t, store)
+
+	if got := store.URL("a.png"); got != "https://example.com/public/a.png" {
+		t.Errorf("URL = %q", got)
+	}
+}
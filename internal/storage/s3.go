@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 keeps media in a bucket of an S3 compatible object store, such as AWS,
+// MinIO or Garage.
+//
+// Requests use path-style addressing (endpoint/bucket/key) and are signed
+// with AWS Signature Version 4.
+// The bucket must allow anonymous reads, or PublicURL must point to
+// something that serves its contents, like a CDN.
+type S3 struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PublicURL string
+
+	Client *http.Client
+}
+
+const s3Algorithm = "AWS4-HMAC-SHA256"
+
+// s3Escape escapes a string the way AWS expects in canonical requests.
+// This differs from url.QueryEscape in that spaces are %20, not +.
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', path && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Query encodes query parameters in the canonical form.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// sign adds the headers needed to authenticate req to it.
+// The query string of req must already be in canonical form.
+func (s *S3) sign(req *http.Request, payload []byte) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signed := "host;x-amz-content-sha256;x-amz-date"
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		req.URL.RawQuery,
+		headers,
+		signed,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	toSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonical)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// do performs a signed request against the bucket.
+// The caller is responsible for closing the body of the response.
+func (s *S3) do(method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	target := s.Endpoint + "/" + s.Bucket
+	if key != "" {
+		target += "/" + key
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	s.sign(req, body)
+	return s.Client.Do(req)
+}
+
+// s3Error turns an unexpected response into an error.
+func s3Error(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+func (s *S3) Put(key string, data []byte, mediaType string) error {
+	if !validKey(key) {
+		return errors.New("invalid key")
+	}
+
+	header := http.Header{}
+	if mediaType != "" {
+		header.Set("Content-Type", mediaType)
+	}
+
+	resp, err := s.do(http.MethodPut, key, nil, data, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+
+	return nil
+}
+
+func (s *S3) Get(key string) ([]byte, error) {
+	if !validKey(key) {
+		return nil, errors.New("invalid key")
+	}
+
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3) Delete(key string) error {
+	if !validKey(key) {
+		return errors.New("invalid key")
+	}
+
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 says 204 whether or not the key existed
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+
+	return nil
+}
+
+func (s *S3) Exists(key string) (bool, error) {
+	if !validKey(key) {
+		return false, errors.New("invalid key")
+	}
+
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, s3Error(resp)
+}
+
+func (s *S3) URL(key string) string {
+	return s.PublicURL + "/" + key
+}
+
+func (s *S3) Key(url string) (string, bool) {
+	key := strings.TrimPrefix(url, s.PublicURL+"/")
+	if key == url || !validKey(key) {
+		return "", false
+	}
+
+	return key, true
+}
+
+// s3List is the response to ListObjectsV2.
+type s3List struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+	}
+}
+
+func (s *S3) List() ([]Object, error) {
+	var objs []Object
+
+	query := url.Values{"list-type": {"2"}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var list s3List
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range list.Contents {
+			objs = append(objs, Object{Key: c.Key, Modified: c.LastModified})
+		}
+
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return objs, nil
+		}
+
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+}
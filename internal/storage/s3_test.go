@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is just enough of an S3 bucket to test against.
+// Requests that aren't signed with its keys are turned away, and why is kept
+// in rejected.
+type fakeS3 struct {
+	bucket, region       string
+	accessKey, secretKey string
+
+	// pageSize is how many keys are listed at a time, so that listing has
+	// to follow continuation tokens.
+	pageSize int
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	types    map[string]string
+	rejected []error
+}
+
+// verify checks the signature of r the way S3 does, returning why it is
+// wrong if it is.
+func (f *fakeS3) verify(r *http.Request, body []byte) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, s3Algorithm+" ") {
+		return fmt.Errorf("not signed: %q", auth)
+	}
+
+	fields := make(map[string]string)
+	for _, kv := range strings.Split(strings.TrimPrefix(auth, s3Algorithm+" "), ", ") {
+		k, v, _ := strings.Cut(kv, "=")
+		fields[k] = v
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	date, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return fmt.Errorf("bad X-Amz-Date %q", amzDate)
+	} else if d := time.Since(date); d > 15*time.Minute || d < -15*time.Minute {
+		return fmt.Errorf("X-Amz-Date %q is too far off", amzDate)
+	}
+
+	scope := date.Format("20060102") + "/" + f.region + "/s3/aws4_request"
+	if want := f.accessKey + "/" + scope; fields["Credential"] != want {
+		return fmt.Errorf("credential %q, want %q", fields["Credential"], want)
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != sha256Hex(body) {
+		return fmt.Errorf("payload hash %q doesn't match the body", payloadHash)
+	}
+
+	var headers strings.Builder
+	for _, h := range strings.Split(fields["SignedHeaders"], ";") {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+
+		fmt.Fprintf(&headers, "%s:%s\n", h, strings.TrimSpace(v))
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		headers.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+
+	toSign := strings.Join([]string{s3Algorithm, amzDate, scope, sha256Hex([]byte(canonical))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+f.secretKey), date.Format("20060102"))
+	key = hmacSHA256(key, f.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	if want := hex.EncodeToString(hmacSHA256(key, toSign)); fields["Signature"] != want {
+		return fmt.Errorf("signature %q, want %q", fields["Signature"], want)
+	}
+
+	return nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.verify(r, body); err != nil {
+		f.rejected = append(f.rejected, fmt.Errorf("%s %s: %w", r.Method, r.URL, err))
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		f.types[key] = r.Header.Get("Content-Type")
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", f.types[key])
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("list-type") != "2" {
+		http.Error(w, "only ListObjectsV2 is supported", http.StatusBadRequest)
+		return
+	}
+
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// The continuation token is simply the last key of the previous page
+	after := r.URL.Query().Get("continuation-token")
+	start := sort.SearchStrings(keys, after)
+	if after != "" && start < len(keys) && keys[start] == after {
+		start++
+	}
+
+	var resp struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []struct {
+			Key          string
+			LastModified time.Time
+		}
+	}
+
+	for _, k := range keys[start:] {
+		if len(resp.Contents) == f.pageSize {
+			resp.IsTruncated = true
+			resp.NextContinuationToken = resp.Contents[len(resp.Contents)-1].Key
+			break
+		}
+
+		resp.Contents = append(resp.Contents, struct {
+			Key          string
+			LastModified time.Time
+		}{k, time.Now().UTC()})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(resp)
+}
+
+func TestS3(t *testing.T) {
+	fake := &fakeS3{
+		bucket:    "media",
+		region:    "us-east-1",
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		pageSize:  2,
+		objects:   make(map[string][]byte),
+		types:     make(map[string]string),
+	}
+
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	store := &S3{
+		Endpoint:  srv.URL,
+		Region:    fake.region,
+		Bucket:    fake.bucket,
+		AccessKey: fake.accessKey,
+		SecretKey: fake.secretKey,
+		PublicURL: "https://cdn.example.com",
+		Client:    srv.Client(),
+	}
+
+	testStore(t, store)
+
+	for _, err := range fake.rejected {
+		t.Error(err)
+	}
+
+	if got := fake.types["b.jpg"]; got != "application/octet-stream" {
+		t.Errorf("stored with Content-Type %q", got)
+	}
+
+	if got := store.URL("b.jpg"); got != "https://cdn.example.com/b.jpg" {
+		t.Errorf("URL = %q", got)
+	}
+}
+
+func TestS3BadKey(t *testing.T) {
+	fake := &fakeS3{
+		bucket:    "media",
+		region:    "us-east-1",
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "right",
+		objects:   make(map[string][]byte),
+		types:     make(map[string]string),
+	}
+
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	store := &S3{
+		Endpoint:  srv.URL,
+		Region:    fake.region,
+		Bucket:    fake.bucket,
+		AccessKey: fake.accessKey,
+		SecretKey: "wrong",
+		Client:    srv.Client(),
+	}
+
+	if err := store.Put("a.png", []byte("data"), "image/png"); err == nil {
+		t.Error("Put signed with the wrong secret key succeeded")
+	}
+
+	if len(fake.objects) != 0 || len(fake.rejected) != 1 {
+		t.Errorf("Put signed with the wrong secret key wasn't turned away: %v", fake.rejected)
+	}
+}
@@ -0,0 +1,93 @@
+// storage is a package abstracting away where uploaded media is kept.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+)
+
+// ErrNotExist is returned by Get when a key is not in the store.
+var ErrNotExist = errors.New("media does not exist")
+
+// Object describes something kept in a MediaStore.
+type Object struct {
+	Key      string
+	Modified time.Time
+}
+
+// MediaStore is somewhere uploaded media can be kept.
+//
+// Keys are flat file names; Fedichan uses the SHA-256 of the file followed by
+// an extension.
+type MediaStore interface {
+	// Put stores data under key, replacing anything already there.
+	Put(key string, data []byte, mediaType string) error
+
+	// Get returns the data stored under key.
+	Get(key string) ([]byte, error)
+
+	// Delete removes key from the store.
+	// Deleting a key that doesn't exist is not an error.
+	Delete(key string) error
+
+	// Exists reports whether key is in the store.
+	Exists(key string) (bool, error)
+
+	// URL returns the public URL of key.
+	URL(key string) string
+
+	// Key is the inverse of URL.
+	// ok is false if url does not point into this store.
+	Key(url string) (key string, ok bool)
+
+	// List returns everything in the store.
+	List() ([]Object, error)
+}
+
+// Default is the store used for all media.
+// It is set by Open.
+var Default MediaStore
+
+// Open sets Default to the store described by the configuration file.
+func Open() error {
+	switch config.MediaStore {
+	case "", "local":
+		Default = &Local{
+			Dir:     "./public",
+			BaseURL: config.Domain + "/public",
+		}
+	case "s3":
+		if config.S3Bucket == "" || config.S3Endpoint == "" {
+			return errors.New("s3 media store requires s3endpoint and s3bucket")
+		}
+
+		publicURL := config.S3PublicURL
+		if publicURL == "" {
+			publicURL = strings.TrimSuffix(config.S3Endpoint, "/") + "/" + config.S3Bucket
+		}
+
+		Default = &S3{
+			Endpoint:  strings.TrimSuffix(config.S3Endpoint, "/"),
+			Region:    config.S3Region,
+			Bucket:    config.S3Bucket,
+			AccessKey: config.S3AccessKey,
+			SecretKey: config.S3SecretKey,
+			PublicURL: strings.TrimSuffix(publicURL, "/"),
+			Client:    &http.Client{Timeout: 30 * time.Second},
+		}
+	default:
+		return fmt.Errorf("unknown media store %q", config.MediaStore)
+	}
+
+	return nil
+}
+
+// validKey makes sure a key can't be used to escape the store.
+func validKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, "/\\")
+}
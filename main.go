@@ -3,12 +3,15 @@ package main
 import (
 	"log"
 	"math/rand"
+	"net"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/config"
 	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/internal/storage"
 	"github.com/KushBlazingJudah/fedichan/routes"
 	"github.com/KushBlazingJudah/fedichan/util"
 	"github.com/gofiber/fiber/v2"
@@ -18,6 +21,16 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		gc(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		bench(os.Args[2:])
+		return
+	}
+
 	Init()
 
 	defer db.Close()
@@ -74,7 +87,7 @@ func main() {
 
 	// Main actor
 	app.Get("/", routes.Index)
-	app.Post("/inbox", routes.Inbox)
+	app.Post("/inbox", routes.InboxLimit, routes.Inbox)
 	app.Post("/outbox", routes.Outbox)
 	app.Get("/following", routes.Following)
 	app.Get("/followers", routes.Followers)
@@ -92,16 +105,32 @@ func main() {
 	app.Post("/"+config.Key+"/chpasswd", routes.AdminChangePasswd)
 	app.Post("/"+config.Key+"/blotter", routes.AdminSetBlotter)
 	app.Post("/"+config.Key+"/lock", routes.AdminSetLocked)
+	app.Post("/"+config.Key+"/flood", routes.AdminSetFloodLimits)
+	app.Post("/"+config.Key+"/threadlimits", routes.AdminSetThreadLimits)
+	app.Post("/"+config.Key+"/spoilerimage", routes.AdminSetSpoilerImage)
+	app.Post("/"+config.Key+"/posterids", routes.AdminSetPosterIDs)
+	app.All("/"+config.Key+"/mediabans", routes.AdminMediaBans)
+	app.All("/"+config.Key+"/bans", routes.AdminBans)
 	app.Post("/"+config.Key+"/:actor/editsummary", routes.AdminEditSummary)
 	app.All("/"+config.Key+"/:actor/follow", routes.AdminFollow)
 	app.Get("/"+config.Key+"/:actor", routes.AdminActorIndex)
 
 	// News routes
+	app.Get("/news/feed.:format", routes.NewsFeed)
 	app.Get("/news/:ts", routes.NewsGet)
 	app.Get("/news", routes.NewsGetAll)
 
+	// Search routes
+	app.Get("/search", routes.Search)
+
+	// Overboard routes
+	app.Get("/overboard", routes.Overboard)
+	app.Post("/overboard", routes.OverboardSettings)
+	app.Get("/overboard/catalog", routes.OverboardCatalog)
+
 	// Board managment
 	app.Get("/banmedia", routes.BoardBanMedia)
+	app.Get("/ban", routes.BoardBan)
 	app.Get("/delete", routes.BoardDelete)
 	app.Get("/deleteattach", routes.BoardDeleteAttach)
 	app.Get("/marksensitive", routes.BoardMarkSensitive)
@@ -111,30 +140,63 @@ func main() {
 	app.All("/blacklist", routes.BoardBlacklist)
 	app.All("/report", routes.ReportPost)
 	app.Get("/make-report", routes.ReportGet)
+	app.Post("/deletepost", routes.PosterDelete)
+	app.Get("/deletepost", routes.PosterDeleteGet)
+	app.Post("/appeal", routes.BanAppeal)
+	app.Post("/vote", routes.PollVote)
 	app.Get("/sticky", routes.Sticky)
 	app.Get("/lock", routes.Lock)
+	app.Get("/autosage", routes.Autosage)
+	app.Get("/cyclical", routes.Cyclical)
 
 	// Webfinger routes
 	app.Get("/.well-known/webfinger", routes.Webfinger)
 
 	// API routes
 	app.Get("/api/media", routes.Media)
+	app.Get("/api/captcha", routes.Captcha)
+	app.Get("/api/search", routes.SearchAPI)
+
+	// 4chan API routes
+	app.Get("/boards.json", routes.ChanBoards)
+	app.Get("/:actor/threads.json", routes.ChanThreads)
+	app.Get("/:actor/catalog.json", routes.ChanCatalog)
+	app.Get("/:actor/archive.json", routes.ChanArchive)
+	app.Get("/:actor/thread/:post.json", routes.ChanThread)
 
 	// Board actor routes
 	app.Post("/post", routes.MakeActorPost)
 	app.Get("/:actor/catalog", routes.ActorCatalog)
-	app.Post("/:actor/inbox", routes.ActorInbox)
+	app.Post("/:actor/inbox", routes.InboxLimit, routes.ActorInbox)
 	app.Get("/:actor/outbox", routes.GetActorOutbox)
 	app.Get("/:actor/following", routes.ActorFollowing)
 	app.Get("/:actor/followers", routes.ActorFollowers)
 	app.Get("/:actor/archive", routes.ActorArchive)
+	app.Get("/:actor/events", routes.BoardEvents)
+	app.Get("/:actor/feed.:format", routes.BoardFeed)
 	app.Get("/:actor", routes.ActorPosts)
 	app.Get("/:actor/:post", routes.ActorPost)
+	app.Get("/:actor/:post/events", routes.ThreadEvents)
+	app.Get("/:actor/:post/feed.:format", routes.ThreadFeed)
 
 	if err := db.PrintAdminAuth(); err != nil {
 		panic(err)
 	}
 
+	if config.OnionListen != "" {
+		ln, err := net.Listen("tcp", config.OnionListen)
+		if err != nil {
+			panic(err)
+		}
+
+		// Onion visitors are told apart by the listener they came in on,
+		// so they have one of their own
+		app.Hooks().OnListen(func() error {
+			go app.Server().Serve(ln)
+			return nil
+		})
+	}
+
 	app.Listen(config.Port)
 }
 
@@ -148,6 +210,10 @@ func Init() {
 		log.Fatal(err)
 	}
 
+	if err = storage.Open(); err != nil {
+		log.Fatal(err)
+	}
+
 	if err = db.Connect(); err != nil {
 		log.Fatal(err)
 	}
@@ -180,6 +246,14 @@ func Init() {
 
 	go activitypub.StartupArchive()
 
+	if config.GCInterval > 0 {
+		go db.RunGC(time.Duration(config.GCInterval) * time.Hour)
+	}
+
+	if config.IdentityRetention > 0 {
+		go db.RunIdentityPurge(time.Hour)
+	}
+
 	go func() {
 		if err := db.MakeCaptchas(); err != nil {
 			log.Printf("Failed to create captchas: %v", err)
@@ -2,6 +2,7 @@ package routes
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"mime/multipart"
@@ -12,6 +13,8 @@ import (
 	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/config"
 	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/internal/markup"
+	"github.com/KushBlazingJudah/fedichan/internal/media"
 	"github.com/KushBlazingJudah/fedichan/internal/rx"
 	"github.com/KushBlazingJudah/fedichan/util"
 	"github.com/gofiber/fiber/v2"
@@ -48,6 +51,12 @@ func ActorInbox(ctx *fiber.Ctx) error {
 			return ctx.SendStatus(400)
 		}
 	case "Create":
+		if vote, err := activity.ProcessVote(); err != nil {
+			return util.WrapError(err)
+		} else if vote {
+			break
+		}
+
 		if err := actor.ProcessInboxCreate(activity); err != nil {
 			return util.WrapError(err)
 		}
@@ -75,6 +84,20 @@ func ActorInbox(ctx *fiber.Ctx) error {
 			break
 		}
 
+	case "Update":
+		// Only the instance hosting a thread may change it
+		if util.SameOrigin(activity.Object.Id, activity.Actor.Id) {
+			if keep := activity.Object.Cyclical; keep != nil {
+				if err := activity.Object.SetCyclical(activity.Actor.Id, *keep); err != nil {
+					return util.WrapError(err)
+				}
+			}
+
+			if err := activity.Object.SetPollVotes(); err != nil {
+				return util.WrapError(err)
+			}
+		}
+
 	case "Follow":
 		for _, e := range activity.To {
 			if _, err := activitypub.GetActorFromDB(e); err == nil {
@@ -168,6 +191,26 @@ func MakeActorPost(ctx *fiber.Ctx) error {
 		return send404(ctx)
 	}
 
+	if banned, err := checkBan(ctx, actor.Name); err != nil {
+		return send500(ctx, err)
+	} else if banned {
+		return nil
+	}
+
+	identities, err := db.PosterIdentities(identitySource(ctx))
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	if !floodExempt(ctx) {
+		thread := ctx.FormValue("inReplyTo") == ""
+		if msg, err := postFlood(actor, identities, thread, ctx.FormValue("comment")); err != nil {
+			return send500(ctx, err)
+		} else if msg != "" {
+			return send429(ctx, msg)
+		}
+	}
+
 	_, reg := ctx.Locals("acct").(*db.Acct)
 
 	// Waive captcha for authenticated users, otherwise complain
@@ -194,27 +237,30 @@ func MakeActorPost(ctx *fiber.Ctx) error {
 		return send400(ctx, "Media is required for new threads.")
 	}
 
-	var file multipart.File
+	var file []byte
 	if header != nil && err == nil {
-		file, err = header.Open()
-		if err != nil {
-			return err
+		if inReplyTo := ctx.FormValue("inReplyTo"); inReplyTo != "" {
+			op := activitypub.ObjectBase{Id: inReplyTo}
+			if _, full, err := op.LimitsReached(); err == nil && full {
+				return send400(ctx, "This thread has reached its image limit.")
+			}
 		}
-		defer file.Close()
 
 		// TODO: Do this according to the set limit
 		if header.Size > (7 << 20) {
 			return send400(ctx, "Max file size is 7 MB.")
-		} else if isBanned, err := db.IsMediaBanned(file); err == nil && isBanned {
-			return send400(ctx, "Media is banned.")
 		}
 
-		contentType, _ := util.GetFileContentType(file)
-		if !util.SupportedMIMEType(contentType) {
+		if file, err = readUpload(header); err != nil {
+			return util.WrapError(err)
+		}
+
+		if !util.SupportedMIMEType(http.DetectContentType(file)) {
 			return send400(ctx, "Unsupported file type.")
 		}
 
-		file.Seek(0, io.SeekStart)
+		// The file is checked against the limits and the media bans when
+		// it is stored, once the rest of the post has been checked.
 	} else {
 		// No file attached or couldn't load it
 		// Disallow blank posting
@@ -226,20 +272,28 @@ func MakeActorPost(ctx *fiber.Ctx) error {
 	// Sanity check values
 	if len(ctx.FormValue("comment")) > 4500 {
 		return send400(ctx, "Comment limit is 4500 characters.")
-	} else if len(ctx.FormValue("subject")) > 100 || len(ctx.FormValue("name")) > 100 || len(ctx.FormValue("options")) > 100 {
-		return send400(ctx, "Name, subject, or options limit is 100 characters.")
+	} else if len(ctx.FormValue("subject")) > 100 || len(ctx.FormValue("name")) > 100 || len(ctx.FormValue("options")) > 100 || len(ctx.FormValue("password")) > 100 {
+		return send400(ctx, "Name, subject, options, or password limit is 100 characters.")
 	} else if strings.Count(ctx.FormValue("comment"), "\n") > 50 {
 		return send400(ctx, "Your post has too many lines.")
 	} else if is, _ := util.IsPostBlacklist(ctx.FormValue("comment")); is {
 		return send400(ctx, "Your post was blocked.")
 	}
 
-	nObj, err := objectFromForm(ctx, activitypub.CreateObject("Note"))
-	if err != nil {
+	if ctx.FormValue("inReplyTo") == "" {
+		if _, err := parsePoll(ctx); err != nil {
+			return send400(ctx, err.Error())
+		}
+	}
+
+	nObj, err := objectFromForm(ctx, activitypub.CreateObject("Note"), file)
+	if msg := uploadError(err); msg != "" {
+		return send400(ctx, msg)
+	} else if err != nil {
 		return util.WrapError(err)
 	}
 
-	if err := newPost(actor, &nObj); err != nil {
+	if err := newPost(actor, &nObj, identitySource(ctx)); err != nil {
 		return err
 	}
 
@@ -272,7 +326,42 @@ func MakeActorPost(ctx *fiber.Ctx) error {
 	return ctx.Redirect("/"+ctx.FormValue("boardName"), 301)
 }
 
+// readUpload reads the whole of an uploaded file.
+func readUpload(header *multipart.FileHeader) ([]byte, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// uploadError returns what to tell a poster whose file was refused with err,
+// or an empty string if err isn't about their file.
+func uploadError(err error) string {
+	switch {
+	case errors.Is(err, activitypub.ErrMediaBanned):
+		return "Media is banned."
+	case errors.Is(err, activitypub.ErrCannotStrip):
+		return "This image can't be processed here. Try saving it as a PNG or JPEG."
+	case errors.Is(err, media.ErrDimensions):
+		return "Image dimensions are too large."
+	case errors.Is(err, media.ErrMismatch):
+		return "The image does not match its file type."
+	case errors.Is(err, media.ErrCorrupt):
+		return "The image could not be read."
+	}
+
+	return ""
+}
+
 func ActorPost(ctx *fiber.Ctx) error {
+	slot := pages.slot(ctx)
+	if ok, err := slot.serve(ctx); ok {
+		return err
+	}
+
 	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
 	actor, err := activitypub.GetActorByNameFromDB(ctx.Params("actor"))
 
@@ -319,6 +408,7 @@ func ActorPost(ctx *fiber.Ctx) error {
 	data.Board.Summary = actor.Summary
 	data.Board.Domain = config.Domain
 	data.Board.Restricted = actor.Restricted
+	data.Board.SpoilerImage, _ = actor.SpoilerImage()
 	data.Blotters, _ = actor.Blotters()
 	data.Acct = acct
 	data.ReturnTo = "feed"
@@ -328,8 +418,12 @@ func ActorPost(ctx *fiber.Ctx) error {
 		data.PostId = util.ShortURL(data.Board.To, data.Posts[0].Id)
 	}
 
-	if err := populateCaptcha(hasAuth, &data.Board); err != nil {
-		return util.WrapError(err)
+	// Cached pages are shown to everyone, so captcha.js gives each visitor
+	// their own captcha instead
+	if slot.key == "" {
+		if err := populateCaptcha(hasAuth, &data.Board); err != nil {
+			return util.WrapError(err)
+		}
 	}
 
 	data.Instance, err = activitypub.GetActorFromDB(config.Domain)
@@ -343,9 +437,10 @@ func ActorPost(ctx *fiber.Ctx) error {
 	data.Title = "/" + data.Board.Name + "/ - " + data.PostId
 
 	if len(data.Posts) > 0 {
-		data.Meta.Description = data.Posts[0].Content
+		data.Meta.Description = markup.PlainText(data.Posts[0].Content)
 		data.Meta.Url = data.Posts[0].Id
 		data.Meta.Title = data.Posts[0].Name
+		data.Meta.Feed = "/" + data.Board.Name + "/" + data.PostId + "/feed"
 		if data.Posts[0].Preview != nil {
 			data.Meta.Preview = data.Posts[0].Preview.Href
 		}
@@ -354,10 +449,15 @@ func ActorPost(ctx *fiber.Ctx) error {
 	data.Themes = config.Themes
 	data.ThemeCookie = themeCookie(ctx)
 
-	return ctx.Render("npost", data, "layouts/main")
+	return slot.render(ctx, "npost", data, inReplyTo)
 }
 
 func ActorCatalog(ctx *fiber.Ctx) error {
+	slot := pages.slot(ctx)
+	if ok, err := slot.serve(ctx); ok {
+		return err
+	}
+
 	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
 	actorName := ctx.Params("actor")
 	actor, err := activitypub.GetActorByNameFromDB(actorName)
@@ -366,7 +466,17 @@ func ActorCatalog(ctx *fiber.Ctx) error {
 		return util.WrapError(err)
 	}
 
-	collection, err := actor.GetCatalogCollection()
+	query := activitypub.CatalogQuery{
+		Sort:     ctx.Query("sort"),
+		Filter:   strings.TrimSpace(ctx.Query("filter")),
+		Instance: ctx.Query("instance"),
+	}
+
+	if !util.IsInStringArray(activitypub.CatalogSorts, query.Sort) {
+		query.Sort = activitypub.CatalogSorts[0]
+	}
+
+	collection, err := actor.GetCatalogCollection(query)
 
 	if err != nil {
 		return util.WrapError(err)
@@ -381,6 +491,7 @@ func ActorCatalog(ctx *fiber.Ctx) error {
 	data.Board.Summary = actor.Summary
 	data.Board.Domain = config.Domain
 	data.Board.Restricted = actor.Restricted
+	data.Board.SpoilerImage, _ = actor.SpoilerImage()
 	data.Blotters, _ = actor.Blotters()
 	data.Acct = acct
 	data.Key = config.Key
@@ -394,26 +505,39 @@ func ActorCatalog(ctx *fiber.Ctx) error {
 		return util.WrapError(err)
 	}
 
-	if err := populateCaptcha(hasAuth, &data.Board); err != nil {
-		return util.WrapError(err)
+	// Cached pages are shown to everyone, so captcha.js gives each visitor
+	// their own captcha instead
+	if slot.key == "" {
+		if err := populateCaptcha(hasAuth, &data.Board); err != nil {
+			return util.WrapError(err)
+		}
 	}
 
 	data.Title = "/" + data.Board.Name + "/ - catalog"
 
 	data.Boards = activitypub.Boards
 	data.Posts = collection.OrderedItems
+	data.Catalog = query
+	data.CatalogSorts = activitypub.CatalogSorts
+	data.Instances, _ = actor.CatalogInstances()
 
 	data.Meta.Description = data.Board.Summary
 	data.Meta.Url = data.Board.Actor.Id
 	data.Meta.Title = data.Title
+	data.Meta.Feed = "/" + data.Board.Name + "/feed"
 
 	data.Themes = config.Themes
 	data.ThemeCookie = themeCookie(ctx)
 
-	return ctx.Render("catalog", data, "layouts/main")
+	return slot.render(ctx, "catalog", data, "")
 }
 
 func ActorPosts(ctx *fiber.Ctx) error {
+	slot := pages.slot(ctx)
+	if ok, err := slot.serve(ctx); ok {
+		return err
+	}
+
 	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
 	actor, err := activitypub.GetActorByNameFromDB(ctx.Params("actor"))
 
@@ -459,6 +583,7 @@ func ActorPosts(ctx *fiber.Ctx) error {
 	data.Board.Actor = actor
 	data.Board.Domain = config.Domain
 	data.Board.Restricted = actor.Restricted
+	data.Board.SpoilerImage, _ = actor.SpoilerImage()
 	data.Blotters, _ = actor.Blotters()
 	data.Acct = acct
 	data.CurrentPage = page
@@ -467,8 +592,12 @@ func ActorPosts(ctx *fiber.Ctx) error {
 
 	data.Board.Post.Actor = actor.Id
 
-	if err := populateCaptcha(hasAuth, &data.Board); err != nil {
-		return util.WrapError(err)
+	// Cached pages are shown to everyone, so captcha.js gives each visitor
+	// their own captcha instead
+	if slot.key == "" {
+		if err := populateCaptcha(hasAuth, &data.Board); err != nil {
+			return util.WrapError(err)
+		}
 	}
 
 	data.Title = "/" + actor.Name + "/ - " + actor.PreferredUsername
@@ -484,11 +613,12 @@ func ActorPosts(ctx *fiber.Ctx) error {
 	data.Meta.Description = data.Board.Summary
 	data.Meta.Url = data.Board.Actor.Id
 	data.Meta.Title = data.Title
+	data.Meta.Feed = "/" + data.Board.Name + "/feed"
 
 	data.Themes = config.Themes
 	data.ThemeCookie = themeCookie(ctx)
 
-	return ctx.Render("nposts", data, "layouts/main")
+	return slot.render(ctx, "nposts", data, "")
 }
 
 func ActorArchive(ctx *fiber.Ctx) error {
@@ -515,6 +645,7 @@ func ActorArchive(ctx *fiber.Ctx) error {
 	data.Board.Summary = actor.Summary
 	data.Board.Domain = config.Domain
 	data.Board.Restricted = actor.Restricted
+	data.Board.SpoilerImage, _ = actor.SpoilerImage()
 	data.Blotters, _ = actor.Blotters()
 	data.Acct = acct
 	data.Key = config.Key
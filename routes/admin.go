@@ -3,13 +3,17 @@ package routes
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/activitypub"
 	"github.com/KushBlazingJudah/fedichan/config"
 	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/internal/media"
 	"github.com/KushBlazingJudah/fedichan/util"
 	"github.com/gofiber/fiber/v2"
 )
@@ -90,6 +94,10 @@ func AdminIndex(ctx *fiber.Ctx) error {
 	adminData.PostBlacklist, _ = util.GetRegexBlacklist()
 	adminData.Reports = reported
 
+	if acct.Type >= db.Mod {
+		adminData.Bans, _ = db.GetAppeals()
+	}
+
 	adminData.Meta.Description = adminData.Title
 	adminData.Meta.Url = adminData.Board.Actor.Id
 	adminData.Meta.Title = adminData.Title
@@ -230,6 +238,243 @@ func AdminSetLocked(ctx *fiber.Ctx) error {
 	return ctx.Redirect("/"+config.Key+"/"+ctx.FormValue("board", ""), http.StatusSeeOther)
 }
 
+func AdminSetPosterIDs(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Admin {
+		return send403(ctx, "Only admins can set poster IDs.")
+	}
+
+	actor, err := activitypub.GetActorByNameFromDB(ctx.FormValue("board"))
+	if err != nil {
+		return send404(ctx, "Board not found")
+	}
+
+	if err := actor.SetPosterIDs(ctx.FormValue("posterids") == "1"); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"/"+actor.Name, http.StatusSeeOther)
+}
+
+func AdminSetFloodLimits(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Admin {
+		return send403(ctx, "Only admins can set flood limits.")
+	}
+
+	actor, err := activitypub.GetActorByNameFromDB(ctx.FormValue("board"))
+	if err != nil {
+		return send404(ctx, "Board not found")
+	}
+
+	var limits activitypub.FloodLimits
+	for _, v := range []struct {
+		name string
+		dst  *int
+	}{
+		{"replydelay", &limits.ReplyDelay},
+		{"threaddelay", &limits.ThreadDelay},
+		{"dupwindow", &limits.DupWindow},
+		{"reportlimit", &limits.ReportLimit},
+	} {
+		n, err := strconv.Atoi(ctx.FormValue(v.name, "0"))
+		if err != nil || n < 0 {
+			return send400(ctx, "Limits must be whole numbers, and not negative.")
+		}
+
+		*v.dst = n
+	}
+
+	if err := actor.SetFloodLimits(limits); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"/"+actor.Name, http.StatusSeeOther)
+}
+
+func AdminSetThreadLimits(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Admin {
+		return send403(ctx, "Only admins can set thread limits.")
+	}
+
+	actor, err := activitypub.GetActorByNameFromDB(ctx.FormValue("board"))
+	if err != nil {
+		return send404(ctx, "Board not found")
+	}
+
+	var limits activitypub.ThreadLimits
+	for _, v := range []struct {
+		name string
+		dst  *int
+	}{
+		{"bumplimit", &limits.BumpLimit},
+		{"imagelimit", &limits.ImageLimit},
+		{"cyclelimit", &limits.CycleLimit},
+	} {
+		n, err := strconv.Atoi(ctx.FormValue(v.name, "0"))
+		if err != nil || n < 0 {
+			return send400(ctx, "Limits must be whole numbers, and not negative.")
+		}
+
+		*v.dst = n
+	}
+
+	if err := actor.SetThreadLimits(limits); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"/"+actor.Name, http.StatusSeeOther)
+}
+
+// AdminSetSpoilerImage replaces the image spoilered files on a board are
+// hidden behind, or goes back to the default one if asked to reset it.
+func AdminSetSpoilerImage(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Admin {
+		return send403(ctx, "Only admins can set the spoiler image.")
+	}
+
+	actor, err := activitypub.GetActorByNameFromDB(ctx.FormValue("board"))
+	if err != nil {
+		return send404(ctx, "Board not found")
+	}
+
+	if ctx.FormValue("reset") != "" {
+		if err := actor.SetSpoilerImage(nil, ""); err != nil {
+			return send500(ctx, err)
+		}
+
+		return ctx.Redirect("/"+config.Key+"/"+actor.Name, http.StatusSeeOther)
+	}
+
+	header, err := ctx.FormFile("file")
+	if err != nil {
+		return send400(ctx, "Choose an image to use.")
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return send500(ctx, err)
+	}
+	defer file.Close()
+
+	contentType, err := util.GetFileContentType(file)
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	if !media.Supported(contentType) {
+		return send400(ctx, "The spoiler image must be a GIF, JPEG, PNG or WebP image.")
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	if _, err := media.Check(data, contentType, util.MediaLimits()); errors.Is(err, media.ErrDimensions) {
+		return send400(ctx, "Image dimensions are too large.")
+	} else if errors.Is(err, media.ErrMismatch) {
+		return send400(ctx, "The image does not match its file type.")
+	} else if err != nil {
+		return send400(ctx, "The image could not be read.")
+	}
+
+	if err := actor.SetSpoilerImage(data, contentType); err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Redirect("/"+config.Key+"/"+actor.Name, http.StatusSeeOther)
+}
+
+func AdminMediaBans(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Mod {
+		return send403(ctx, "Only moderators and admins can manage media bans.")
+	}
+
+	if id := ctx.Query("remove"); id != "" {
+		i, _ := strconv.Atoi(id)
+		if err := util.DeleteMediaBan(i); err != nil {
+			return util.WrapError(err)
+		}
+
+		return ctx.Redirect("/"+config.Key+"/mediabans", http.StatusSeeOther)
+	}
+
+	if ctx.Method() == "POST" {
+		header, err := ctx.FormFile("file")
+		if err != nil {
+			return send400(ctx, "Choose a file to ban.")
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			return util.WrapError(err)
+		}
+		defer file.Close()
+
+		contentType, err := util.GetFileContentType(file)
+		if err != nil {
+			return util.WrapError(err)
+		}
+
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return util.WrapError(err)
+		}
+
+		match, err := util.WriteMediaBan(data, contentType)
+		if err != nil {
+			return util.WrapError(err)
+		}
+
+		if err := removeMediaPosts(match); err != nil {
+			return util.WrapError(err)
+		}
+
+		return ctx.Redirect("/"+config.Key+"/mediabans", http.StatusSeeOther)
+	}
+
+	var adminData adminPage
+
+	adminData.Key = config.Key
+	adminData.Domain = config.Domain
+	adminData.Acct = acct
+	adminData.Title = "Media Bans"
+
+	adminData.Boards = activitypub.Boards
+
+	adminData.Instance, _ = activitypub.GetActorFromDB(config.Domain)
+
+	adminData.MediaBans, _ = util.GetMediaBans()
+
+	adminData.Themes = config.Themes
+
+	return ctx.Render("mediabans", adminData, "layouts/main")
+}
+
 func AdminActorIndex(ctx *fiber.Ctx) error {
 	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
 	if !hasAuth {
@@ -292,6 +537,9 @@ func AdminActorIndex(ctx *fiber.Ctx) error {
 	data.Instance, _ = activitypub.GetActorFromDB(config.Domain)
 
 	data.AutoSubscribe, _ = actor.GetAutoSubscribe()
+	data.FloodLimits, _ = actor.FloodLimits()
+	data.ThreadLimits, _ = actor.ThreadLimits()
+	data.Board.SpoilerImage, _ = actor.SpoilerImage()
 
 	data.Meta.Description = data.Title
 	data.Meta.Url = data.Board.Actor.Id
@@ -324,6 +572,8 @@ func AdminEditSummary(ctx *fiber.Ctx) error {
 		return util.WrapError(err)
 	}
 
+	actor.Changed("Update")
+
 	var redirect string
 	if actor.Name != "main" {
 		redirect = actor.Name
@@ -475,3 +725,92 @@ func AdminChangePasswd(ctx *fiber.Ctx) error {
 
 	return ctx.RedirectBack("/" + config.Key)
 }
+
+func AdminBans(ctx *fiber.Ctx) error {
+	acct, hasAuth := ctx.Locals("acct").(*db.Acct)
+	if !hasAuth {
+		return sendLogin(ctx)
+	}
+
+	if acct.Type < db.Mod {
+		return send403(ctx, "Only moderators and admins can manage bans.")
+	}
+
+	if id := ctx.Query("remove"); id != "" {
+		i, _ := strconv.Atoi(id)
+		if err := db.DeleteBan(i); err != nil {
+			return util.WrapError(err)
+		}
+
+		return ctx.Redirect("/"+config.Key+"/bans", http.StatusSeeOther)
+	} else if id := ctx.Query("deny"); id != "" {
+		i, _ := strconv.Atoi(id)
+		if err := db.DenyAppeal(i); err != nil {
+			return util.WrapError(err)
+		}
+
+		return ctx.Redirect("/"+config.Key+"/bans", http.StatusSeeOther)
+	}
+
+	if ctx.Method() == "POST" {
+		ban := db.Ban{
+			Board:  ctx.FormValue("board"),
+			Reason: strings.TrimSpace(ctx.FormValue("reason")),
+			Post:   ctx.FormValue("post"),
+			Marked: ctx.FormValue("marked") != "",
+		}
+
+		if ban.Reason == "" {
+			return send400(ctx, "A reason is required.")
+		}
+
+		if ip := ctx.FormValue("ip"); ip != "" {
+			var err error
+			if ban.IP, err = db.ParseAddress(ip); err != nil {
+				return send400(ctx, "Invalid IP address or CIDR range.")
+			}
+		} else if ban.Post != "" {
+			var err error
+			if ban.Identity, err = db.GetIdentity(ban.Post); err != nil {
+				return util.WrapError(err)
+			} else if ban.Identity == "" {
+				return send400(ctx, "Nothing is known about who made that post; it may be remote or too old.")
+			}
+		} else {
+			return send400(ctx, "Either a post or an IP address is required.")
+		}
+
+		if hours, _ := strconv.Atoi(ctx.FormValue("duration")); hours > 0 {
+			expires := time.Now().UTC().Add(time.Duration(hours) * time.Hour)
+			ban.Expires = &expires
+		}
+
+		if err := db.CreateBan(ban); err != nil {
+			return util.WrapError(err)
+		}
+
+		if ban.Marked && ban.Post != "" {
+			activitypub.ObjectBase{Id: ban.Post}.Changed("Update")
+		}
+
+		return ctx.Redirect("/"+config.Key+"/bans", http.StatusSeeOther)
+	}
+
+	var adminData adminPage
+
+	adminData.Key = config.Key
+	adminData.Domain = config.Domain
+	adminData.Acct = acct
+	adminData.Title = "Bans"
+
+	adminData.Boards = activitypub.Boards
+
+	adminData.Instance, _ = activitypub.GetActorFromDB(config.Domain)
+
+	adminData.Bans, _ = db.GetBans()
+	adminData.Ban = db.Ban{Post: ctx.Query("post"), Board: ctx.Query("board")}
+
+	adminData.Themes = config.Themes
+
+	return ctx.Render("bans", adminData, "layouts/main")
+}
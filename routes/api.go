@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
 	"github.com/KushBlazingJudah/fedichan/util"
 	"github.com/gofiber/fiber/v2"
 )
@@ -47,3 +48,18 @@ func RouteImages(ctx *fiber.Ctx, media string) error {
 	_, err = io.Copy(ctx, resp.Body)
 	return err
 }
+
+// Captcha hands out a captcha for the post and report forms on pages that are
+// cached, which can't have one of their own as each can only be solved once.
+func Captcha(ctx *fiber.Ctx) error {
+	file, id, err := db.GetCaptcha()
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	ctx.Set("Cache-Control", "no-store")
+	return ctx.JSON(fiber.Map{
+		"id":    id,
+		"image": "/" + file,
+	})
+}
@@ -0,0 +1,94 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/gofiber/fiber/v2"
+)
+
+// activeBans returns the bans keeping the poster making a request from posting
+// on board.
+func activeBans(ctx *fiber.Ctx, board string) ([]db.Ban, error) {
+	identities, err := db.PosterIdentities(identitySource(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return db.GetActiveBans(identities, clientIP(ctx), board)
+}
+
+// checkBan renders the ban page and returns true if the poster making a
+// request is banned from board.
+// Staff are never banned.
+func checkBan(ctx *fiber.Ctx, board string) (bool, error) {
+	if _, ok := ctx.Locals("acct").(*db.Acct); ok {
+		return false, nil
+	}
+
+	bans, err := activeBans(ctx, board)
+	if err != nil {
+		return false, err
+	} else if len(bans) == 0 {
+		return false, nil
+	}
+
+	return true, sendBanned(ctx, bans[0])
+}
+
+func sendBanned(ctx *fiber.Ctx, ban db.Ban) error {
+	var data banPage
+
+	data.Title = "Banned"
+	data.Boards = activitypub.Boards
+	data.Key = config.Key
+	data.Themes = config.Themes
+	data.ThemeCookie = themeCookie(ctx)
+	data.Instance, _ = activitypub.GetActorFromDB(config.Domain)
+	data.Ban = ban
+
+	return ctx.Status(http.StatusForbidden).Render("banned", data, "layouts/main")
+}
+
+// BanAppeal takes the one appeal a banned poster may make.
+func BanAppeal(ctx *fiber.Ctx) error {
+	id, _ := strconv.Atoi(ctx.FormValue("id"))
+	appeal := strings.TrimSpace(ctx.FormValue("appeal"))
+
+	if appeal == "" {
+		return send400(ctx, "Say why you should be unbanned.")
+	} else if len(appeal) > 2000 {
+		return send400(ctx, "Appeals may contain at most 2000 characters.")
+	}
+
+	bans, err := activeBans(ctx, ctx.FormValue("board"))
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	// Only the banned may appeal
+	for _, ban := range bans {
+		if ban.Id != id {
+			continue
+		}
+
+		if ok, err := db.AppealBan(id, appeal); err != nil {
+			return send500(ctx, err)
+		} else if !ok {
+			return send403(ctx, "This ban has already been appealed.")
+		}
+
+		now := time.Now().UTC()
+		ban.Appeal = appeal
+		ban.Appealed = &now
+
+		return sendBanned(ctx, ban)
+	}
+
+	return send404(ctx)
+}
@@ -6,7 +6,7 @@ import (
 	"log"
 	"net/http"
 	"net/smtp"
-	"os"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -15,6 +15,7 @@ import (
 	"github.com/KushBlazingJudah/fedichan/config"
 
 	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/internal/storage"
 	"github.com/KushBlazingJudah/fedichan/util"
 	"github.com/gofiber/fiber/v2"
 )
@@ -49,45 +50,81 @@ func BoardBanMedia(ctx *fiber.Ctx) error {
 		return util.WrapError(err)
 	}
 
-	var actor activitypub.Actor
-	actor.Id = col.OrderedItems[0].Actor
+	attachment := col.OrderedItems[0].Attachment[0]
 
-	if !hasAuth {
-		err = errors.New("actor does not have auth")
+	var data []byte
+	if key, ok := storage.Default.Key(attachment.Href); ok {
+		data, err = storage.Default.Get(key)
+	} else {
+		data, err = util.FetchMedia(attachment.Href, util.RemoteMediaLimit)
+	}
+
+	if err != nil {
 		return util.WrapError(err)
 	}
 
-	re := regexp.MustCompile(config.Domain)
-	file := re.ReplaceAllString(col.OrderedItems[0].Attachment[0].Href, "")
+	match, err := util.WriteMediaBan(data, attachment.MediaType)
+	if err != nil {
+		return util.WrapError(err)
+	}
 
-	f, err := os.Open("." + file)
+	obj := activitypub.ObjectBase{Id: postID, Actor: col.OrderedItems[0].Actor}
+	isOP, _ := obj.CheckIfOP()
+	local, _ := obj.IsLocal()
 
-	if err != nil {
+	if err := removeMediaPosts(match); err != nil {
 		return util.WrapError(err)
 	}
 
-	defer f.Close()
+	// Files uploaded before hashes were recorded can't be found by them
+	if _type, _ := obj.GetType(); _type != "Tombstone" {
+		if err := removePost(obj); err != nil {
+			return util.WrapError(err)
+		}
+	}
 
-	bytes := make([]byte, 2048)
+	var OP string
+	if len(col.OrderedItems[0].InReplyTo) > 0 {
+		OP = col.OrderedItems[0].InReplyTo[0].Id
+	}
+
+	if !isOP {
+		if !local && OP != "" {
+			return ctx.Redirect("/"+board+"/"+util.RemoteShort(OP), http.StatusSeeOther)
+		} else if OP != "" {
+			return ctx.Redirect(OP, http.StatusSeeOther)
+		}
+	}
 
-	if _, err = f.Read(bytes); err != nil {
+	return ctx.Redirect("/"+board, http.StatusSeeOther)
+}
+
+// removeMediaPosts deletes every post carrying a file that m matches, as if a
+// moderator had deleted each of them.
+func removeMediaPosts(m util.MediaMatch) error {
+	posts, err := activitypub.GetMediaPosts(m)
+	if err != nil {
 		return util.WrapError(err)
 	}
 
-	if banned, err := db.IsMediaBanned(f); err == nil && !banned {
-		query := `insert into bannedmedia (hash) values ($1)`
-		if _, err := config.DB.Exec(query, util.HashBytes(bytes)); err != nil {
+	for _, obj := range posts {
+		// Replies go with their thread
+		if _type, _ := obj.GetType(); _type == "Tombstone" {
+			continue
+		}
+
+		if err := removePost(obj); err != nil {
 			return util.WrapError(err)
 		}
 	}
 
-	var isOP bool
-	var local bool
-	var obj activitypub.ObjectBase
-	obj.Id = postID
-	obj.Actor = actor.Id
+	return nil
+}
 
-	if isOP, _ = obj.CheckIfOP(); !isOP {
+// removePost tombstones a post, or a thread if it is an OP, and lets other
+// instances know if it is ours.
+func removePost(obj activitypub.ObjectBase) error {
+	if isOP, _ := obj.CheckIfOP(); !isOP {
 		if err := obj.Tombstone(); err != nil {
 			return util.WrapError(err)
 		}
@@ -97,30 +134,48 @@ func BoardBanMedia(ctx *fiber.Ctx) error {
 		}
 	}
 
-	if local, _ = obj.IsLocal(); local {
+	if local, _ := obj.IsLocal(); local {
 		if err := obj.DeleteRequest(); err != nil {
 			return util.WrapError(err)
 		}
 	}
 
-	if err := actor.UnArchiveLast(); err != nil {
+	actor := activitypub.Actor{Id: obj.Actor}
+	return actor.UnArchiveLast()
+}
+
+// BoardBan takes moderators to the form for banning whoever made a post.
+func BoardBan(ctx *fiber.Ctx) error {
+	if _, hasAuth := ctx.Locals("acct").(*db.Acct); !hasAuth {
+		return send403(ctx)
+	}
+
+	q := url.Values{"post": {ctx.Query("id")}, "board": {ctx.Query("board")}}
+	return ctx.Redirect("/"+config.Key+"/bans?"+q.Encode(), http.StatusSeeOther)
+}
+
+// removeAttachment deletes the attachment and preview of obj, leaving the
+// post itself alone.
+func removeAttachment(obj activitypub.ObjectBase) error {
+	if err := obj.DeleteAttachmentFromFile(); err != nil {
 		return util.WrapError(err)
 	}
 
-	var OP string
-	if len(col.OrderedItems[0].InReplyTo) > 0 {
-		OP = col.OrderedItems[0].InReplyTo[0].Id
+	if err := obj.TombstoneAttachment(); err != nil {
+		return util.WrapError(err)
 	}
 
-	if !isOP {
-		if !local && OP != "" {
-			return ctx.Redirect("/"+board+"/"+util.RemoteShort(OP), http.StatusSeeOther)
-		} else if OP != "" {
-			return ctx.Redirect(OP, http.StatusSeeOther)
-		}
+	if err := obj.DeletePreviewFromFile(); err != nil {
+		return util.WrapError(err)
 	}
 
-	return ctx.Redirect("/"+board, http.StatusSeeOther)
+	if err := obj.TombstonePreview(); err != nil {
+		return util.WrapError(err)
+	}
+
+	obj.Changed("Delete")
+
+	return nil
 }
 
 func BoardDelete(ctx *fiber.Ctx) error {
@@ -248,19 +303,7 @@ func BoardDeleteAttach(ctx *fiber.Ctx) error {
 
 	obj := activitypub.ObjectBase{Id: postID}
 
-	if err := obj.DeleteAttachmentFromFile(); err != nil {
-		return util.WrapError(err)
-	}
-
-	if err := obj.TombstoneAttachment(); err != nil {
-		return util.WrapError(err)
-	}
-
-	if err := obj.DeletePreviewFromFile(); err != nil {
-		return util.WrapError(err)
-	}
-
-	if err := obj.TombstonePreview(); err != nil {
+	if err := removeAttachment(obj); err != nil {
 		return util.WrapError(err)
 	}
 
@@ -456,6 +499,31 @@ func ReportPost(ctx *fiber.Ctx) error {
 		return ctx.Redirect("/"+config.Key+"/"+board, http.StatusSeeOther)
 	}
 
+	if banned, err := checkBan(ctx, board); err != nil {
+		return send500(ctx, err)
+	} else if banned {
+		return nil
+	}
+
+	identities, err := db.PosterIdentities(identitySource(ctx))
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	if !floodExempt(ctx) {
+		// Boards we only follow use the limits of the instance
+		actor, err := activitypub.GetActorByNameFromDB(board)
+		if err != nil {
+			actor = activitypub.Actor{Id: config.Domain, Name: board}
+		}
+
+		if limited, err := reportFlood(actor, identities); err != nil {
+			return send500(ctx, err)
+		} else if limited {
+			return send429(ctx, "You have made too many reports. Try again later.")
+		}
+	}
+
 	if len(reason) > 100 {
 		return send400(ctx, "Report length may contain at most 100 characters.")
 	}
@@ -474,6 +542,11 @@ func ReportPost(ctx *fiber.Ctx) error {
 		return send500(ctx, err)
 	}
 
+	// The current identity comes first
+	if err := db.WriteReporter(identities[0], board); err != nil {
+		log.Printf("Failed to record reporter: %v", err)
+	}
+
 	go func() {
 		if setup := config.IsEmailSetup(); !setup {
 			return
@@ -558,6 +631,93 @@ func ReportGet(ctx *fiber.Ctx) error {
 	return ctx.Render("report", data, "layouts/main")
 }
 
+// PosterDelete lets a poster delete their own post, or just its file, with
+// the password they posted it with.
+func PosterDelete(ctx *fiber.Ctx) error {
+	id := ctx.FormValue("id")
+	board := ctx.FormValue("board")
+
+	ok, err := db.CheckDeletePassword(id, ctx.FormValue("password"))
+	if errors.Is(err, db.ErrDeleteExpired) {
+		return send403(ctx, "This post is too old to be deleted.")
+	} else if err != nil {
+		return send500(ctx, err)
+	} else if !ok {
+		return send403(ctx, "Incorrect password.")
+	}
+
+	activity := activitypub.Activity{Id: id}
+	col, err := activity.GetCollection()
+	if err != nil {
+		return send500(ctx, err)
+	} else if len(col.OrderedItems) == 0 {
+		return send404(ctx)
+	}
+
+	obj := col.OrderedItems[0]
+
+	OP := obj.Id
+	if len(obj.InReplyTo) > 0 {
+		OP = obj.InReplyTo[0].Id
+	}
+
+	if ctx.FormValue("fileonly") != "" {
+		if err := removeAttachment(activitypub.ObjectBase{Id: obj.Id}); err != nil {
+			return send500(ctx, err)
+		}
+
+		return ctx.Redirect(OP, http.StatusSeeOther)
+	}
+
+	if err := removePost(activitypub.ObjectBase{Id: obj.Id, Actor: obj.Actor}); err != nil {
+		return send500(ctx, err)
+	}
+
+	if OP != obj.Id {
+		return ctx.Redirect(OP, http.StatusSeeOther)
+	}
+
+	return ctx.Redirect("/"+board, http.StatusSeeOther)
+}
+
+func PosterDeleteGet(ctx *fiber.Ctx) error {
+	acct, _ := ctx.Locals("acct").(*db.Acct)
+	actor, _ := activitypub.GetActor(ctx.Query("actor"))
+
+	var data pageData
+	var err error
+
+	data.Board.Actor = actor
+	data.Board.Name = actor.Name
+	data.Board.PrefName = actor.PreferredUsername
+	data.Board.Summary = actor.Summary
+	data.Board.InReplyTo = ctx.Query("post")
+	data.Board.To = actor.Outbox
+	data.Board.Restricted = actor.Restricted
+	data.Acct = acct
+	data.DeletePassword = ctx.Cookies("delpass")
+
+	data.Title = "/" + actor.Name + "/ - delete post"
+
+	data.Meta.Description = data.Board.Summary
+	data.Meta.Url = data.Board.Actor.Id
+	data.Meta.Title = data.Title
+
+	data.Instance, err = activitypub.GetActorFromDB(config.Domain)
+	if err != nil {
+		return err
+	}
+
+	data.Themes = config.Themes
+	data.ThemeCookie = themeCookie(ctx)
+
+	data.Key = config.Key
+	data.Board.Domain = config.Domain
+	data.Boards = activitypub.Boards
+
+	return ctx.Render("deletepost", data, "layouts/main")
+}
+
 func Sticky(ctx *fiber.Ctx) error {
 	_, hasAuth := ctx.Locals("acct").(*db.Acct)
 
@@ -637,3 +797,86 @@ func Lock(ctx *fiber.Ctx) error {
 		return ctx.Redirect(OP, http.StatusSeeOther)
 	}
 }
+
+func Autosage(ctx *fiber.Ctx) error {
+	_, hasAuth := ctx.Locals("acct").(*db.Acct)
+
+	id := ctx.Query("id")
+	board := ctx.Query("board")
+
+	actor, _ := activitypub.GetActorByNameFromDB(board)
+
+	if id == "" || !hasAuth {
+		return send403(ctx)
+	}
+
+	var obj = activitypub.ObjectBase{Id: id}
+	col, _ := obj.GetCollectionFromPath()
+
+	if len(col.OrderedItems) < 1 {
+		obj.MarkAutosage(actor.Id)
+
+		return ctx.Redirect("/"+board, http.StatusSeeOther)
+	}
+
+	actor.Id = col.OrderedItems[0].Actor
+
+	var OP string
+	if len(col.OrderedItems[0].InReplyTo) > 0 && col.OrderedItems[0].InReplyTo[0].Id != "" {
+		OP = col.OrderedItems[0].InReplyTo[0].Id
+	} else {
+		OP = id
+	}
+
+	obj.MarkAutosage(actor.Id)
+
+	var op = activitypub.ObjectBase{Id: OP}
+	if local, _ := op.IsLocal(); !local {
+		return ctx.Redirect("/"+board+"/"+util.RemoteShort(OP), http.StatusSeeOther)
+	} else {
+		return ctx.Redirect(OP, http.StatusSeeOther)
+	}
+}
+
+// Cyclical makes a thread prune its oldest replies as new ones come in.
+func Cyclical(ctx *fiber.Ctx) error {
+	_, hasAuth := ctx.Locals("acct").(*db.Acct)
+
+	id := ctx.Query("id")
+	board := ctx.Query("board")
+
+	actor, _ := activitypub.GetActorByNameFromDB(board)
+
+	if id == "" || !hasAuth {
+		return send403(ctx)
+	}
+
+	limits, err := actor.ThreadLimits()
+	if err != nil {
+		return send500(ctx, err)
+	} else if limits.CycleLimit == 0 {
+		return send400(ctx, "Cyclical threads are turned off on this board.")
+	}
+
+	var obj = activitypub.ObjectBase{Id: id}
+	col, _ := obj.GetCollectionFromPath()
+
+	if len(col.OrderedItems) < 1 {
+		return send404(ctx)
+	}
+
+	if err := obj.MarkCyclical(col.OrderedItems[0].Actor, limits.CycleLimit); err != nil {
+		return send500(ctx, err)
+	}
+
+	if local, _ := obj.IsLocal(); !local {
+		return ctx.Redirect("/"+board+"/"+util.RemoteShort(id), http.StatusSeeOther)
+	}
+
+	// Mirrors prune the thread themselves once they know about it
+	if err := obj.UpdateRequest(); err != nil {
+		log.Printf("Failed to federate cyclical thread %s: %v", id, err)
+	}
+
+	return ctx.Redirect(id, http.StatusSeeOther)
+}
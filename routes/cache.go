@@ -0,0 +1,287 @@
+package routes
+
+import (
+	"container/list"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/gofiber/fiber/v2"
+)
+
+// pages keeps the board pages, catalogs and threads rendered for visitors who
+// aren't logged in, so that reading a board doesn't touch the database.
+var pages = newPageCache(config.PageCache, time.Duration(config.PageCacheAge)*time.Second)
+
+// cachedPage is a rendered page, along with what it shows.
+type cachedPage struct {
+	key      string
+	body     []byte
+	etag     string
+	modified time.Time
+	expires  time.Time
+
+	// actors are the boards whose posts are on the page, and thread is the
+	// thread it is of, if it is of one.
+	actors []string
+	thread string
+}
+
+// shows reports whether e changes what p shows.
+func (p *cachedPage) shows(e activitypub.Event) bool {
+	// The main actor being locked locks every board
+	if e.Actor == config.Domain && e.Thread == "" {
+		return true
+	}
+
+	if p.thread != "" && e.Thread == p.thread {
+		return true
+	}
+
+	// Threads only show what happens in them, apart from changes to the
+	// whole board
+	if p.thread != "" && e.Thread != "" {
+		return false
+	}
+
+	for _, a := range p.actors {
+		if a == e.Actor {
+			return true
+		}
+	}
+
+	return false
+}
+
+type pageCache struct {
+	mu      sync.Mutex
+	size    int
+	age     time.Duration
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// gen counts what has been thrown away, so that pages rendered while
+	// something they show was changing aren't kept.
+	gen uint64
+}
+
+func newPageCache(size int, age time.Duration) *pageCache {
+	c := &pageCache{
+		size:    size,
+		age:     age,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	if size > 0 {
+		activitypub.Subscribe(c.invalidate)
+	}
+
+	return c
+}
+
+func (c *pageCache) get(key string) *cachedPage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	p := el.Value.(*cachedPage)
+	if time.Now().After(p.expires) {
+		c.remove(el)
+		return nil
+	}
+
+	c.lru.MoveToFront(el)
+
+	return p
+}
+
+// put keeps p unless something was thrown away since gen.
+func (c *pageCache) put(p *cachedPage, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	if el, ok := c.entries[p.key]; ok {
+		c.remove(el)
+	}
+
+	c.entries[p.key] = c.lru.PushFront(p)
+
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *pageCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cachedPage).key)
+}
+
+// drop throws away every page match returns true for.
+func (c *pageCache) drop(match func(*cachedPage) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if match(el.Value.(*cachedPage)) {
+			c.remove(el)
+		}
+
+		el = next
+	}
+}
+
+func (c *pageCache) invalidate(e activitypub.Event) {
+	c.drop(func(p *cachedPage) bool {
+		return p.shows(e)
+	})
+}
+
+// pageSlot is where the page a request is for goes in the cache.
+// Requests that can't be cached have an empty key.
+type pageSlot struct {
+	key string
+	gen uint64
+}
+
+// slot returns where the page ctx asks for goes.
+// Pages are only cached for visitors who aren't logged in, and only as HTML.
+func (c *pageCache) slot(ctx *fiber.Ctx) pageSlot {
+	if _, hasAuth := ctx.Locals("acct").(*db.Acct); hasAuth || c.size <= 0 || activitypub.AcceptActivity(ctx.Get("Accept")) {
+		return pageSlot{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return pageSlot{key: ctx.OriginalURL() + "\x00" + themeCookie(ctx), gen: c.gen}
+}
+
+// serve sends the page cached in s, reporting whether there was one.
+func (s pageSlot) serve(ctx *fiber.Ctx) (bool, error) {
+	if s.key == "" {
+		return false, nil
+	}
+
+	p := pages.get(s.key)
+	if p == nil {
+		return false, nil
+	}
+
+	setValidators(ctx, p)
+	if notModified(ctx, p) {
+		return true, ctx.SendStatus(http.StatusNotModified)
+	}
+
+	ctx.Type("html", "utf-8")
+	return true, ctx.Send(p.body)
+}
+
+// render renders the page like ctx.Render does, keeping it in s.
+// thread is the thread the page is of, if it is of one.
+func (s pageSlot) render(ctx *fiber.Ctx, name string, data pageData, thread string) error {
+	if err := ctx.Render(name, data, "layouts/main"); err != nil || s.key == "" {
+		return err
+	}
+
+	p := &cachedPage{
+		key:      s.key,
+		body:     append([]byte(nil), ctx.Response().Body()...),
+		modified: lastModified(data.Posts),
+		expires:  time.Now().Add(pages.age),
+		actors:   []string{data.Board.Actor.Id},
+		thread:   thread,
+	}
+
+	// Followed boards have their posts shown too
+	following, err := data.Board.Actor.GetFollowing()
+	if err != nil {
+		return nil
+	}
+
+	for _, f := range following {
+		p.actors = append(p.actors, f.Id)
+	}
+
+	h := fnv.New64a()
+	h.Write(p.body)
+	p.etag = `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+
+	pages.put(p, s.gen)
+
+	setValidators(ctx, p)
+	if notModified(ctx, p) {
+		ctx.Response().ResetBody()
+		ctx.Status(http.StatusNotModified)
+	}
+
+	return nil
+}
+
+// lastModified returns when the newest of posts, or the replies to them, was
+// made or bumped.
+func lastModified(posts []activitypub.ObjectBase) time.Time {
+	var t time.Time
+
+	for _, p := range posts {
+		if p.Updated != nil && p.Updated.After(t) {
+			t = *p.Updated
+		}
+
+		if p.Published.After(t) {
+			t = p.Published
+		}
+
+		if p.Replies != nil {
+			if r := lastModified(p.Replies.OrderedItems); r.After(t) {
+				t = r
+			}
+		}
+	}
+
+	return t.UTC().Truncate(time.Second)
+}
+
+func setValidators(ctx *fiber.Ctx, p *cachedPage) {
+	ctx.Set(fiber.HeaderETag, p.etag)
+	ctx.Set(fiber.HeaderCacheControl, "no-cache")
+	ctx.Set(fiber.HeaderVary, "Cookie")
+
+	if !p.modified.IsZero() {
+		ctx.Set(fiber.HeaderLastModified, p.modified.Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether the copy of p the client has is still good.
+func notModified(ctx *fiber.Ctx, p *cachedPage) bool {
+	if match := ctx.Get(fiber.HeaderIfNoneMatch); match != "" {
+		for _, etag := range strings.Split(match, ",") {
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == p.etag || etag == "*" {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	since, err := http.ParseTime(ctx.Get(fiber.HeaderIfModifiedSince))
+	return err == nil && !p.modified.IsZero() && !p.modified.After(since)
+}
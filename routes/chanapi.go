@@ -0,0 +1,366 @@
+package routes
+
+import (
+	"path"
+	"strings"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/util"
+	"github.com/gofiber/fiber/v2"
+)
+
+// The read-only JSON API that readers and archivers made for 4chan speak.
+// Post numbers are the short IDs posts have on the board, so no and resto
+// are strings rather than numbers.
+
+// chanPerPage is how many threads are on each page of a board.
+const chanPerPage = 15
+
+type chanBoard struct {
+	Board       string        `json:"board"`
+	Title       string        `json:"title"`
+	WorkSafe    int           `json:"ws_board"`
+	PerPage     int           `json:"per_page"`
+	Pages       int           `json:"pages"`
+	MaxFilesize int           `json:"max_filesize"`
+	MaxComment  int           `json:"max_comment_chars"`
+	BumpLimit   int           `json:"bump_limit"`
+	ImageLimit  int           `json:"image_limit"`
+	Cooldowns   chanCooldowns `json:"cooldowns"`
+	Description string        `json:"meta_description"`
+	IsArchived  int           `json:"is_archived"`
+}
+
+type chanCooldowns struct {
+	Threads int `json:"threads"`
+	Replies int `json:"replies"`
+}
+
+type chanPost struct {
+	No    string `json:"no"`
+	Resto any    `json:"resto"`
+
+	Sticky   int `json:"sticky,omitempty"`
+	Closed   int `json:"closed,omitempty"`
+	Archived int `json:"archived,omitempty"`
+
+	Now     string `json:"now"`
+	Time    int64  `json:"time"`
+	Name    string `json:"name,omitempty"`
+	Trip    string `json:"trip,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Capcode string `json:"capcode,omitempty"`
+	Sub     string `json:"sub,omitempty"`
+	Com     string `json:"com,omitempty"`
+
+	// The file, if there is one.
+	// fedichan doesn't keep MD5s, so its SHA-256 is given instead, and as
+	// files can come from other instances their URLs are given too.
+	Tim         string `json:"tim,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	Ext         string `json:"ext,omitempty"`
+	Fsize       int64  `json:"fsize,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	W           int    `json:"w,omitempty"`
+	H           int    `json:"h,omitempty"`
+	TnW         int    `json:"tn_w,omitempty"`
+	TnH         int    `json:"tn_h,omitempty"`
+	FileURL     string `json:"file_url,omitempty"`
+	ThumbURL    string `json:"thumb_url,omitempty"`
+	FileDeleted int    `json:"filedeleted,omitempty"`
+	Spoiler     int    `json:"spoiler,omitempty"`
+
+	// Only set on threads.
+	Replies      *int       `json:"replies,omitempty"`
+	Images       *int       `json:"images,omitempty"`
+	BumpLimit    int        `json:"bumplimit,omitempty"`
+	ImageLimit   int        `json:"imagelimit,omitempty"`
+	LastModified int64      `json:"last_modified,omitempty"`
+	OmittedPosts int        `json:"omitted_posts,omitempty"`
+	OmittedImgs  int        `json:"omitted_images,omitempty"`
+	LastReplies  []chanPost `json:"last_replies,omitempty"`
+}
+
+type chanPage struct {
+	Page    int        `json:"page"`
+	Threads []chanPost `json:"threads"`
+}
+
+// chanThreadPage is a page of threads.json, which only says which threads
+// there are.
+type chanThreadPage struct {
+	Page    int             `json:"page"`
+	Threads []chanThreadRef `json:"threads"`
+}
+
+type chanThreadRef struct {
+	No           string `json:"no"`
+	LastModified int64  `json:"last_modified"`
+	Replies      int    `json:"replies"`
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// newChanPost converts p, which is in the thread op, to how 4chan has it.
+func newChanPost(b activitypub.Board, op activitypub.ObjectBase, p activitypub.ObjectBase) chanPost {
+	c := chanPost{
+		No:      util.ShortURL(b.Actor.Outbox, p.Id),
+		Resto:   0,
+		Sticky:  boolInt(p.Sticky),
+		Closed:  boolInt(p.Locked),
+		Now:     p.Published.UTC().Format("01/02/06(Mon)15:04:05"),
+		Time:    p.Published.Unix(),
+		Name:    p.AttributedTo,
+		Trip:    p.TripCode,
+		ID:      p.PosterID,
+		Capcode: strings.ToLower(p.Capcode),
+		Sub:     p.Name,
+	}
+
+	if p.Id != op.Id {
+		c.Resto = util.ShortURL(b.Actor.Outbox, op.Id)
+	}
+
+	com, _ := db.ParseContent(b.Actor, op.Id, p.Content, op, p.Id, false)
+	c.Com = string(com)
+
+	if len(p.Attachment) > 0 {
+		a := p.Attachment[0]
+		if a.Type == "Tombstone" {
+			c.FileDeleted = 1
+		} else if a.Href != "" {
+			c.Ext = path.Ext(a.Href)
+			c.Tim = strings.TrimSuffix(path.Base(a.Href), c.Ext)
+			c.Filename = strings.TrimSuffix(a.Name, path.Ext(a.Name))
+			c.Fsize = a.Size
+			c.SHA256 = a.Hash
+			c.W, c.H = a.Width, a.Height
+			c.Spoiler = boolInt(a.Spoiler)
+
+			// Sensitive files are hidden on SFW boards, so they aren't
+			// linked to either
+			sensitive := b.Actor.Restricted && p.Sensitive
+			if !sensitive {
+				c.FileURL = util.MediaProxy(a.Href)
+			}
+
+			if p.Preview != nil && p.Preview.Href != "" {
+				c.TnW, c.TnH = p.Preview.Width, p.Preview.Height
+				if !sensitive {
+					c.ThumbURL = util.MediaProxy(p.Preview.Href)
+				}
+			}
+		}
+	}
+
+	if p.Id == op.Id {
+		replies, images := 0, 0
+		if p.Replies != nil {
+			replies, images = p.Replies.TotalItems, p.Replies.TotalImgs
+		}
+
+		c.Replies, c.Images = &replies, &images
+		c.BumpLimit = boolInt(p.BumpLimit)
+		c.ImageLimit = boolInt(p.ImageLimit)
+		c.LastModified = lastModified([]activitypub.ObjectBase{p}).Unix()
+	}
+
+	return c
+}
+
+func chanNotFound(ctx *fiber.Ctx, msg string) error {
+	return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": msg})
+}
+
+// ChanBoards lists the boards on this instance.
+func ChanBoards(ctx *fiber.Ctx) error {
+	boards := []chanBoard{}
+
+	for _, b := range activitypub.Boards {
+		if _, ok := findBoard(b.Name); !ok {
+			continue
+		}
+
+		flood, err := b.Actor.FloodLimits()
+		if err != nil {
+			return send500(ctx, err)
+		}
+
+		limits, err := b.Actor.ThreadLimits()
+		if err != nil {
+			return send500(ctx, err)
+		}
+
+		boards = append(boards, chanBoard{
+			Board:       b.Name,
+			Title:       b.PrefName,
+			WorkSafe:    boolInt(b.Restricted),
+			PerPage:     chanPerPage,
+			Pages:       config.PostCountPerPage + 1,
+			MaxFilesize: 7 << 20,
+			MaxComment:  4500,
+			BumpLimit:   limits.BumpLimit,
+			ImageLimit:  limits.ImageLimit,
+			Cooldowns: chanCooldowns{
+				Threads: flood.ThreadDelay,
+				Replies: flood.ReplyDelay,
+			},
+			Description: b.Actor.Summary,
+			IsArchived:  1,
+		})
+	}
+
+	return ctx.JSON(fiber.Map{"boards": boards})
+}
+
+// ChanThreads lists the threads on a board, page by page.
+func ChanThreads(ctx *fiber.Ctx) error {
+	b, ok := findBoard(ctx.Params("actor"))
+	if !ok {
+		return chanNotFound(ctx, "No such board.")
+	}
+
+	col, err := b.Actor.GetCatalogCollection(activitypub.CatalogQuery{})
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	pages := []chanThreadPage{}
+
+	for i, op := range col.OrderedItems {
+		if i%chanPerPage == 0 {
+			pages = append(pages, chanThreadPage{Page: i/chanPerPage + 1})
+		}
+
+		page := &pages[len(pages)-1]
+		page.Threads = append(page.Threads, chanThreadRef{
+			No:           util.ShortURL(b.Actor.Outbox, op.Id),
+			LastModified: lastModified([]activitypub.ObjectBase{op}).Unix(),
+			Replies:      op.Replies.TotalItems,
+		})
+	}
+
+	return ctx.JSON(pages)
+}
+
+// ChanCatalog lists the threads on a board along with their latest replies,
+// page by page.
+func ChanCatalog(ctx *fiber.Ctx) error {
+	b, ok := findBoard(ctx.Params("actor"))
+	if !ok {
+		return chanNotFound(ctx, "No such board.")
+	}
+
+	pages := []chanPage{}
+
+	for i := 0; i <= config.PostCountPerPage; i++ {
+		col, err := b.Actor.GetCollectionPage(i)
+		if err != nil {
+			return send500(ctx, err)
+		} else if len(col.OrderedItems) == 0 {
+			break
+		}
+
+		page := chanPage{Page: i + 1, Threads: []chanPost{}}
+		for _, op := range col.OrderedItems {
+			t := newChanPost(b, op, op)
+
+			if op.Replies != nil {
+				for _, r := range op.Replies.OrderedItems {
+					t.LastReplies = append(t.LastReplies, newChanPost(b, op, r))
+				}
+
+				t.OmittedPosts = op.Replies.TotalItems - len(op.Replies.OrderedItems)
+				t.OmittedImgs = op.Replies.TotalImgs
+				for _, r := range op.Replies.OrderedItems {
+					if len(r.Attachment) > 0 {
+						t.OmittedImgs--
+					}
+				}
+			}
+
+			page.Threads = append(page.Threads, t)
+		}
+
+		pages = append(pages, page)
+	}
+
+	return ctx.JSON(pages)
+}
+
+// ChanArchive lists the archived threads on a board.
+func ChanArchive(ctx *fiber.Ctx) error {
+	b, ok := findBoard(ctx.Params("actor"))
+	if !ok {
+		return chanNotFound(ctx, "No such board.")
+	}
+
+	col, err := b.Actor.GetCollectionType("Archive")
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	nos := []string{}
+	for _, op := range col.OrderedItems {
+		nos = append(nos, util.ShortURL(b.Actor.Outbox, op.Id))
+	}
+
+	return ctx.JSON(nos)
+}
+
+// ChanThread shows a thread with all of its replies.
+func ChanThread(ctx *fiber.Ctx) error {
+	b, ok := findBoard(ctx.Params("actor"))
+	if !ok {
+		return chanNotFound(ctx, "No such board.")
+	}
+
+	id, err := db.GetPostIDFromNum(ctx.Params("post"))
+	if err != nil || id == "" {
+		return chanNotFound(ctx, "No such thread.")
+	}
+
+	obj := activitypub.ObjectBase{Id: id}
+	if op, _ := obj.GetOP(); op != id {
+		return chanNotFound(ctx, "No such thread.")
+	}
+
+	col, err := obj.GetCollectionFromPath()
+	if err != nil {
+		return send500(ctx, err)
+	} else if len(col.OrderedItems) == 0 || col.OrderedItems[0].Type == "Tombstone" {
+		return chanNotFound(ctx, "No such thread.")
+	}
+
+	op := col.OrderedItems[0]
+
+	if shown, err := boardShows(b, op); err != nil {
+		return send500(ctx, err)
+	} else if !shown {
+		return chanNotFound(ctx, "No such thread.")
+	}
+
+	t := newChanPost(b, op, op)
+	t.Archived = boolInt(op.Type == "Archive")
+
+	posts := []chanPost{t}
+	if op.Replies != nil {
+		for _, r := range op.Replies.OrderedItems {
+			if r.Type == "Tombstone" {
+				continue
+			}
+
+			posts = append(posts, newChanPost(b, op, r))
+		}
+	}
+
+	return ctx.JSON(fiber.Map{"posts": posts})
+}
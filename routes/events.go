@@ -0,0 +1,372 @@
+package routes
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/util"
+	"github.com/gofiber/fiber/v2"
+)
+
+// liveBuffer is how many events may be waiting to be sent to a listener
+// before it is dropped for falling behind.
+const liveBuffer = 16
+
+// liveKeepalive is how often listeners are sent something so that proxies
+// don't think their connection is idle.
+const liveKeepalive = 15 * time.Second
+
+// live sends events to those watching boards and threads.
+var live = newLiveHub(config.LiveConns)
+
+// liveEvent is what listeners are sent about an event.
+type liveEvent struct {
+	Type   string `json:"type"`
+	Id     string `json:"id,omitempty"`
+	Thread string `json:"thread,omitempty"`
+
+	// Short is the short URL of the post on the board it is being watched
+	// on, which its element is named after.
+	Short string `json:"short,omitempty"`
+
+	// HTML is the post rendered with the post partial.
+	// Posts are only rendered for those watching their thread.
+	HTML string `json:"html,omitempty"`
+
+	Post *activitypub.ObjectBase `json:"post,omitempty"`
+}
+
+// liveListener is a connection watching a board, or a thread on it.
+type liveListener struct {
+	identity string
+	board    activitypub.Board
+	thread   string
+
+	// actors are the boards whose posts are shown on the board.
+	actors []string
+
+	ch chan []byte
+}
+
+// wants reports whether l is told about e.
+func (l *liveListener) wants(e activitypub.Event) bool {
+	if l.thread != "" {
+		return e.Thread == l.thread
+	}
+
+	if e.Actor == config.Domain && e.Thread == "" {
+		return true
+	}
+
+	for _, a := range l.actors {
+		if a == e.Actor {
+			return true
+		}
+	}
+
+	return false
+}
+
+type liveHub struct {
+	mu        sync.Mutex
+	limit     int
+	listeners map[*liveListener]bool
+	conns     map[string]int
+
+	// count is how many listeners there are, so that events can be
+	// dropped when there are none without waiting on mu.
+	count atomic.Int64
+
+	// Events are handled away from whatever made them, as reading and
+	// rendering the posts they are about takes time.
+	queue chan activitypub.Event
+}
+
+func newLiveHub(limit int) *liveHub {
+	h := &liveHub{
+		limit:     limit,
+		listeners: make(map[*liveListener]bool),
+		conns:     make(map[string]int),
+		queue:     make(chan activitypub.Event, 256),
+	}
+
+	if limit > 0 {
+		activitypub.Subscribe(h.enqueue)
+		go h.run()
+	}
+
+	return h
+}
+
+func (h *liveHub) enqueue(e activitypub.Event) {
+	if h.count.Load() == 0 {
+		return
+	}
+
+	select {
+	case h.queue <- e:
+	default:
+		log.Printf("Live updates are falling behind; dropped %s of %s", e.Type, e.Post)
+	}
+}
+
+// listen adds a listener for identity to the board, or the thread on it.
+// It returns nil if identity already has as many as it may.
+func (h *liveHub) listen(identity string, board activitypub.Board, thread string) (*liveListener, error) {
+	l := &liveListener{
+		identity: identity,
+		board:    board,
+		thread:   thread,
+		actors:   []string{board.Actor.Id},
+		ch:       make(chan []byte, liveBuffer),
+	}
+
+	if thread == "" {
+		following, err := board.Actor.GetFollowing()
+		if err != nil {
+			return nil, util.WrapError(err)
+		}
+
+		for _, f := range following {
+			l.actors = append(l.actors, f.Id)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conns[identity] >= h.limit {
+		return nil, nil
+	}
+
+	h.conns[identity]++
+	h.listeners[l] = true
+	h.count.Add(1)
+
+	return l, nil
+}
+
+// leave removes l, if it wasn't dropped already.
+func (h *liveHub) leave(l *liveListener) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(l)
+}
+
+func (h *liveHub) remove(l *liveListener) {
+	if !h.listeners[l] {
+		return
+	}
+
+	delete(h.listeners, l)
+	close(l.ch)
+	h.count.Add(-1)
+
+	if h.conns[l.identity]--; h.conns[l.identity] <= 0 {
+		delete(h.conns, l.identity)
+	}
+}
+
+func (h *liveHub) run() {
+	for e := range h.queue {
+		h.mu.Lock()
+		var wanted []*liveListener
+		for l := range h.listeners {
+			if l.wants(e) {
+				wanted = append(wanted, l)
+			}
+		}
+		h.mu.Unlock()
+
+		if len(wanted) == 0 {
+			continue
+		}
+
+		// Deleted posts can't be read anymore, and don't need to be
+		var post *activitypub.ObjectBase
+		if e.Type != "Delete" && e.Post != "" {
+			if col, err := (activitypub.ObjectBase{Id: e.Post}).GetCollectionFromPath(); err == nil && len(col.OrderedItems) > 0 {
+				post = &col.OrderedItems[0]
+			}
+		}
+
+		// Each board is rendered for once, no matter how many are
+		// watching it, and without holding up those joining and leaving
+		msgs := make(map[string][]byte)
+		for _, l := range wanted {
+			key := liveKey(l)
+			if _, ok := msgs[key]; !ok {
+				msgs[key] = liveMessage(e, post, l)
+			}
+		}
+
+		h.mu.Lock()
+		for _, l := range wanted {
+			msg := msgs[liveKey(l)]
+
+			// Those that left while rendering have had their channel
+			// closed
+			if msg == nil || !h.listeners[l] {
+				continue
+			}
+
+			select {
+			case l.ch <- msg:
+			default:
+				// Fell behind; it can catch up by reconnecting
+				h.remove(l)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// liveKey returns what l is sent the same messages as others with.
+func liveKey(l *liveListener) string {
+	return l.board.Actor.Id + "\x00" + l.thread
+}
+
+// liveMessage formats e as a server-sent event for l.
+func liveMessage(e activitypub.Event, post *activitypub.ObjectBase, l *liveListener) []byte {
+	ev := liveEvent{
+		Type:   strings.ToLower(e.Type),
+		Id:     e.Post,
+		Thread: e.Thread,
+		Post:   post,
+	}
+
+	if e.Post != "" {
+		ev.Short = util.ShortURL(l.board.Actor.Outbox, e.Post)
+	}
+
+	if post != nil && l.thread != "" {
+		html, err := executePost(*post, l.board, activitypub.ObjectBase{Id: e.Thread}, nil, false)
+		if err != nil {
+			log.Printf("Rendering %s for live updates: %v", e.Post, err)
+		}
+
+		ev.HTML = string(html)
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Encoding %s for live updates: %v", e.Post, err)
+		return nil
+	}
+
+	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", ev.Type, data))
+}
+
+// liveBoard returns the board ctx is for, as the post partial needs it.
+func liveBoard(ctx *fiber.Ctx) (activitypub.Board, error) {
+	actor, err := activitypub.GetActorByNameFromDB(ctx.Params("actor"))
+	if err != nil {
+		return activitypub.Board{}, err
+	}
+
+	b := activitypub.Board{
+		Name:       actor.Name,
+		PrefName:   actor.PreferredUsername,
+		To:         actor.Outbox,
+		Actor:      actor,
+		Domain:     config.Domain,
+		Restricted: actor.Restricted,
+	}
+	b.SpoilerImage, _ = actor.SpoilerImage()
+
+	return b, nil
+}
+
+// BoardEvents streams the events on a board as they happen.
+func BoardEvents(ctx *fiber.Ctx) error {
+	board, err := liveBoard(ctx)
+	if err != nil {
+		return send404(ctx)
+	}
+
+	return streamEvents(ctx, board, "")
+}
+
+// ThreadEvents streams the events in a thread as they happen.
+func ThreadEvents(ctx *fiber.Ctx) error {
+	board, err := liveBoard(ctx)
+	if err != nil {
+		return send404(ctx)
+	}
+
+	thread, err := db.GetPostIDFromNum(ctx.Params("post"))
+	if err != nil {
+		return send404(ctx)
+	}
+
+	if op, _ := (activitypub.ObjectBase{Id: thread}).GetOP(); op != thread {
+		return send404(ctx)
+	}
+
+	return streamEvents(ctx, board, thread)
+}
+
+func streamEvents(ctx *fiber.Ctx, board activitypub.Board, thread string) error {
+	// No Content tells browsers not to try again
+	if live.limit <= 0 {
+		return ctx.SendStatus(http.StatusNoContent)
+	}
+
+	l, err := live.listen(identitySource(ctx), board, thread)
+	if err != nil {
+		return send500(ctx, err)
+	} else if l == nil {
+		return send429(ctx, "Too many live updates open. Close some tabs and try again.")
+	}
+
+	ctx.Set(fiber.HeaderContentType, "text/event-stream")
+	ctx.Set(fiber.HeaderCacheControl, "no-cache")
+	ctx.Set("X-Accel-Buffering", "no")
+
+	// Streams outlast the write timeout, so it is pushed back as they go
+	conn := ctx.Context().Conn()
+
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer live.leave(l)
+
+		t := time.NewTicker(liveKeepalive)
+		defer t.Stop()
+
+		msg := []byte("retry: 5000\n\n")
+		for {
+			conn.SetWriteDeadline(time.Now().Add(2 * liveKeepalive))
+
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case m, ok := <-l.ch:
+				if !ok {
+					return
+				}
+
+				msg = m
+			case <-t.C:
+				msg = []byte(": keepalive\n\n")
+			}
+		}
+	})
+
+	return nil
+}
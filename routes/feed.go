@@ -0,0 +1,523 @@
+package routes
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/internal/markup"
+	"github.com/KushBlazingJudah/fedichan/util"
+	"github.com/gofiber/fiber/v2"
+)
+
+// feedLength is how many entries feeds have at most.
+const feedLength = 50
+
+// feed is a feed before it is written out as RSS, Atom or JSON Feed.
+type feed struct {
+	Title       string
+	Description string
+
+	// Link is the page the feed is of, and Self is the feed itself, without
+	// the extension.
+	Link string
+	Self string
+
+	Updated time.Time
+	Entries []feedEntry
+}
+
+type feedEntry struct {
+	Id     string
+	Title  string
+	Link   string
+	Author string
+
+	Text string
+	HTML string
+
+	Published time.Time
+	Updated   time.Time
+
+	Enclosure *feedEnclosure
+}
+
+type feedEnclosure struct {
+	URL    string
+	Type   string
+	Length int64
+}
+
+// postTitle is what a post is called in feeds: its subject, or the start of
+// its comment if it has none.
+func postTitle(short string, p activitypub.ObjectBase) string {
+	if p.Name != "" {
+		return p.Name
+	}
+
+	text := strings.Join(strings.Fields(markup.PlainText(p.Content)), " ")
+	if text == "" {
+		return "No. " + short
+	}
+
+	if utf8.RuneCountInString(text) > 80 {
+		text = string([]rune(text)[:80]) + "…"
+	}
+
+	return text
+}
+
+// postEntry makes the entry for p, which is in the thread op on b.
+func postEntry(b activitypub.Board, op activitypub.ObjectBase, p activitypub.ObjectBase) feedEntry {
+	short := util.ShortURL(b.Actor.Outbox, p.Id)
+
+	e := feedEntry{
+		Id:        p.Id,
+		Title:     postTitle(short, p),
+		Link:      config.Domain + "/" + b.Name + "/" + util.ShortURL(b.Actor.Outbox, op.Id) + "#" + short,
+		Author:    p.AttributedTo + p.TripCode,
+		Text:      markup.PlainText(p.Content),
+		Published: p.Published,
+		Updated:   p.Published,
+	}
+
+	if e.Author == "" {
+		e.Author = "Anonymous"
+	}
+
+	content, _ := db.ParseContent(b.Actor, op.Id, p.Content, op, p.Id, false)
+	body := string(content)
+
+	if len(p.Attachment) > 0 && p.Attachment[0].Type != "Tombstone" && p.Attachment[0].Href != "" {
+		a := p.Attachment[0]
+		href := util.MediaProxy(a.Href)
+
+		// Media is hidden the same way it is on the board, and feed readers
+		// can't hide it, so it is left out
+		if b.Restricted && p.Sensitive {
+			body = "<p>[NSFW content]</p>" + body
+		} else if a.Spoiler {
+			body = "<p>[Spoiler]</p>" + body
+		} else {
+			if strings.HasPrefix(a.MediaType, "image/") {
+				src := href
+				if p.Preview != nil && p.Preview.Href != "" {
+					src = util.MediaProxy(p.Preview.Href)
+				}
+
+				body = fmt.Sprintf(`<p><a href="%s"><img src="%s" alt="%s"></a></p>`, html.EscapeString(href), html.EscapeString(src), html.EscapeString(a.Name)) + body
+			}
+
+			e.Enclosure = &feedEnclosure{URL: href, Type: a.MediaType, Length: a.Size}
+		}
+	}
+
+	// Links to posts are relative to the site, which feed readers aren't on
+	e.HTML = strings.ReplaceAll(body, `href="/`, `href="`+config.Domain+"/")
+
+	return e
+}
+
+// newestEntry returns when the newest of entries was made.
+func newestEntry(entries []feedEntry) time.Time {
+	var t time.Time
+	for _, e := range entries {
+		if e.Updated.After(t) {
+			t = e.Updated
+		}
+	}
+
+	return t
+}
+
+// BoardFeed is a feed of the newest threads on a board.
+func BoardFeed(ctx *fiber.Ctx) error {
+	b, ok := findBoard(ctx.Params("actor"))
+	if !ok {
+		return send404(ctx)
+	}
+
+	col, err := b.Actor.GetCatalogCollection(activitypub.CatalogQuery{Sort: "created"})
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	// Stickies come first in the catalog, no matter how old they are
+	threads := col.OrderedItems
+	sort.SliceStable(threads, func(i, j int) bool {
+		return threads[i].Published.After(threads[j].Published)
+	})
+
+	if len(threads) > feedLength {
+		threads = threads[:feedLength]
+	}
+
+	f := feed{
+		Title:       "/" + b.Name + "/ - " + b.PrefName,
+		Description: b.Actor.Summary,
+		Link:        config.Domain + "/" + b.Name,
+		Self:        config.Domain + "/" + b.Name + "/feed",
+	}
+
+	for _, op := range threads {
+		f.Entries = append(f.Entries, postEntry(b, op, op))
+	}
+
+	f.Updated = newestEntry(f.Entries)
+
+	return sendFeed(ctx, f)
+}
+
+// ThreadFeed is a feed of the replies to a thread.
+func ThreadFeed(ctx *fiber.Ctx) error {
+	b, ok := findBoard(ctx.Params("actor"))
+	if !ok {
+		return send404(ctx)
+	}
+
+	id, err := db.GetPostIDFromNum(ctx.Params("post"))
+	if err != nil || id == "" {
+		return send404(ctx)
+	}
+
+	obj := activitypub.ObjectBase{Id: id}
+	if op, _ := obj.GetOP(); op != id {
+		return send404(ctx)
+	}
+
+	col, err := obj.GetCollectionFromPath()
+	if err != nil {
+		return send500(ctx, err)
+	} else if len(col.OrderedItems) == 0 || col.OrderedItems[0].Type == "Tombstone" {
+		return send404(ctx)
+	}
+
+	op := col.OrderedItems[0]
+
+	// Only threads that are shown on the board have feeds on it
+	if shown, err := boardShows(b, op); err != nil {
+		return send500(ctx, err)
+	} else if !shown {
+		return send404(ctx)
+	}
+
+	short := util.ShortURL(b.Actor.Outbox, op.Id)
+
+	f := feed{
+		Title:       "/" + b.Name + "/ - " + postTitle(short, op),
+		Description: markup.PlainText(op.Content),
+		Link:        config.Domain + "/" + b.Name + "/" + short,
+		Self:        config.Domain + "/" + b.Name + "/" + short + "/feed",
+	}
+
+	posts := []activitypub.ObjectBase{op}
+	if op.Replies != nil {
+		posts = append(posts, op.Replies.OrderedItems...)
+	}
+
+	// Newest first, as feed readers expect
+	for i := len(posts) - 1; i >= 0 && len(f.Entries) < feedLength; i-- {
+		if posts[i].Type == "Tombstone" {
+			continue
+		}
+
+		f.Entries = append(f.Entries, postEntry(b, op, posts[i]))
+	}
+
+	f.Updated = newestEntry(f.Entries)
+
+	return sendFeed(ctx, f)
+}
+
+// NewsFeed is a feed of the news.
+func NewsFeed(ctx *fiber.Ctx) error {
+	actor, err := activitypub.GetActorFromDB(config.Domain)
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	news, err := db.GetNews(feedLength)
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	f := feed{
+		Title: actor.PreferredUsername + " News",
+		Link:  config.Domain + "/news",
+		Self:  config.Domain + "/news/feed",
+	}
+
+	for _, n := range news {
+		link := config.Domain + "/news/" + strconv.Itoa(n.Time)
+		t := time.Unix(int64(n.Time), 0)
+
+		// News is written by admins as HTML
+		f.Entries = append(f.Entries, feedEntry{
+			Id:        link,
+			Title:     n.Title,
+			Link:      link,
+			Author:    actor.PreferredUsername,
+			HTML:      string(n.Content),
+			Published: t,
+			Updated:   t,
+		})
+	}
+
+	f.Updated = newestEntry(f.Entries)
+
+	return sendFeed(ctx, f)
+}
+
+// sendFeed writes f out in the format ctx asks for.
+func sendFeed(ctx *fiber.Ctx, f feed) error {
+	if f.Updated.IsZero() {
+		f.Updated = time.Now()
+	}
+
+	switch ctx.Params("format") {
+	case "rss":
+		ctx.Set(fiber.HeaderContentType, "application/rss+xml; charset=utf-8")
+		return sendXML(ctx, rssFeed(f))
+	case "atom":
+		ctx.Set(fiber.HeaderContentType, "application/atom+xml; charset=utf-8")
+		return sendXML(ctx, atomFeed(f))
+	case "json":
+		out, err := json.Marshal(jsonFeed(f))
+		if err != nil {
+			return send500(ctx, err)
+		}
+
+		ctx.Set(fiber.HeaderContentType, "application/feed+json; charset=utf-8")
+		return ctx.Send(out)
+	}
+
+	return send404(ctx)
+}
+
+func sendXML(ctx *fiber.Ctx, v any) error {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	return ctx.Send(append([]byte(xml.Header), out...))
+}
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Self          atomLink  `xml:"atom:link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Guid        rssGuid       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Description string        `xml:"description"`
+	Enclosure   *rssEnclosure `xml:"enclosure"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length int64  `xml:"length,attr"`
+}
+
+func rssFeed(f feed) rss {
+	r := rss{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          f.Link,
+			Self:          atomLink{Href: f.Self + ".rss", Rel: "self", Type: "application/rss+xml"},
+			Description:   f.Description,
+			LastBuildDate: f.Updated.UTC().Format(time.RFC1123Z),
+		},
+	}
+
+	// RSS needs a description
+	if r.Channel.Description == "" {
+		r.Channel.Description = f.Title
+	}
+
+	for _, e := range f.Entries {
+		item := rssItem{
+			Title:       e.Title,
+			Link:        e.Link,
+			Guid:        rssGuid{Value: e.Id},
+			PubDate:     e.Published.UTC().Format(time.RFC1123Z),
+			Description: e.HTML,
+		}
+
+		if e.Enclosure != nil {
+			item.Enclosure = &rssEnclosure{URL: e.Enclosure.URL, Type: e.Enclosure.Type, Length: e.Enclosure.Length}
+		}
+
+		r.Channel.Items = append(r.Channel.Items, item)
+	}
+
+	return r
+}
+
+type atom struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Summary string      `xml:"subtitle,omitempty"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Id        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Author    atomAuthor `xml:"author"`
+	Links     []atomLink `xml:"link"`
+	Summary   *atomText  `xml:"summary"`
+	Content   atomText   `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+func atomFeed(f feed) atom {
+	a := atom{
+		Id:      f.Self,
+		Title:   f.Title,
+		Summary: f.Description,
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: f.Link, Rel: "alternate", Type: "text/html"},
+			{Href: f.Self + ".atom", Rel: "self", Type: "application/atom+xml"},
+		},
+	}
+
+	for _, e := range f.Entries {
+		entry := atomEntry{
+			Id:        e.Id,
+			Title:     e.Title,
+			Updated:   e.Updated.UTC().Format(time.RFC3339),
+			Published: e.Published.UTC().Format(time.RFC3339),
+			Author:    atomAuthor{Name: e.Author},
+			Links:     []atomLink{{Href: e.Link, Rel: "alternate", Type: "text/html"}},
+			Content:   atomText{Type: "html", Value: e.HTML},
+		}
+
+		if e.Text != "" {
+			entry.Summary = &atomText{Type: "text", Value: e.Text}
+		}
+
+		if e.Enclosure != nil {
+			entry.Links = append(entry.Links, atomLink{Href: e.Enclosure.URL, Rel: "enclosure", Type: e.Enclosure.Type, Length: e.Enclosure.Length})
+		}
+
+		a.Entries = append(a.Entries, entry)
+	}
+
+	return a
+}
+
+type jsonFeedDoc struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	Id            string               `json:"id"`
+	URL           string               `json:"url"`
+	Title         string               `json:"title"`
+	ContentHTML   string               `json:"content_html"`
+	ContentText   string               `json:"content_text,omitempty"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified"`
+	Authors       []jsonFeedAuthor     `json:"authors"`
+	Attachments   []jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedAttachment struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size_in_bytes,omitempty"`
+}
+
+func jsonFeed(f feed) jsonFeedDoc {
+	j := jsonFeedDoc{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.Link,
+		FeedURL:     f.Self + ".json",
+		Description: f.Description,
+		Items:       []jsonFeedItem{},
+	}
+
+	for _, e := range f.Entries {
+		item := jsonFeedItem{
+			Id:            e.Id,
+			URL:           e.Link,
+			Title:         e.Title,
+			ContentHTML:   e.HTML,
+			ContentText:   e.Text,
+			DatePublished: e.Published.UTC().Format(time.RFC3339),
+			DateModified:  e.Updated.UTC().Format(time.RFC3339),
+			Authors:       []jsonFeedAuthor{{Name: e.Author}},
+		}
+
+		if e.Enclosure != nil {
+			item.Attachments = []jsonFeedAttachment{{URL: e.Enclosure.URL, MimeType: e.Enclosure.Type, Size: e.Enclosure.Length}}
+		}
+
+		j.Items = append(j.Items, item)
+	}
+
+	return j
+}
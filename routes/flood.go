@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/internal/ratelimit"
+	"github.com/gofiber/fiber/v2"
+)
+
+var inboxLimiter = ratelimit.New(config.InboxRate, config.InboxBurst)
+
+// floodExempt reports whether the request is from someone flood control
+// doesn't apply to.
+func floodExempt(ctx *fiber.Ctx) bool {
+	acct, ok := ctx.Locals("acct").(*db.Acct)
+	return ok && acct.Type >= db.Mod
+}
+
+// postFlood returns why the poster known by any of identities may not post on
+// board yet, or an empty string if they may.
+// All of their identities are checked so that the limits carry over when the
+// salt rotates.
+func postFlood(board activitypub.Actor, identities []string, thread bool, comment string) (string, error) {
+	limits, err := board.FloodLimits()
+	if err != nil {
+		return "", err
+	}
+
+	delay, what := limits.ReplyDelay, "replying"
+	if thread {
+		delay, what = limits.ThreadDelay, "starting a new thread"
+	}
+
+	if delay > 0 {
+		last, err := db.LastPost(identities, board.Id, thread)
+		if err != nil {
+			return "", err
+		}
+
+		if wait := time.Until(last.Add(time.Duration(delay) * time.Second)); wait > 0 {
+			return fmt.Sprintf("Wait %d more seconds before %s.", int(wait.Seconds())+1, what), nil
+		}
+	}
+
+	if limits.DupWindow > 0 && comment != "" {
+		dup, err := db.IsDuplicate(identities, board.Id, comment, time.Duration(limits.DupWindow)*time.Second)
+		if err != nil {
+			return "", err
+		} else if dup {
+			return "You have already posted that comment.", nil
+		}
+	}
+
+	return "", nil
+}
+
+// reportFlood reports whether the poster known by any of identities has used
+// up the reports they may make on board.
+func reportFlood(board activitypub.Actor, identities []string) (bool, error) {
+	limits, err := board.FloodLimits()
+	if err != nil || limits.ReportLimit <= 0 {
+		return false, err
+	}
+
+	n, err := db.CountReports(identities, board.Name, time.Hour)
+	return n >= limits.ReportLimit, err
+}
+
+// InboxLimit keeps any one host from flooding the inboxes.
+func InboxLimit(ctx *fiber.Ctx) error {
+	if config.InboxRate <= 0 || inboxLimiter.Allow(clientIP(ctx).String()) {
+		return ctx.Next()
+	}
+
+	ctx.Set("Retry-After", strconv.Itoa(int(60/float64(config.InboxRate))+1))
+	return ctx.SendStatus(http.StatusTooManyRequests)
+}
@@ -50,6 +50,7 @@ func NewsGet(ctx *fiber.Ctx) error {
 	data.Meta.Description = data.PreferredUsername + " is a federated image board based on ActivityPub. The current version of the code running on the server is still a work-in-progress product, expect a bumpy ride for the time being. Get the server code here: https://git.fchannel.org."
 	data.Meta.Url = data.Board.Actor.Id
 	data.Meta.Title = data.Title
+	data.Meta.Feed = "/news/feed"
 
 	data.Themes = config.Themes
 	data.ThemeCookie = themeCookie(ctx)
@@ -90,6 +91,7 @@ func NewsGetAll(ctx *fiber.Ctx) error {
 	data.Meta.Description = data.PreferredUsername + " is a federated image board based on ActivityPub. The current version of the code running on the server is still a work-in-progress product, expect a bumpy ride for the time being. Get the server code here: https://git.fchannel.org."
 	data.Meta.Url = data.Board.Actor.Id
 	data.Meta.Title = data.Title
+	data.Meta.Feed = "/news/feed"
 
 	data.Themes = config.Themes
 	data.ThemeCookie = themeCookie(ctx)
@@ -0,0 +1,188 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/gofiber/fiber/v2"
+)
+
+// overboardPageSize is how many threads are on each page of the overboard,
+// as on boards.
+const overboardPageSize = 15
+
+type overboardPage struct {
+	common
+
+	Threads     []threadView
+	Catalog     bool
+	Pages       []int
+	CurrentPage int
+	TotalPage   int
+
+	// The local boards, and which of them are left out.
+	Local    []activitypub.Board
+	Excluded map[string]bool
+	SFW      bool
+}
+
+// overboardSettings returns the names of the boards the visitor has left out
+// of the overboard, and whether they only want to see what is safe for work.
+func overboardSettings(ctx *fiber.Ctx) (map[string]bool, bool) {
+	excluded := make(map[string]bool)
+	for _, name := range strings.Split(ctx.Cookies("overboard-exclude"), ",") {
+		if name != "" {
+			excluded[name] = true
+		}
+	}
+
+	return excluded, ctx.Cookies("overboard-sfw") != ""
+}
+
+func overboard(ctx *fiber.Ctx, catalog bool) error {
+	acct, _ := ctx.Locals("acct").(*db.Acct)
+
+	actor, err := activitypub.GetActorFromDB(config.Domain)
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	var data overboardPage
+	data.Excluded, data.SFW = overboardSettings(ctx)
+
+	q := activitypub.OverboardQuery{SFW: data.SFW}
+
+	boards := make(map[string]activitypub.Board)
+	for _, b := range activitypub.Boards {
+		if _, ok := findBoard(b.Name); !ok {
+			continue
+		}
+
+		if data.Excluded[b.Name] {
+			q.Exclude = append(q.Exclude, b.Actor.Id)
+		}
+
+		b.SpoilerImage, _ = b.Actor.SpoilerImage()
+		boards[b.Actor.Id] = b
+		data.Local = append(data.Local, b)
+	}
+
+	if catalog {
+		q.Limit = overboardPageSize * (config.PostCountPerPage + 1)
+	} else {
+		page, _ := strconv.Atoi(ctx.Query("page"))
+		if page < 0 || page > config.PostCountPerPage {
+			return send404(ctx)
+		}
+
+		q.Replies = 5
+		q.Limit = overboardPageSize
+		q.Offset = page * overboardPageSize
+		data.CurrentPage = page
+	}
+
+	threads, total, err := activitypub.Overboard(q)
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	for _, t := range threads {
+		b, ok := boards[t.Board]
+		if !ok {
+			continue
+		}
+
+		data.Threads = append(data.Threads, threadView{
+			Board:  b,
+			Thread: t.Thread,
+			Acct:   acct,
+			Trunc:  true,
+			Badge:  true,
+		})
+	}
+
+	for i := 0; i*overboardPageSize < total && i <= config.PostCountPerPage; i++ {
+		data.Pages = append(data.Pages, i)
+	}
+
+	data.Catalog = catalog
+	data.TotalPage = len(data.Pages) - 1
+
+	data.Title = "Overboard"
+	data.Boards = activitypub.Boards
+	data.Key = config.Key
+	data.Board.Name = "overboard"
+	data.Board.PrefName = "Overboard"
+	data.Board.Summary = "Threads from every board"
+	data.Board.Domain = config.Domain
+	data.Board.Actor = actor
+	data.Board.Restricted = data.SFW
+	data.Acct = acct
+	data.Instance = actor
+
+	data.Meta.Description = data.Board.Summary
+	data.Meta.Url = config.Domain + "/overboard"
+	data.Meta.Title = data.Title
+
+	data.Themes = config.Themes
+	data.ThemeCookie = themeCookie(ctx)
+
+	if catalog {
+		return ctx.Render("overboard_catalog", data, "layouts/main")
+	}
+
+	return ctx.Render("overboard", data, "layouts/main")
+}
+
+// Overboard shows the threads on every board, latest bumped first.
+func Overboard(ctx *fiber.Ctx) error {
+	return overboard(ctx, false)
+}
+
+// OverboardCatalog shows the overboard as a catalog.
+func OverboardCatalog(ctx *fiber.Ctx) error {
+	return overboard(ctx, true)
+}
+
+// OverboardSettings remembers which boards a visitor wants left out of the
+// overboard, and whether they only want to see what is safe for work.
+func OverboardSettings(ctx *fiber.Ctx) error {
+	var exclude []string
+	for _, name := range ctx.Request().PostArgs().PeekMulti("exclude") {
+		if _, ok := findBoard(string(name)); ok {
+			exclude = append(exclude, string(name))
+		}
+	}
+
+	sfw := ""
+	if ctx.FormValue("sfw") != "" {
+		sfw = "1"
+	}
+
+	expires := time.Now().UTC().AddDate(1, 0, 0)
+
+	ctx.Cookie(&fiber.Cookie{
+		Name:     "overboard-exclude",
+		Value:    strings.Join(exclude, ","),
+		Expires:  expires,
+		HTTPOnly: true,
+	})
+
+	ctx.Cookie(&fiber.Cookie{
+		Name:     "overboard-sfw",
+		Value:    sfw,
+		Expires:  expires,
+		HTTPOnly: true,
+	})
+
+	if ctx.FormValue("catalog") != "" {
+		return ctx.Redirect("/overboard/catalog", http.StatusSeeOther)
+	}
+
+	return ctx.Redirect("/overboard", http.StatusSeeOther)
+}
@@ -0,0 +1,137 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/util"
+	"github.com/gofiber/fiber/v2"
+)
+
+// parsePoll reads the poll a new thread is being posted with, if any.
+// Its errors are meant for the poster.
+func parsePoll(ctx *fiber.Ctx) (activitypub.Poll, error) {
+	var choices []string
+
+	for _, line := range strings.Split(ctx.FormValue("poll"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || util.IsInStringArray(choices, line) {
+			continue
+		}
+
+		if len(line) > 100 {
+			return activitypub.Poll{}, errors.New("Poll choices may contain at most 100 characters.")
+		}
+
+		choices = append(choices, line)
+	}
+
+	if len(choices) == 0 {
+		return activitypub.Poll{}, nil
+	} else if len(choices) < 2 {
+		return activitypub.Poll{}, errors.New("Polls need at least two choices.")
+	} else if len(choices) > config.PollChoices {
+		return activitypub.Poll{}, fmt.Errorf("Polls may have at most %d choices.", config.PollChoices)
+	}
+
+	hours, err := strconv.Atoi(ctx.FormValue("pollhours", "24"))
+	if err != nil || hours < 1 || hours > 720 {
+		return activitypub.Poll{}, errors.New("Polls may last between an hour and 30 days.")
+	}
+
+	end := time.Now().UTC().Add(time.Duration(hours) * time.Hour)
+	return activitypub.NewPoll(choices, ctx.FormValue("pollmultiple") != "", end), nil
+}
+
+// PollVote casts the vote of a poster in a poll.
+// Each poster identity may vote once.
+func PollVote(ctx *fiber.Ctx) error {
+	actor, err := activitypub.GetActorByNameFromDB(ctx.FormValue("board"))
+	if err != nil {
+		return send404(ctx, "Board not found")
+	}
+
+	if banned, err := checkBan(ctx, actor.Name); err != nil {
+		return send500(ctx, err)
+	} else if banned {
+		return nil
+	}
+
+	poll := activitypub.ObjectBase{Id: ctx.FormValue("poll")}
+
+	p, err := poll.GetPoll()
+	if err != nil {
+		return send500(ctx, err)
+	} else if len(p.Choices()) == 0 {
+		return send404(ctx)
+	} else if p.Closed() {
+		return send403(ctx, "This poll has closed.")
+	}
+
+	var names []string
+	for _, v := range ctx.Request().PostArgs().PeekMulti("choice") {
+		name := string(v)
+		if !p.HasChoice(name) {
+			return send400(ctx, "That is not one of the choices.")
+		} else if !util.IsInStringArray(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return send400(ctx, "Pick a choice to vote for.")
+	} else if len(names) > 1 && !p.Multiple() {
+		return send400(ctx, "This poll only takes one choice.")
+	}
+
+	source := identitySource(ctx)
+
+	identities, err := db.PosterIdentities(source)
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	if counted, err := poll.Vote(identities, names); err != nil {
+		return send500(ctx, err)
+	} else if !counted {
+		return send403(ctx, "You have already voted in this poll.")
+	}
+
+	local, _ := poll.IsLocal()
+
+	// The instance hosting the poll only learns who voted by a per-thread
+	// ID, the same one posts get
+	var voter string
+	if !local {
+		if voter, err = db.ThreadPosterID(source, poll.Id); err != nil {
+			return send500(ctx, err)
+		}
+	}
+
+	go func() {
+		var err error
+		if local {
+			err = poll.UpdateRequest()
+		} else {
+			err = poll.SendVote(actor, voter, names)
+		}
+
+		if err != nil {
+			log.Printf("Failed to federate vote in %s: %v", poll.Id, err)
+		}
+	}()
+
+	if !local {
+		return ctx.Redirect("/"+actor.Name+"/"+util.RemoteShort(poll.Id), http.StatusSeeOther)
+	}
+
+	return ctx.Redirect(poll.Id, http.StatusSeeOther)
+}
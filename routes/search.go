@@ -0,0 +1,240 @@
+package routes
+
+import (
+	"errors"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/activitypub"
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/db"
+	"github.com/KushBlazingJudah/fedichan/util"
+	"github.com/gofiber/fiber/v2"
+)
+
+// searchPageSize is how many results are shown at a time.
+const searchPageSize = 20
+
+type searchResult struct {
+	Post    activitypub.ObjectBase
+	Board   activitypub.Board
+	Thread  activitypub.ObjectBase
+	Snippet template.HTML
+}
+
+type searchPage struct {
+	common
+
+	Terms    string
+	BoardSel string
+	Since    string
+	Until    string
+	HasFile  bool
+	TripCode string
+
+	Results []searchResult
+	Total   int
+	Prev    string
+	Next    string
+}
+
+// parseSearch reads a search from the query string of a request, along with
+// the page of results asked for.
+// Its errors are meant for the searcher.
+func parseSearch(ctx *fiber.Ctx) (activitypub.SearchQuery, int, error) {
+	q := activitypub.SearchQuery{
+		Terms:    strings.TrimSpace(ctx.Query("q")),
+		HasFile:  ctx.Query("file") != "",
+		TripCode: strings.TrimSpace(ctx.Query("tripcode")),
+		Limit:    searchPageSize,
+	}
+
+	if len(q.Terms) > 200 {
+		return q, 0, errors.New("Searches may contain at most 200 characters.")
+	}
+
+	if name := ctx.Query("board"); name != "" {
+		board, ok := findBoard(name)
+		if !ok {
+			return q, 0, errors.New("There is no board by that name.")
+		}
+
+		q.Board = board.Actor.Id
+	}
+
+	var err error
+	if v := ctx.Query("since"); v != "" {
+		if q.Since, err = time.Parse("2006-01-02", v); err != nil {
+			return q, 0, errors.New("Dates must look like 2006-01-02.")
+		}
+	}
+
+	if v := ctx.Query("until"); v != "" {
+		if q.Until, err = time.Parse("2006-01-02", v); err != nil {
+			return q, 0, errors.New("Dates must look like 2006-01-02.")
+		}
+
+		// Until the end of that day
+		q.Until = q.Until.AddDate(0, 0, 1)
+	}
+
+	page, _ := strconv.Atoi(ctx.Query("page"))
+	if page < 0 {
+		page = 0
+	}
+
+	q.Offset = page * searchPageSize
+
+	return q, page, nil
+}
+
+// findBoard returns the local board called name.
+func findBoard(name string) (activitypub.Board, bool) {
+	for _, b := range activitypub.Boards {
+		if b.Name == name && b.Actor.Id == config.Domain+"/"+b.Name {
+			return b, true
+		}
+	}
+
+	return activitypub.Board{}, false
+}
+
+// boardShows reports whether the thread op is shown on b, which is so if it
+// was posted there or to a board b follows.
+func boardShows(b activitypub.Board, op activitypub.ObjectBase) (bool, error) {
+	if op.Actor == b.Actor.Id {
+		return true, nil
+	}
+
+	following, err := b.Actor.GetFollowing()
+	if err != nil {
+		return false, util.WrapError(err)
+	}
+
+	for _, f := range following {
+		if f.Id == op.Actor {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Search shows the posts matching a search, local and cached.
+func Search(ctx *fiber.Ctx) error {
+	acct, _ := ctx.Locals("acct").(*db.Acct)
+
+	actor, err := activitypub.GetActorFromDB(config.Domain)
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	q, page, err := parseSearch(ctx)
+	if err != nil {
+		return send400(ctx, err.Error())
+	}
+
+	var data searchPage
+	data.Title = "Search"
+	data.Boards = activitypub.Boards
+	data.Key = config.Key
+	data.Board.Domain = config.Domain
+	data.Board.Actor = actor
+	data.Board.Restricted = actor.Restricted
+	data.Acct = acct
+	data.Instance = actor
+
+	data.Terms = q.Terms
+	data.BoardSel = ctx.Query("board")
+	data.Since = ctx.Query("since")
+	data.Until = ctx.Query("until")
+	data.HasFile = q.HasFile
+	data.TripCode = q.TripCode
+
+	if q.Terms != "" {
+		results, total, err := activitypub.Search(q)
+		if err != nil {
+			return send500(ctx, err)
+		}
+
+		boards := make(map[string]activitypub.Board)
+		for _, b := range activitypub.Boards {
+			b.SpoilerImage, _ = b.Actor.SpoilerImage()
+			boards[b.Actor.Id] = b
+		}
+
+		for _, r := range results {
+			board, ok := boards[r.Board]
+			if !ok {
+				if board.Actor, err = activitypub.GetActorFromDB(r.Board); err != nil {
+					return send500(ctx, err)
+				}
+
+				board.Name = board.Actor.Name
+				board.Restricted = board.Actor.Restricted
+				board.SpoilerImage, _ = board.Actor.SpoilerImage()
+				boards[r.Board] = board
+			}
+
+			data.Results = append(data.Results, searchResult{
+				Post:    r.Post,
+				Board:   board,
+				Thread:  activitypub.ObjectBase{Id: r.OP},
+				Snippet: template.HTML(r.Snippet),
+			})
+		}
+
+		data.Total = total
+
+		link := func(page int) string {
+			v, _ := url.ParseQuery(string(ctx.Request().URI().QueryString()))
+			v.Set("page", strconv.Itoa(page))
+			return "/search?" + v.Encode()
+		}
+
+		if page > 0 {
+			data.Prev = link(page - 1)
+		}
+
+		if q.Offset+len(results) < total {
+			data.Next = link(page + 1)
+		}
+	}
+
+	data.Meta.Description = data.Title
+	data.Meta.Url = config.Domain + "/search"
+	data.Meta.Title = data.Title
+
+	data.Themes = config.Themes
+	data.ThemeCookie = themeCookie(ctx)
+
+	return ctx.Render("search", data, "layouts/main")
+}
+
+// SearchAPI returns the posts matching a search as JSON.
+// It takes the same parameters as the search page.
+func SearchAPI(ctx *fiber.Ctx) error {
+	q, _, err := parseSearch(ctx)
+	if err != nil {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	} else if q.Terms == "" {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Search for something."})
+	}
+
+	results, total, err := activitypub.Search(q)
+	if err != nil {
+		return send500(ctx, err)
+	}
+
+	if results == nil {
+		results = []activitypub.SearchResult{}
+	}
+
+	return ctx.JSON(fiber.Map{
+		"total":   total,
+		"results": results,
+	})
+}
@@ -34,6 +34,10 @@ type pageData struct {
 	BoardRemainer     []int
 	PostType          string
 	Blotters          []string
+	DeletePassword    string
+	Catalog           activitypub.CatalogQuery
+	CatalogSorts      []string
+	Instances         []string
 }
 
 type errorData struct {
@@ -42,6 +46,11 @@ type errorData struct {
 	Error   error
 }
 
+type banPage struct {
+	common
+	Ban db.Ban
+}
+
 type adminPage struct {
 	common
 
@@ -51,16 +60,36 @@ type adminPage struct {
 	Domain        string
 	IsLocal       bool
 	PostBlacklist []util.PostBlacklist
+	MediaBans     []util.MediaBan
+	Bans          []db.Ban
+	Ban           db.Ban
 	AutoSubscribe bool
+	FloodLimits   activitypub.FloodLimits
+	ThreadLimits  activitypub.ThreadLimits
 	RecentPosts   []activitypub.ObjectBase
 	Reports       map[string][]db.Reports
 	Users         []db.Acct
 	User          *db.Acct
 }
 
+// threadView is what the thread and catalog item partials show a thread with.
+type threadView struct {
+	Board  activitypub.Board
+	Thread activitypub.ObjectBase
+	Acct   *db.Acct
+	Trunc  bool
+
+	// Badge shows the board the thread is on, for pages with threads from
+	// more than one.
+	Badge bool
+}
+
 type meta struct {
 	Title       string
 	Description string
 	Url         string
 	Preview     string
+
+	// Feed is where the feeds of the page are, without the extension.
+	Feed string
 }
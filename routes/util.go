@@ -1,16 +1,18 @@
 package routes
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"html"
 	"html/template"
-	"io"
 	"log"
-	"mime/multipart"
-	"os"
-	"os/exec"
+	"math"
+	"net"
+	"net/http"
 	"regexp"
 	"strings"
 	"time"
@@ -67,7 +69,8 @@ func getActorPost(ctx *fiber.Ctx) error {
 	return nil
 }
 
-func newPost(actor activitypub.Actor, nObj *activitypub.ObjectBase) error {
+// newPost writes nObj, a post made on actor by the poster known by source.
+func newPost(actor activitypub.Actor, nObj *activitypub.ObjectBase, source string) error {
 	nObj.Actor = config.Domain + "/" + actor.Name
 
 	if locked, _ := nObj.InReplyTo[0].IsLocked(); locked {
@@ -80,6 +83,27 @@ func newPost(actor activitypub.Actor, nObj *activitypub.ObjectBase) error {
 	}
 	*nObj = _nObj
 
+	if err := db.WriteIdentity(nObj.Id, source); err != nil {
+		log.Printf("Failed to write poster identity: %v", err)
+	}
+
+	// Threads don't have an ID to derive poster IDs from until they are
+	// written
+	if actor.PosterIDs() {
+		op := nObj.Id
+		if nObj.InReplyTo[0].Id != "" {
+			op = nObj.InReplyTo[0].Id
+		}
+
+		if nObj.PosterID, err = db.ThreadPosterID(source, op); err != nil {
+			return util.WrapError(err)
+		}
+
+		if err := nObj.SetPosterID(); err != nil {
+			return util.WrapError(err)
+		}
+	}
+
 	if len(nObj.To) == 0 {
 		if err := actor.ArchivePosts(); err != nil {
 			return util.WrapError(err)
@@ -123,13 +147,66 @@ func timeToUnix(t time.Time) string {
 	return fmt.Sprint(t.Unix())
 }
 
+// posterIDColor picks a background colour for a poster ID that dark text can
+// be read on top of.
+func posterIDColor(id string) string {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+
+	// HSL with a fixed saturation and lightness, converted to RGB
+	hue := float64(h.Sum32()%360) / 60
+	const s, l = 0.6, 0.75
+
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(hue, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch int(hue) {
+	case 0:
+		r, g, b = c, x, 0
+	case 1:
+		r, g, b = x, c, 0
+	case 2:
+		r, g, b = 0, c, x
+	case 3:
+		r, g, b = 0, x, c
+	case 4:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x", int((r+m)*255), int((g+m)*255), int((b+m)*255))
+}
+
+// postTmpl is the post partial, which posts are rendered with on their own.
+var postTmpl *template.Template
+
+// executePost renders p, a post in thread t on board b, as it is shown to a.
+func executePost(p activitypub.ObjectBase, b activitypub.Board, t activitypub.ObjectBase, a *db.Acct, trunc bool) (template.HTML, error) {
+	buf := &strings.Builder{}
+	if err := postTmpl.ExecuteTemplate(buf, "post", struct {
+		Board  activitypub.Board
+		Acct   *db.Acct
+		Thread activitypub.ObjectBase
+		Post   activitypub.ObjectBase
+		Trunc  bool
+	}{b, a, t, p, trunc}); err != nil {
+		return "", err
+	}
+
+	return template.HTML(buf.String()), nil
+}
+
 func TemplateFunctions(engine *fhtml.Engine) {
-	postTmpl := template.Must(template.New("").Funcs(template.FuncMap{
+	postTmpl = template.Must(template.New("").Funcs(template.FuncMap{
 		"convertSize":        util.ConvertSize,
 		"isOnion":            util.IsOnion,
 		"parseAttachment":    parseAttachment,
 		"parseContent":       db.ParseContent,
 		"parseReplyLink":     parseReplyLink,
+		"posterIDColor":      posterIDColor,
 		"proxy":              util.MediaProxy,
 		"shortImg":           util.ShortImg,
 		"timeToReadableLong": timeToReadableLong,
@@ -174,6 +251,7 @@ func TemplateFunctions(engine *fhtml.Engine) {
 	engine.AddFunc("isOnion", util.IsOnion)
 
 	engine.AddFunc("parseReplyLink", parseReplyLink)
+	engine.AddFunc("posterIDColor", posterIDColor)
 
 	engine.AddFunc("shortExcerpt", func(post activitypub.ObjectBase) template.HTML {
 		var returnString string
@@ -237,77 +315,154 @@ func TemplateFunctions(engine *fhtml.Engine) {
 		return true
 	})
 
+	engine.AddFunc("threadView", func(b activitypub.Board, t activitypub.ObjectBase, a *db.Acct, trunc, badge bool) threadView {
+		return threadView{Board: b, Thread: t, Acct: a, Trunc: trunc, Badge: badge}
+	})
+
 	engine.AddFunc("renderPost", func(p activitypub.ObjectBase, b activitypub.Board, t activitypub.ObjectBase, a *db.Acct, trunc bool) template.HTML {
-		buf := &strings.Builder{}
-		if err := postTmpl.ExecuteTemplate(buf, "post", struct {
-			Board  activitypub.Board
-			Acct   *db.Acct
-			Thread activitypub.ObjectBase
-			Post   activitypub.ObjectBase
-			Trunc  bool
-		}{b, a, t, p, trunc}); err != nil {
+		html, err := executePost(p, b, t, a, trunc)
+		if err != nil {
 			// A panic is fine in this context
 			panic(err)
 		}
 
-		return template.HTML(buf.String())
+		return html
 	})
 }
 
-func objectFromForm(ctx *fiber.Ctx, obj activitypub.ObjectBase) (activitypub.ObjectBase, error) {
-	acct, _ := ctx.Locals("acct").(*db.Acct)
+// clientIP returns the address of the client making a request.
+// Behind a reverse proxy, it is the last address the proxy put in
+// config.ProxyHeader; anything before it came from the client.
+func clientIP(ctx *fiber.Ctx) net.IP {
+	addr := ctx.IP()
 
-	var err error
-	var file multipart.File
+	if config.ProxyHeader != "" {
+		if h := ctx.Get(config.ProxyHeader); h != "" {
+			addrs := strings.Split(h, ",")
+			addr = strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
 
-	header, _ := ctx.FormFile("file")
+	return net.ParseIP(addr)
+}
 
-	if header != nil {
-		file, _ = header.Open()
+// viaOnion reports whether a request came over Tor.
+// Only the instance's configuration can say so; the host a request names is
+// up to whoever sends it.
+// Requests to onion instances all come over Tor, and others have them come
+// in on config.OnionListen.
+func viaOnion(ctx *fiber.Ctx) bool {
+	if util.IsOnion(config.Domain) {
+		return true
+	} else if config.OnionListen == "" {
+		return false
 	}
 
-	if file != nil {
-		defer file.Close()
-		var tempFile = new(os.File)
+	_, port, _ := net.SplitHostPort(config.OnionListen)
+	_, local, _ := net.SplitHostPort(ctx.Context().LocalAddr().String())
 
-		obj.Attachment, tempFile, err = activitypub.CreateAttachmentObject(file, header)
-		if err != nil {
-			return obj, util.WrapError(err)
-		}
-		defer tempFile.Close()
+	return port != "" && port == local
+}
 
-		if _, err := io.Copy(tempFile, file); err != nil {
-			return obj, util.WrapError(err)
+// identitySource returns what tells the poster making a request apart from
+// others.
+// Everyone visiting over Tor comes from the same place, so they are given a
+// token to keep in a cookie instead.
+func identitySource(ctx *fiber.Ctx) string {
+	if viaOnion(ctx) {
+		token := ctx.Cookies("ident")
+		if token == "" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			token = hex.EncodeToString(b)
 		}
 
-		re := regexp.MustCompile(`image/(jpe?g|png|webp)`)
-		if re.MatchString(obj.Attachment[0].MediaType) {
-			fileLoc := strings.ReplaceAll(obj.Attachment[0].Href, config.Domain, "")
+		ctx.Cookie(&fiber.Cookie{
+			Name:     "ident",
+			Value:    token,
+			Expires:  time.Now().UTC().AddDate(1, 0, 0),
+			HTTPOnly: true,
+		})
 
-			cmd := exec.Command("exiv2", "rm", "."+fileLoc)
+		return "token:" + token
+	}
 
-			if err := cmd.Run(); err != nil {
-				return obj, util.WrapError(err)
-			}
+	ip := clientIP(ctx)
+	if ip == nil {
+		return "ip:"
+	}
+
+	// IPv6 users usually have a whole /64 to pick addresses from
+	if ip.To4() == nil {
+		ip = ip.Mask(net.CIDRMask(64, 128))
+	}
+
+	return "ip:" + ip.String()
+}
+
+// deletePassword returns the password the poster wants to be able to delete
+// their post with, remembering it for next time.
+// Posters that don't give one are assigned one.
+func deletePassword(ctx *fiber.Ctx) string {
+	pass := ctx.FormValue("password")
+	if pass == "" {
+		pass = ctx.Cookies("delpass")
+	}
+
+	if pass == "" {
+		pass = db.NewDeletePassword()
+	}
+
+	ctx.Cookie(&fiber.Cookie{
+		Name:     "delpass",
+		Value:    pass,
+		Expires:  time.Now().UTC().AddDate(1, 0, 0),
+		HTTPOnly: true,
+	})
+
+	return pass
+}
+
+// objectFromForm makes a post out of the form ctx was sent with.
+// file holds the contents of the uploaded file, if there is one, as read by
+// MakeActorPost.
+// Errors about the file itself are returned as they are; see uploadError.
+func objectFromForm(ctx *fiber.Ctx, obj activitypub.ObjectBase, file []byte) (activitypub.ObjectBase, error) {
+	acct, _ := ctx.Locals("acct").(*db.Acct)
+
+	var err error
+
+	if header, _ := ctx.FormFile("file"); header != nil && file != nil {
+		obj.Attachment, obj.Preview, err = activitypub.CreateAttachmentObject(file, header.Filename, http.DetectContentType(file))
+		if err != nil {
+			return obj, err
 		}
 
-		obj.Preview = obj.Attachment[0].CreatePreview()
+		for i := range obj.Attachment {
+			obj.Attachment[i].Spoiler = ctx.FormValue("spoiler") != ""
+		}
 	}
 
-	name, tripcode, _ := db.CreateNameTripCode(ctx.FormValue("name"), acct)
+	name, tripcode, capcode, _ := db.CreateNameTripCode(ctx.FormValue("name"), acct)
 
 	obj.AttributedTo = name
 	obj.TripCode = tripcode
+	obj.Capcode = capcode
 	obj.Name = ctx.FormValue("subject")
 	obj.Content = ctx.FormValue("comment")
 	obj.Sensitive = (ctx.FormValue("sensitive") != "")
 	obj.Option = parseOptions(ctx)
+	obj.DeletePassword = db.HashDeletePassword(deletePassword(ctx))
 
 	var originalPost activitypub.ObjectBase
 
 	originalPost.Id = html.EscapeString(ctx.FormValue("inReplyTo"))
 	obj.InReplyTo = append(obj.InReplyTo, originalPost)
 
+	if originalPost.Id == "" {
+		obj.Poll, _ = parsePoll(ctx)
+	}
+
 	var activity activitypub.Activity
 
 	if !util.IsInStringArray(activity.To, originalPost.Id) {
@@ -372,9 +527,9 @@ func parseAttachment(obj activitypub.ObjectBase, catalog bool) template.HTML {
 	}
 
 	if strings.HasPrefix(obj.Attachment[0].MediaType, "image/") {
-		src := obj.Preview.Href
-		if src == "" {
-			src = obj.Attachment[0].Href
+		src := obj.Attachment[0].Href
+		if obj.Preview != nil && obj.Preview.Href != "" {
+			src = obj.Preview.Href
 		}
 		src = util.MediaProxy(src)
 
@@ -459,3 +614,4 @@ func send500(ctx *fiber.Ctx, err error, msg ...string) error {
 var send400 = statusTemplate(400)
 var send403 = statusTemplate(403)
 var send404 = statusTemplate(404)
+var send429 = statusTemplate(429)
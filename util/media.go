@@ -0,0 +1,191 @@
+package util
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/media"
+)
+
+// RemoteMediaLimit is the largest remote file we will download to check
+// against the media bans; it matches the upload limit.
+const RemoteMediaLimit = 7 << 20
+
+type MediaBan struct {
+	Id    int
+	Hash  string
+	PHash bool
+	Added time.Time
+
+	// Legacy bans were made by older versions, which hashed only part of
+	// each file, and match nothing.
+	Legacy bool
+}
+
+// MediaMatch is what files caught by a media ban are found by.
+type MediaMatch struct {
+	// Hashes are the SHA-256 hashes the file may be known by.
+	Hashes []string
+
+	// PHash is the perceptual hash of the file if it is an image.
+	PHash *int64
+}
+
+// MediaLimits returns the limits uploaded images are held to.
+func MediaLimits() media.Limits {
+	return media.Limits{
+		MaxWidth:  config.MaxImageWidth,
+		MaxHeight: config.MaxImageHeight,
+		MaxPixels: config.MaxImagePixels,
+	}
+}
+
+// FetchMedia downloads a remote file, giving up if it is larger than max
+// bytes.
+func FetchMedia(href string, max int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", href, nil)
+	if err != nil {
+		return nil, WrapError(err)
+	}
+
+	resp, err := RouteProxy(req)
+	if err != nil {
+		return nil, WrapError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", href, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return nil, WrapError(err)
+	} else if int64(len(data)) > max {
+		return nil, fmt.Errorf("fetching %s: file is larger than %d bytes", href, max)
+	}
+
+	return data, nil
+}
+
+// MediaPHash returns the perceptual hash of data, or nil if it isn't an image
+// that can be read.
+func MediaPHash(data []byte, mediaType string) *int64 {
+	if !media.Supported(mediaType) {
+		return nil
+	}
+
+	phash, err := media.PerceptualHash(data, mediaType, MediaLimits())
+	if err != nil {
+		return nil
+	}
+
+	p := int64(phash)
+	return &p
+}
+
+// mediaFingerprint returns what a file and copies of it may be found by.
+// Images are stored after their metadata is stripped, so the hash of the
+// stripped file is included alongside that of data.
+func mediaFingerprint(data []byte, mediaType string) MediaMatch {
+	m := MediaMatch{Hashes: []string{media.Hash(data)}}
+
+	if !media.Supported(mediaType) {
+		return m
+	}
+
+	if _, info, err := media.Sanitize(data, mediaType, MediaLimits()); err == nil && info.Hash != m.Hashes[0] {
+		m.Hashes = append(m.Hashes, info.Hash)
+	}
+
+	m.PHash = MediaPHash(data, mediaType)
+	return m
+}
+
+func DeleteMediaBan(id int) error {
+	query := `delete from bannedmedia where id=$1`
+	_, err := config.DB.Exec(query, id)
+
+	return WrapError(err)
+}
+
+func GetMediaBans() ([]MediaBan, error) {
+	var list []MediaBan
+
+	query := `select id, hash, phash is not null, added, legacy from bannedmedia order by added desc`
+	rows, err := config.DB.Query(query)
+
+	if err != nil {
+		return list, WrapError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var temp MediaBan
+
+		rows.Scan(&temp.Id, &temp.Hash, &temp.PHash, &temp.Added, &temp.Legacy)
+		list = append(list, temp)
+	}
+
+	return list, nil
+}
+
+// IsMediaBanned reports whether data matches a media ban, either exactly or,
+// for images, by being perceptually similar to a banned one.
+func IsMediaBanned(data []byte, mediaType string) (bool, error) {
+	return mediaFingerprint(data, mediaType).Banned()
+}
+
+// Banned reports whether a file found by m is caught by a media ban.
+func (m MediaMatch) Banned() (bool, error) {
+	var id int
+
+	query := `select id from bannedmedia where hash = any($1) and not legacy`
+	if err := config.DB.QueryRow(query, m.Hashes).Scan(&id); err == nil {
+		return true, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return false, WrapError(err)
+	}
+
+	if m.PHash == nil || config.MediaBanDistance < 0 {
+		return false, nil
+	}
+
+	query = `select phash from bannedmedia where phash is not null`
+	rows, err := config.DB.Query(query)
+	if err != nil {
+		return false, WrapError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var banned int64
+		if err := rows.Scan(&banned); err != nil {
+			return false, WrapError(err)
+		}
+
+		if media.Distance(uint64(*m.PHash), uint64(banned)) <= config.MediaBanDistance {
+			return true, nil
+		}
+	}
+
+	return false, WrapError(rows.Err())
+}
+
+// WriteMediaBan bans data and returns what posts carrying it may be found by.
+func WriteMediaBan(data []byte, mediaType string) (MediaMatch, error) {
+	m := mediaFingerprint(data, mediaType)
+
+	// The last hash is the one the file would be stored under
+	hash := m.Hashes[len(m.Hashes)-1]
+
+	query := `insert into bannedmedia (hash, phash) values ($1, $2) on conflict (hash) do nothing`
+	_, err := config.DB.Exec(query, hash, m.PHash)
+
+	return m, WrapError(err)
+}
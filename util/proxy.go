@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/KushBlazingJudah/fedichan/config"
+	"github.com/KushBlazingJudah/fedichan/internal/storage"
 )
 
 func GetPathProxyType(path string) string {
@@ -28,6 +29,13 @@ func MediaProxy(url string) string {
 		return url
 	}
 
+	// Media kept in an object store is served from there directly
+	if storage.Default != nil {
+		if _, ok := storage.Default.Key(url); ok {
+			return url
+		}
+	}
+
 	re = regexp.MustCompile(`(.+)?\.onion(.+)?`)
 	if re.MatchString(url) {
 		return url
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
@@ -136,21 +137,19 @@ func IsInStringArray(haystack []string, needle string) bool {
 	return false
 }
 
-// GetUniqueFilename will look for an available random filename in the /public/ directory.
-func GetUniqueFilename(ext string) string {
-	id := RandomID(8)
-	file := "/public/" + id + "." + ext
+// SameOrigin reports whether two URLs have the same scheme and host.
+func SameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil || ua.Host == "" {
+		return false
+	}
 
-	for {
-		if _, err := os.Stat("." + file); err == nil {
-			id = RandomID(8)
-			file = "/public/" + id + "." + ext
-		} else {
-			return "/public/" + id + "." + ext
-		}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
 	}
 
-	return ""
+	return ua.Scheme == ub.Scheme && strings.EqualFold(ua.Host, ub.Host)
 }
 
 func HashMedia(media string) string {
@@ -170,7 +169,7 @@ func CreateUniqueID(actor string) (string, error) {
 
 	for {
 		newID = RandomID(8)
-		query := "select id from activitystream where id=$1"
+		query := "select id from posts where id=$1"
 		args := fmt.Sprintf("%s/%s/%s", config.Domain, actor, newID)
 
 		if err := config.DB.QueryRow(query, args); err != nil {
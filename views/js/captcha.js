@@ -0,0 +1,23 @@
+// Pages that are cached are shown to everyone, so they come without a captcha
+// and each visitor is given their own here.
+function loadCaptcha() {
+    fetch("/api/captcha", {cache: "no-store"})
+        .then(resp => resp.json())
+        .then(captcha => {
+            for (let input of document.querySelectorAll("input[name=captchaCode]")) {
+                input.value = captcha.id;
+            }
+
+            for (let img of document.querySelectorAll("img.captcha")) {
+                img.src = captcha.image;
+            }
+        });
+}
+
+window.addEventListener("pageshow", function(e) {
+    // Pages coming back from the history may have had their captcha used
+    let missing = Array.from(document.querySelectorAll("input[name=captchaCode]")).some(i => i.value == "");
+    if (missing || e.persisted) {
+        loadCaptcha();
+    }
+});
@@ -1,23 +1,68 @@
 var imgs = document.querySelectorAll('.media');
 
-for (let img of document.getElementsByClassName('media')) {
-    img.addEventListener("click", function(e){
-        var id = img.getAttribute("id");
-        var media = document.getElementById("media-" + id);
-        var sensitive = document.getElementById("sensitive-" + id);     
+// setupPosts makes the posts in root interactive.
+// Posts added after the page has loaded are set up by live updates.
+function setupPosts(root) {
+    for (let img of root.getElementsByClassName('media')) {
+        img.addEventListener("click", function(e){
+            var id = img.getAttribute("id");
+            var media = document.getElementById("media-" + id);
+            var sensitive = document.getElementById("sensitive-" + id);     
         
-        if (img.getAttribute("enlarge") == "0") {
-            var attachment = img.getAttribute("attachment");
-            img.setAttribute("enlarge", "1");
-            img.src = attachment;
-        } else {
-            var preview = img.getAttribute("preview");
-            img.setAttribute("enlarge", "0");
-	    img.src = preview;
-        }
-    });
+            if (img.getAttribute("enlarge") == "0") {
+                var attachment = img.getAttribute("attachment");
+                img.setAttribute("enlarge", "1");
+                img.src = attachment;
+            } else {
+                var preview = img.getAttribute("preview");
+                img.setAttribute("enlarge", "0");
+	        img.src = preview;
+            }
+        });
+    }
+
+	// Setup buttons for sensitive media
+	for (let i of root.getElementsByClassName("mediacont")) {
+		let id = i.id.substr(6); // strip off "media-"
+		if (i.dataset.sensitive) {
+			let sensitive = document.getElementById("sensitive-" + id);
+			let hide = document.getElementById("hide-" + id);
+
+			sensitive.onclick = () => {
+				i.style="display: block;";
+				sensitive.style="display: none;";
+				hide.style="display: block;"
+			};
+			hide.onclick = () => {
+				i.style="display: none;";
+				sensitive.style="display: block;";
+				hide.style="display: none;";
+			}
+		}
+	}
+
+	// Highlight every post by the poster whose ID was clicked
+	for (let i of root.getElementsByClassName("posterid")) {
+		i.onclick = () => {
+			let on = !i.closest(".post").classList.contains("highlight");
+
+			for (let post of document.getElementsByClassName("post")) {
+				post.classList.remove("highlight");
+			}
+
+			if (!on) {
+				return;
+			}
+
+			for (let j of document.querySelectorAll(".posterid[data-posterid=\"" + i.dataset.posterid + "\"]")) {
+				j.closest(".post").classList.add("highlight");
+			}
+		};
+	}
 }
 
+setupPosts(document);
+
 function viewLink(board, actor) {
     var posts = document.querySelectorAll('#view');
     var postsArray = [].slice.call(posts);
@@ -27,23 +72,3 @@ function viewLink(board, actor) {
         p.href = "/" + board + "/" + shortURL(actor, id);
     });
 }
-
-// Setup buttons for sensitive media
-for (let i of document.getElementsByClassName("mediacont")) {
-	let id = i.id.substr(6); // strip off "media-"
-	if (i.dataset.sensitive) {
-		let sensitive = document.getElementById("sensitive-" + id);
-		let hide = document.getElementById("hide-" + id);
-
-		sensitive.onclick = () => {
-			i.style="display: block;";
-			sensitive.style="display: none;";
-			hide.style="display: block;"
-		};
-		hide.onclick = () => {
-			i.style="display: none;";
-			sensitive.style="display: block;";
-			hide.style="display: none;";
-		}
-	}
-}
@@ -0,0 +1,112 @@
+// Live updates for threads and boards.
+// The page to watch is given by the data-events attribute of the script tag,
+// and the thread on it, if there is one, by data-thread.
+(function() {
+    var events = document.currentScript.dataset.events;
+    if (!events || !window.EventSource) {
+        return;
+    }
+
+    var thread = document.currentScript.dataset.thread ? document.querySelector(".thread") : null;
+    var autoreload = document.getElementById("autoreload-checkbox");
+    var source = new EventSource(events);
+    var missed = 0;
+
+    // Reloading is only needed when live updates don't work
+    source.onopen = function() {
+        if (autoreload) {
+            autoreload.parentElement.style.display = "none";
+        }
+    };
+
+    source.onerror = function() {
+        if (autoreload && source.readyState === EventSource.CLOSED) {
+            autoreload.parentElement.style.display = "";
+        }
+    };
+
+    function notice(text) {
+        var n = document.getElementById("live-notice");
+        if (!n) {
+            n = document.createElement("div");
+            n.id = "live-notice";
+            n.className = "box2";
+            n.style = "position: fixed; bottom: 10px; right: 10px; padding: 5px; cursor: pointer;";
+            n.onclick = function() { location.reload(); };
+            document.body.appendChild(n);
+        }
+
+        n.innerText = text;
+    }
+
+    // Replaces the post the event is about, or adds it to the end of the
+    // thread if it is new.
+    function showPost(ev) {
+        var post = document.getElementById(ev.short);
+        if (post) {
+            post.innerHTML = ev.html;
+            setupPosts(post);
+            return;
+        }
+
+        if (!thread || ev.type !== "create") {
+            return;
+        }
+
+        post = document.createElement("div");
+        post.id = ev.short;
+        post.className = "post reply";
+        post.innerHTML = ev.html;
+
+        thread.appendChild(post);
+        thread.appendChild(document.createElement("br"));
+        setupPosts(post);
+
+        var stats = document.getElementById("threadStats");
+        if (stats) {
+            stats.dataset.total = parseInt(stats.dataset.total) + 1;
+            if (ev.post && ev.post.attachment && ev.post.attachment.length > 0) {
+                stats.dataset.imgs = parseInt(stats.dataset.imgs) + 1;
+            }
+
+            stats.innerText = stats.dataset.total + " / " + stats.dataset.imgs;
+        }
+    }
+
+    function update(e) {
+        var ev = JSON.parse(e.data);
+
+        // Boards only say that something happened
+        if (!thread) {
+            missed++;
+            notice(missed + " update" + (missed > 1 ? "s" : "") + ". Click to reload.");
+            return;
+        }
+
+        if (ev.type === "delete") {
+            if (ev.id === ev.thread) {
+                notice("This thread has been deleted.");
+                return;
+            }
+
+            var post = document.getElementById(ev.short);
+            if (post) {
+                if (post.nextElementSibling && post.nextElementSibling.tagName === "BR") {
+                    post.nextElementSibling.remove();
+                }
+
+                post.remove();
+            }
+
+            return;
+        }
+
+        if (ev.html) {
+            showPost(ev);
+        }
+    }
+
+    for (let type of ["create", "delete", "sticky", "lock", "archive", "update"]) {
+        source.addEventListener(type, update);
+    }
+})();